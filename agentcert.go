@@ -1,64 +1,398 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"crypto/ecdsa"
 	"crypto/elliptic"
-	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"github.com/candlerb/sshtokenca/util"
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/crypto/ssh/agent"
-	"log"
+	"net"
+	"strings"
 	"time"
 )
 
-// Given an agent, CA private key, username and some settings, generate
-// an SSH certificate and insert it in the agent.
-func addCertToAgent(agentC agent.ExtendedAgent, caKey ssh.Signer, user *util.UserPrincipals, settings util.Settings) error {
+// Check a certificate presented by a client in place of their registered
+// key. It must be a user certificate from a trusted CA, be currently
+// valid, not revoked, name the user as a principal, and be presented from
+// an address its source-address option allows, if it has one.
+func checkClientCert(cert *ssh.Certificate, settings *util.Settings, c ssh.ConnMetadata) error {
+	if cert.CertType != ssh.UserCert {
+		return fmt.Errorf("certificate is not a user certificate")
+	}
+	if !settings.IsTrustedUserCA(cert.SignatureKey) {
+		return fmt.Errorf("certificate signed by untrusted authority")
+	}
+	// CheckCert takes a certificate without principals to be valid for
+	// any user
+	if !hasPrincipals(cert, []string{c.User()}) {
+		return fmt.Errorf("certificate does not name %s as a principal", c.User())
+	}
+	if settings.RevokedFile != "" {
+		revoked, err := util.LoadRevocations(settings.RevokedFile)
+		if err != nil {
+			return err
+		}
+		if revoked.IsRevoked(cert) {
+			return fmt.Errorf("certificate has been revoked")
+		}
+	}
+	if sourceAddr, ok := cert.CriticalOptions["source-address"]; ok {
+		if err := checkSourceAddress(c.RemoteAddr(), sourceAddr); err != nil {
+			return err
+		}
+	}
+	checker := &ssh.CertChecker{}
+	return checker.CheckCert(c.User(), cert)
+}
+
+// Check addr against the comma separated addresses and CIDR ranges of a
+// certificate's source-address option. x/crypto/ssh only enforces it for
+// the permissions returned by the callback, which here are our own.
+func checkSourceAddress(addr net.Addr, sourceAddr string) error {
+	ip := net.ParseIP(remoteIP(addr))
+	if ip == nil {
+		return fmt.Errorf("remote address %s is not an IP address, but the certificate has a source-address", addr)
+	}
+	for _, s := range strings.Split(sourceAddr, ",") {
+		s = strings.TrimSpace(s)
+		if allowed := net.ParseIP(s); allowed != nil {
+			if allowed.Equal(ip) {
+				return nil
+			}
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(s)
+		if err != nil {
+			return fmt.Errorf("certificate has bad source-address %q: %s", s, err)
+		}
+		if ipNet.Contains(ip) {
+			return nil
+		}
+	}
+	return fmt.Errorf("remote address %s is not allowed by the certificate's source-address", addr)
+}
+
+// Report whether cert has the key id of one issued by this service for user
+func issuedFor(cert *ssh.Certificate, settings *util.Settings, user string) bool {
+	return strings.HasPrefix(cert.KeyId, fmt.Sprintf("%s_%s_from:", settings.Organisation, user))
+}
+
+// Return the certificates in the agent which were issued by this service
+// to user with caKey. The agent's other keys and certificates are left
+// out.
+func agentCerts(agentC agent.Agent, caKey ssh.Signer, user *util.UserPrincipals, settings *util.Settings) ([]*ssh.Certificate, error) {
+	keys, err := agentC.List()
+	if err != nil {
+		return nil, err
+	}
+	caKeyBytes := caKey.PublicKey().Marshal()
+	var certs []*ssh.Certificate
+	for _, k := range keys {
+		pubKey, err := ssh.ParsePublicKey(k.Blob)
+		if err != nil {
+			continue
+		}
+		cert, ok := pubKey.(*ssh.Certificate)
+		if !ok || cert.CertType != user.CertificateType() || !issuedFor(cert, settings, user.Name) {
+			continue
+		}
+		if bytes.Equal(cert.SignatureKey.Marshal(), caKeyBytes) {
+			certs = append(certs, cert)
+		}
+	}
+	return certs, nil
+}
+
+// Return a certificate in the agent which was issued by this service to
+// user with caKey, has all of principals and at least reuse_remaining
+// left, if there is one, so that another need not be issued
+func reusableCert(agentC agent.Agent, caKey ssh.Signer, user *util.UserPrincipals, principals []string,
+	settings *util.Settings) *ssh.Certificate {
+
+	if settings.ReuseRemaining == 0 {
+		return nil
+	}
+	certs, err := agentCerts(agentC, caKey, user, settings)
+	if err != nil {
+		return nil
+	}
+	for _, cert := range certs {
+		validBefore := time.Unix(int64(cert.ValidBefore), 0)
+		if time.Until(validBefore) < settings.ReuseRemaining {
+			continue
+		}
+		if hasPrincipals(cert, principals) {
+			return cert
+		}
+	}
+	return nil
+}
+
+// Remove from the agent the certificates issued by this service to user
+// with caKey which cert supersedes, having none of principals it lacks.
+// A certificate for principals which cert does not have is kept.
+func removeSuperseded(agentC agent.Agent, caKey ssh.Signer, user *util.UserPrincipals, cert *ssh.Certificate,
+	settings *util.Settings) {
+
+	certs, err := agentCerts(agentC, caKey, user, settings)
+	if err != nil {
+		return
+	}
+	removed := 0
+	for _, old := range certs {
+		if old.Serial == cert.Serial || !hasPrincipals(cert, old.ValidPrincipals) {
+			continue
+		}
+		if err := agentC.Remove(old); err != nil {
+			logWarn("agent_remove_failed", logFields{"user": user.Name, "serial": old.Serial, "error": err},
+				"could not remove superseded certificate serial %d from the agent of %s: %s", old.Serial, user.Name, err)
+			continue
+		}
+		removed++
+	}
+	if removed > 0 {
+		logInfo("certificates_superseded", logFields{"user": user.Name, "removed": removed},
+			"removed %d superseded certificates from the agent of %s", removed, user.Name)
+	}
+}
+
+// Report whether cert has all of principals
+func hasPrincipals(cert *ssh.Certificate, principals []string) bool {
+	for _, p := range principals {
+		found := false
+		for _, cp := range cert.ValidPrincipals {
+			if cp == p {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// Insert cert, signed for privKey by caKey, in the agent, with the
+// lifetime and confirmation the settings give the user. Once it is added,
+// the certificates it supersedes are removed.
+func addCertToAgent(agentC agent.ExtendedAgent, privKey *ecdsa.PrivateKey, cert *ssh.Certificate, caKey ssh.Signer,
+	user *util.UserPrincipals, settings *util.Settings) error {
+
+	validity := time.Until(time.Unix(int64(cert.ValidBefore), 0))
+	lifetime := settings.UserAgentLifetime(user)
+	if lifetime > validity {
+		lifetime = validity
+	}
+	err := agentC.Add(agent.AddedKey{
+		PrivateKey:       privKey,
+		Certificate:      cert,
+		LifetimeSecs:     uint32(lifetime.Seconds()),
+		ConfirmBeforeUse: settings.UserAgentConfirm(user),
+		Comment:          agentComment(cert, settings, user),
+	})
+	if err != nil {
+		return err
+	}
+	removeSuperseded(agentC, caKey, user, cert, settings)
+	return nil
+}
+
+// Returned when the client's forwarded agent does not respond within
+// agent_timeout
+var errAgentTimeout = errors.New("agent did not respond in time")
+
+// Run op, which talks to the client's forwarded agent, giving up once ctx
+// is done. abort is then called to unblock op, by closing the channel or
+// connection it waits on, so that a slow or broken agent cannot hold up
+// the session.
+func withAgentTimeout(ctx context.Context, abort func(), op func() error) error {
+	done := make(chan error, 1)
+	go func() { done <- op() }()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		abort()
+		return errAgentTimeout
+	}
+}
+
+// Open the channel to the client's forwarded agent, giving up after
+// timeout. The connection is left open, so that the user can be told, and
+// a channel which opens later is closed.
+func openAgentChannel(sshConn ssh.Conn, timeout time.Duration) (ssh.Channel, <-chan *ssh.Request, error) {
+	type opened struct {
+		ch   ssh.Channel
+		reqs <-chan *ssh.Request
+		err  error
+	}
+	done := make(chan opened, 1)
+	go func() {
+		ch, reqs, err := sshConn.OpenChannel("auth-agent@openssh.com", nil)
+		done <- opened{ch, reqs, err}
+	}()
+	select {
+	case o := <-done:
+		return o.ch, o.reqs, o.err
+	case <-time.After(timeout):
+		go func() {
+			if o := <-done; o.err == nil {
+				go ssh.DiscardRequests(o.reqs)
+				o.ch.Close()
+			}
+		}()
+		return nil, nil, errAgentTimeout
+	}
+}
 
-	// generate a new private key for signing the certificate, and then
-	// derive the public key from it
-	privKey, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+// Generate a new private key for the certificate added to an agent, and
+// derive the public key to be certified from it
+func generateCertKey(settings *util.Settings) (*ecdsa.PrivateKey, ssh.PublicKey, error) {
+	privKey, err := ecdsa.GenerateKey(elliptic.P384(), settings.Random())
 	if err != nil {
-		return fmt.Errorf("Could not generate cert private key %s", err)
+		return nil, nil, fmt.Errorf("Could not generate cert private key %s", err)
 	}
 	pubKey, err := ssh.NewPublicKey(&privKey.PublicKey)
 	if err != nil {
-		return fmt.Errorf("Could not generate cert public key %s", err)
+		return nil, nil, fmt.Errorf("Could not generate cert public key %s", err)
+	}
+	return privKey, pubKey, nil
+}
+
+// Return the comment for a certificate added to an agent, which shows in
+// ssh-add -l
+func agentComment(cert *ssh.Certificate, settings *util.Settings, user *util.UserPrincipals) string {
+	validBefore := time.Unix(int64(cert.ValidBefore), 0).UTC()
+	return fmt.Sprintf("issued by %s for %s serial %d valid until %s",
+		settings.Organisation, user.Name, cert.Serial, validBefore.Format("2006-01-02T15:04MST"))
+}
+
+// Given a public key, CA private key, username, the principals to grant
+// and some settings, generate and sign an SSH certificate for the key and
+// record it in the audit log. The connection metadata is used for the
+// audit log.
+func signCertificate(pubKey ssh.PublicKey, caKey ssh.Signer, user *util.UserPrincipals, principals []string,
+	settings *util.Settings, conn *ssh.ServerConn) (*ssh.Certificate, error) {
+
+	cert, err := newUserCert(pubKey, caKey, user, principals, settings)
+	if err != nil {
+		return nil, err
+	}
+	err = signCert(cert, caKey, settings)
+	if err != nil {
+		return nil, err
 	}
+	// the validity as signed, which a CA such as Vault sets itself
+	fromT := time.Unix(int64(cert.ValidAfter), 0).UTC()
+	toT := time.Unix(int64(cert.ValidBefore), 0).UTC()
+
+	kex, cipher, mac := connAlgorithms(conn.Permissions)
+	err = recordIssue(settings, auditRecord{
+		Timestamp:      time.Now().UTC(),
+		User:           user.Name,
+		Serial:         cert.Serial,
+		KeyID:          cert.KeyId,
+		Principals:     cert.ValidPrincipals,
+		ValidAfter:     fromT,
+		ValidBefore:    toT,
+		RemoteAddr:     conn.RemoteAddr().String(),
+		ClientVersion:  string(conn.ClientVersion()),
+		KeyFingerprint: clientKeyFingerprint(conn.Permissions),
+		SessionID:      hex.EncodeToString(conn.SessionID()),
+		ServerVersion:  string(conn.ServerVersion()),
+		Kex:            kex,
+		Cipher:         cipher,
+		MAC:            mac,
+	})
+	if err != nil {
+		// don't hand out a certificate we have no record of
+		return nil, err
+	}
+	recentIssues.Issued(connTenant(conn.Permissions), user.Name, settings.IssueCooldown)
+
+	if user.HasWildcardPrincipal() {
+		logWarn("wildcard_principal", logFields{"user": user.Name, "principals": principals},
+			"WARNING: issuing certificate with wildcard principal for %s principals %s", user.Name, principals)
+	}
+	logInfo("certificate_issued", logFields{"user": user.Name, "serial": cert.Serial, "principals": principals, "key_id": cert.KeyId, "valid_before": toT},
+		"completed making certificate for %s principals %s expiring %s", user.Name, principals, toT.Format("2006-01-02T15:04MST"))
+	return cert, nil
+}
+
+// Build the unsigned certificate for a user's public key, with the
+// principals to grant, its validity and extensions set from the settings.
+// A user with cert_type host is given a host certificate, without
+// extensions. Fails if the CA key's certificate has expired.
+func newUserCert(pubKey ssh.PublicKey, caKey ssh.Signer, user *util.UserPrincipals, principals []string,
+	settings *util.Settings) (*ssh.Certificate, error) {
 
 	fromT := time.Now().UTC()
-	toT := time.Now().UTC().Add(settings.Validity)
+	toT := fromT.Add(settings.Validity)
+	if settings.ValidityRounding > 0 {
+		// round down so that the configured validity is never exceeded
+		toT = toT.Truncate(settings.ValidityRounding)
+	}
+	if expiry := user.Expiry(); !expiry.IsZero() && toT.After(expiry) {
+		// never outlive the user's account
+		toT = expiry.UTC()
+	}
+	toT, err := clampToCA(toT, caKey, user.Name)
+	if err != nil {
+		return nil, err
+	}
 	fmtF := "2006-01-02T15:04"
 	fmtT := "2006-01-02T15:04MST"
 	timeStamp := fmt.Sprintf("from:%s_to:%s", fromT.Format(fmtF), toT.Format(fmtT))
 	identifier := fmt.Sprintf("%s_%s_%s", settings.Organisation, user.Name, timeStamp)
 	permissions := ssh.Permissions{}
-	permissions.Extensions = settings.Extensions
+	permissions.Extensions = settings.UserExtensions(user)
 
-	cert := &ssh.Certificate{
-		CertType:        ssh.UserCert,
+	return &ssh.Certificate{
+		CertType:        user.CertificateType(),
 		Key:             pubKey,
+		Serial:          util.NextSerial(),
 		KeyId:           identifier,
-		ValidAfter:      uint64(fromT.Unix()),
+		ValidAfter:      uint64(fromT.Add(-*settings.ValidAfterSkew).Unix()),
 		ValidBefore:     uint64(toT.Unix()),
-		ValidPrincipals: user.Principals,
+		ValidPrincipals: principals,
 		Permissions:     permissions,
+	}, nil
+}
+
+// Return toT, or the expiry of the CA key's own certificate if that is
+// earlier, so that certificates never outlive the CA which signed them.
+// Nothing may be signed once the CA certificate has expired, or before
+// it is valid.
+func clampToCA(toT time.Time, caKey ssh.Signer, name string) (time.Time, error) {
+	caExpiry, err := util.CheckCAValidity(caKey, time.Now())
+	if err != nil {
+		return toT, err
 	}
-	if err := cert.SignCert(rand.Reader, caKey); err != nil {
-		return fmt.Errorf("cert signing error: %s", err)
+	if caExpiry.IsZero() || !toT.After(caExpiry) {
+		return toT, nil
 	}
+	caExpiry = caExpiry.UTC()
+	logInfo("validity_clamped", logFields{"user": name, "valid_before": toT, "ca_expiry": caExpiry},
+		"shortening certificate for %s to expire with the CA certificate at %s", name, caExpiry.Format(time.RFC3339))
+	return caExpiry, nil
+}
 
-	err = agentC.Add(agent.AddedKey{
-		PrivateKey:   privKey,
-		Certificate:  cert,
-		LifetimeSecs: uint32(settings.Validity.Seconds()),
-		Comment:      identifier,
-	})
+// Sign cert with the CA key, waiting for the signing rate limit, with
+// the signature_algorithm and random_source of the settings
+func signCert(cert *ssh.Certificate, caKey ssh.Signer, settings *util.Settings) error {
+	wait, err := signingLimiter.Wait(settings.SigningRate, settings.SigningBurst)
+	metrics.SigningWait(wait)
 	if err != nil {
+		return err
+	}
+	if err := util.SignCert(cert, caKey, settings.SignatureAlgorithm, settings.Random()); err != nil {
 		return fmt.Errorf("cert signing error: %s", err)
 	}
-
-	log.Printf("completed making certificate for %s principals %s expiring %s", user.Name, user.Principals, toT.Format(fmtT))
 	return nil
 }
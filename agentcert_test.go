@@ -0,0 +1,102 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// An agent which records the keys added to it, as decoded from the agent
+// protocol, the way a client's forwarded agent receives them
+type recordingAgent struct {
+	agent.Agent
+	added []agent.AddedKey
+}
+
+func (a *recordingAgent) Add(key agent.AddedKey) error {
+	a.added = append(a.added, key)
+	return a.Agent.Add(key)
+}
+
+func TestAddCertToAgentConstraints(t *testing.T) {
+	caKey := newTestSigner(t)
+	userKey := newTestSigner(t)
+	settings := loadTestSettings(t, fmt.Sprintf(`validity: 1h
+organisation: acme
+agent_lifetime: 30m
+user_principals:
+    - name: bob
+      authorized_key: %s
+      principals: [web]
+    - name: jane
+      authorized_key: %s
+      principals: [db]
+      agent_confirm: true
+      agent_lifetime: 10m
+`, ssh.MarshalAuthorizedKey(userKey.PublicKey()), ssh.MarshalAuthorizedKey(userKey.PublicKey())))
+
+	for _, tc := range []struct {
+		name     string
+		confirm  bool
+		lifetime uint32
+	}{
+		{"bob", false, 30 * 60},
+		{"jane", true, 10 * 60},
+	} {
+		user, err := settings.UserByName(tc.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		privKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pubKey, err := ssh.NewPublicKey(&privKey.PublicKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cert := &ssh.Certificate{
+			Key:             pubKey,
+			CertType:        ssh.UserCert,
+			KeyId:           tc.name,
+			ValidPrincipals: user.Principals,
+			ValidAfter:      uint64(time.Now().Add(-time.Minute).Unix()),
+			ValidBefore:     uint64(time.Now().Add(time.Hour).Unix()),
+		}
+		if err := cert.SignCert(rand.Reader, caKey); err != nil {
+			t.Fatal(err)
+		}
+
+		// the agent is reached over an in-memory channel, so that the
+		// constraints pass through the agent protocol
+		recorder := &recordingAgent{Agent: agent.NewKeyring()}
+		client, server := net.Pipe()
+		go agent.ServeAgent(recorder, server)
+		err = addCertToAgent(agent.NewClient(client), privKey, cert, caKey, user, &settings)
+		client.Close()
+		if err != nil {
+			t.Fatalf("could not add certificate for %s: %v", tc.name, err)
+		}
+
+		if len(recorder.added) != 1 {
+			t.Fatalf("%d keys added for %s, want 1", len(recorder.added), tc.name)
+		}
+		added := recorder.added[0]
+		if added.ConfirmBeforeUse != tc.confirm {
+			t.Errorf("%s added with ConfirmBeforeUse %v, want %v", tc.name, added.ConfirmBeforeUse, tc.confirm)
+		}
+		if added.LifetimeSecs != tc.lifetime {
+			t.Errorf("%s added with LifetimeSecs %d, want %d", tc.name, added.LifetimeSecs, tc.lifetime)
+		}
+		if added.Certificate == nil || added.Certificate.Serial != cert.Serial || added.Certificate.KeyId != tc.name {
+			t.Errorf("%s added with certificate %+v", tc.name, added.Certificate)
+		}
+	}
+}
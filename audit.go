@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/candlerb/sshtokenca/util"
+	"os"
+	"sync"
+	"time"
+)
+
+// A record of an issued certificate, written as one json object per line
+// to the audit log
+type auditRecord struct {
+	Timestamp      time.Time `json:"timestamp"`
+	User           string    `json:"user"`
+	Host           string    `json:"host,omitempty"`
+	Serial         uint64    `json:"serial"`
+	KeyID          string    `json:"key_id"`
+	Principals     []string  `json:"principals"`
+	ValidAfter     time.Time `json:"valid_after"`
+	ValidBefore    time.Time `json:"valid_before"`
+	RemoteAddr     string    `json:"remote_addr"`
+	ClientVersion  string    `json:"client_version"`
+	KeyFingerprint string    `json:"key_fingerprint,omitempty"`
+	SessionID      string    `json:"session_id,omitempty"`
+	ServerVersion  string    `json:"server_version,omitempty"`
+	Kex            string    `json:"kex,omitempty"`
+	Cipher         string    `json:"cipher,omitempty"`
+	MAC            string    `json:"mac,omitempty"`
+}
+
+// Record an issued certificate in the audit log and the database, those
+// which are set
+func recordIssue(settings *util.Settings, record auditRecord) error {
+	if settings.AuditLog != "" {
+		if err := writeAudit(settings.AuditLog, record); err != nil {
+			return fmt.Errorf("audit log error: %s", err)
+		}
+	}
+	if settings.Database != "" {
+		if err := writeHistory(settings.Database, record); err != nil {
+			return fmt.Errorf("database error: %s", err)
+		}
+	}
+	return nil
+}
+
+// serialises writes to the audit log from concurrent connections
+var auditMu sync.Mutex
+
+// Append a record to the audit log at path. The file is reopened for each
+// record so that it may be rotated while the server is running.
+func writeAudit(path string, record auditRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	auditMu.Lock()
+	defer auditMu.Unlock()
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(line)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"github.com/candlerb/sshtokenca/util"
+	"golang.org/x/crypto/ssh"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// Counts authentication failures by source IP, so that a client repeatedly
+// failing to authenticate can be refused further connections for a while
+type failureTracker struct {
+	mu      sync.Mutex
+	entries map[string]*failureEntry
+	lastGC  time.Time
+}
+
+type failureEntry struct {
+	count int
+	start time.Time // when the current window began
+}
+
+var authFailures = &failureTracker{entries: map[string]*failureEntry{}}
+
+// Return the IP part of a remote address
+func remoteIP(addr net.Addr) string {
+	if tcp, ok := addr.(*net.TCPAddr); ok {
+		return tcp.IP.String()
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// Record an authentication failure from addr
+func (f *failureTracker) Failure(addr net.Addr, window time.Duration) {
+	ip := remoteIP(addr)
+	now := time.Now()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.gc(now, window)
+	e, ok := f.entries[ip]
+	if !ok || now.Sub(e.start) >= window {
+		e = &failureEntry{start: now}
+		f.entries[ip] = e
+	}
+	e.count++
+}
+
+// Report whether addr has had at least max failures in the current window.
+// A max of zero means no limit.
+func (f *failureTracker) Blocked(addr net.Addr, max int, window time.Duration) bool {
+	if max <= 0 {
+		return false
+	}
+	ip := remoteIP(addr)
+	now := time.Now()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.gc(now, window)
+	e, ok := f.entries[ip]
+	return ok && now.Sub(e.start) < window && e.count >= max
+}
+
+// Drop entries whose window has passed, at most once per window. Must be
+// called with the lock held.
+func (f *failureTracker) gc(now time.Time, window time.Duration) {
+	if now.Sub(f.lastGC) < window {
+		return
+	}
+	for ip, e := range f.entries {
+		if now.Sub(e.start) >= window {
+			delete(f.entries, ip)
+		}
+	}
+	f.lastGC = now
+}
+
+// The least time a failed public key authentication takes, so that how
+// long it takes does not show whether the user exists or which check
+// failed. Up to a tenth more is added at random.
+const authFailureFloor = 100 * time.Millisecond
+
+// The one error given for every failed public key authentication, so
+// that a missing user cannot be told from a wrong key
+var errAuthFailed = errors.New("authentication failed")
+
+// Fail a public key authentication which began at start. The failure is
+// counted, and its reason logged, but the client is only given
+// errAuthFailed once authFailureFloor has passed.
+func publicKeyFailed(c ssh.ConnMetadata, start time.Time, reason error, settings *util.Settings) (*ssh.Permissions, error) {
+	authFailed(c, "publickey", settings)
+	if reason == util.ErrEmptyUsername {
+		logWarn("empty_username", logFields{"remote_addr": c.RemoteAddr().String()},
+			"public key authentication from %s with an empty username, likely a probe", c.RemoteAddr())
+	} else {
+		logInfo("publickey_failed", logFields{"user": c.User(), "remote_addr": c.RemoteAddr().String(), "error": reason},
+			"public key authentication for %s from %s failed: %s", c.User(), c.RemoteAddr(), reason)
+	}
+	authFailureDelay(start)
+	return nil, errAuthFailed
+}
+
+// Wait until authFailureFloor, and up to a tenth more, has passed since
+// start. Every failure of public key authentication waits, whichever way
+// it fails, so that the time taken by the checks before it, such as for
+// a kept refresh token, shows nothing.
+func authFailureDelay(start time.Time) {
+	wait := authFailureFloor + time.Duration(rand.Int63n(int64(authFailureFloor/10)))
+	time.Sleep(time.Until(start.Add(wait)))
+}
+
+// Report whether pubKey is one of keys, comparing it with every one of
+// them in constant time
+func keyListed(pubKey ssh.PublicKey, keys []ssh.PublicKey) bool {
+	wire := pubKey.Marshal()
+	found := 0
+	for _, key := range keys {
+		found |= subtle.ConstantTimeCompare(wire, key.Marshal())
+	}
+	return found == 1
+}
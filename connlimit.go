@@ -0,0 +1,40 @@
+package main
+
+import (
+	"sync"
+)
+
+// Bounds how many connections are serviced at once, so that a connection
+// storm cannot start an unbounded number of goroutines
+type connCounter struct {
+	mu     sync.Mutex
+	active int
+}
+
+var connLimiter = &connCounter{}
+
+// Take a slot for a connection if fewer than max are active, reporting
+// whether it was taken. A max of zero means no limit.
+func (c *connCounter) Acquire(max int) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if max > 0 && c.active >= max {
+		return false
+	}
+	c.active++
+	return true
+}
+
+// Return how many connections are being serviced
+func (c *connCounter) Active() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.active
+}
+
+// Release a slot taken by Acquire
+func (c *connCounter) Release() {
+	c.mu.Lock()
+	c.active--
+	c.mu.Unlock()
+}
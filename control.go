@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"github.com/candlerb/sshtokenca/util"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// The live status of the server, as given by the control socket's
+// "status" command
+type controlStatus struct {
+	Connections        int       `json:"connections"`
+	Maintenance        bool      `json:"maintenance"`
+	SettingsLoaded     time.Time `json:"settings_loaded"`
+	ReloadError        string    `json:"reload_error,omitempty"`
+	LastSerial         uint64    `json:"last_serial"`
+	CertificatesIssued uint64    `json:"certificates_issued"`
+}
+
+// The reply to a control socket command, written as one line of json
+type controlReply struct {
+	OK     bool           `json:"ok"`
+	Error  string         `json:"error,omitempty"`
+	Status *controlStatus `json:"status,omitempty"`
+}
+
+// Serve the control socket at path, for administration without signals.
+// Each line sent is a command, answered with a line of json:
+//
+//	status              the live status of the server
+//	reload              reload the settings, as SIGHUP does
+//	maintenance on|off  enter or leave maintenance mode
+//
+// The socket is only accessible to the user the server runs as, being
+// created with a umask which leaves no one else any access, so that it is
+// never open to others even briefly. A stale socket left by an earlier
+// run is replaced.
+func serveControl(path string, live *liveSettings, yamlFilePath string) (net.Listener, error) {
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	umask := syscall.Umask(0177)
+	listener, err := net.Listen("unix", path)
+	syscall.Umask(umask)
+	if err != nil {
+		return nil, err
+	}
+	logInfo("control_listening", logFields{"path": path}, "Serving control socket on %s", path)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go handleControl(conn, live, yamlFilePath)
+		}
+	}()
+	return listener, nil
+}
+
+// Answer the commands sent on a control socket connection until it is
+// closed
+func handleControl(conn net.Conn, live *liveSettings, yamlFilePath string) {
+	defer conn.Close()
+	scanner := bufio.NewScanner(conn)
+	enc := json.NewEncoder(conn)
+	for scanner.Scan() {
+		command := strings.Fields(scanner.Text())
+		if len(command) == 0 {
+			continue
+		}
+		logInfo("control", logFields{"command": strings.Join(command, " ")}, "control command %q", strings.Join(command, " "))
+		if enc.Encode(controlCommand(command, live, yamlFilePath)) != nil {
+			return
+		}
+	}
+}
+
+// Carry out a control socket command
+func controlCommand(command []string, live *liveSettings, yamlFilePath string) controlReply {
+	switch {
+	case command[0] == "status" && len(command) == 1:
+		status := &controlStatus{
+			Connections:        connLimiter.Active(),
+			Maintenance:        maintenance.On(),
+			SettingsLoaded:     live.Loaded().UTC(),
+			LastSerial:         util.LastSerial(),
+			CertificatesIssued: metrics.IssuedCount(),
+		}
+		if err := health.ReloadError(); err != nil {
+			status.ReloadError = err.Error()
+		}
+		return controlReply{OK: true, Status: status}
+	case command[0] == "reload" && len(command) == 1:
+		err := reloadSettings(live, yamlFilePath, "reload on the control socket")
+		if err != nil {
+			return controlReply{Error: err.Error()}
+		}
+		return controlReply{OK: true}
+	case command[0] == "maintenance" && len(command) == 2 && (command[1] == "on" || command[1] == "off"):
+		maintenance.Set(command[1] == "on", "maintenance "+command[1]+" on the control socket")
+		return controlReply{OK: true}
+	}
+	return controlReply{Error: fmt.Sprintf("unknown command %q; use status, reload or maintenance on|off", strings.Join(command, " "))}
+}
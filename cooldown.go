@@ -0,0 +1,71 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Remembers when each user was last signed a certificate, so that a
+// client stuck in a loop cannot have fresh ones signed over and over.
+// Users are kept by tenant as well as name, since tenants' users are
+// unrelated.
+type issueTracker struct {
+	mu     sync.Mutex
+	last   map[string]time.Time
+	lastGC time.Time
+}
+
+var recentIssues = &issueTracker{last: map[string]time.Time{}}
+
+// Record that the user name of tenant, "" for the top level, was signed
+// a certificate. Nothing is kept when there is no cooldown.
+func (t *issueTracker) Issued(tenant, name string, cooldown time.Duration) {
+	if cooldown <= 0 {
+		return
+	}
+	now := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.gc(now, cooldown)
+	t.last[issueKey(tenant, name)] = now
+}
+
+// Return how much longer the user name of tenant must wait before
+// another certificate may be signed for them, or zero if they need not
+// wait. A cooldown of zero means no limit.
+func (t *issueTracker) Wait(tenant, name string, cooldown time.Duration) time.Duration {
+	if cooldown <= 0 {
+		return 0
+	}
+	now := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.gc(now, cooldown)
+	last, ok := t.last[issueKey(tenant, name)]
+	if !ok {
+		return 0
+	}
+	if wait := last.Add(cooldown).Sub(now); wait > 0 {
+		return wait
+	}
+	return 0
+}
+
+// Drop entries whose cooldown has passed, at most once per cooldown. Must
+// be called with the lock held.
+func (t *issueTracker) gc(now time.Time, cooldown time.Duration) {
+	if now.Sub(t.lastGC) < cooldown {
+		return
+	}
+	for key, last := range t.last {
+		if now.Sub(last) >= cooldown {
+			delete(t.last, key)
+		}
+	}
+	t.lastGC = now
+}
+
+// The key of a tenant's user, which no other tenant and name can share
+func issueKey(tenant, name string) string {
+	return tenant + "\x00" + name
+}
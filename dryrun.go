@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/candlerb/sshtokenca/util"
+	"golang.org/x/crypto/ssh"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The certificate which would be issued to a user, as printed by
+// --issue-dryrun
+type dryRunCert struct {
+	User            string            `json:"user"`
+	Serial          uint64            `json:"serial"`
+	KeyID           string            `json:"key_id"`
+	Principals      []string          `json:"principals"`
+	CriticalOptions map[string]string `json:"critical_options"`
+	Extensions      map[string]string `json:"extensions"`
+	ValidAfter      time.Time         `json:"valid_after"`
+	ValidBefore     time.Time         `json:"valid_before"`
+	CAKey           string            `json:"ca_key"`
+	Signed          bool              `json:"signed"`
+}
+
+// Build the certificate the server would issue to the named user, with all
+// of their principals, and print it in the given format. The certificate
+// is for a throwaway key and is neither added to an agent nor audited. A
+// CA which signs certificates itself, such as Vault, is not asked to. The
+// user's CA key is chosen from caKeys as when serving.
+func issueDryRun(name, format string, caKeys []ssh.Signer, settings *util.Settings) error {
+	user, err := settings.UserByName(name)
+	if err != nil {
+		return err
+	}
+	caKey, err := settings.UserCAKey(user, caKeys)
+	if err != nil {
+		return err
+	}
+	if reason := accountRefusal(user); reason != "" {
+		return fmt.Errorf("%s", reason)
+	}
+	principals := util.GrantPrincipals(settings.UserPrincipalList(user), user.PrincipalPatterns, nil)
+	if len(principals) == 0 {
+		return fmt.Errorf("user %s has no principals, so must request some", name)
+	}
+	_, pubKey, err := generateCertKey(settings)
+	if err != nil {
+		return err
+	}
+	cert, err := newUserCert(pubKey, caKey, user, principals, settings)
+	if err != nil {
+		return err
+	}
+
+	signer, err := util.NewCASigner(caKey, settings.SignatureAlgorithm)
+	if err != nil {
+		return err
+	}
+	_, certSigner := signer.(util.CertSigner)
+	if !certSigner {
+		err = signCert(cert, caKey, settings)
+		if err != nil {
+			return err
+		}
+	}
+
+	d := dryRunCert{
+		User:            user.Name,
+		Serial:          cert.Serial,
+		KeyID:           cert.KeyId,
+		Principals:      cert.ValidPrincipals,
+		CriticalOptions: cert.CriticalOptions,
+		Extensions:      cert.Extensions,
+		ValidAfter:      time.Unix(int64(cert.ValidAfter), 0).UTC(),
+		ValidBefore:     time.Unix(int64(cert.ValidBefore), 0).UTC(),
+		CAKey:           ssh.FingerprintSHA256(caKey.PublicKey()),
+		Signed:          !certSigner,
+	}
+	if format == "json" {
+		out, err := json.MarshalIndent(d, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(out))
+		return nil
+	}
+	fmt.Printf("User:             %s\n", d.User)
+	fmt.Printf("Serial:           %d\n", d.Serial)
+	fmt.Printf("Key ID:           %s\n", d.KeyID)
+	fmt.Printf("Principals:       %s\n", strings.Join(d.Principals, ", "))
+	fmt.Printf("Critical options: %s\n", formatOptions(d.CriticalOptions))
+	fmt.Printf("Extensions:       %s\n", formatOptions(d.Extensions))
+	fmt.Printf("Valid after:      %s\n", d.ValidAfter.Format(time.RFC3339))
+	fmt.Printf("Valid before:     %s\n", d.ValidBefore.Format(time.RFC3339))
+	fmt.Printf("CA key:           %s\n", d.CAKey)
+	if !d.Signed {
+		fmt.Printf("Not signed, as the CA signs certificates itself\n")
+	}
+	return nil
+}
+
+// Format certificate options or extensions as sorted name or name=value
+// items
+func formatOptions(options map[string]string) string {
+	var items []string
+	for k, v := range options {
+		if v != "" {
+			k = fmt.Sprintf("%s=%s", k, v)
+		}
+		items = append(items, k)
+	}
+	sort.Strings(items)
+	return strings.Join(items, " ")
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"strings"
+)
+
+// Run a command given by an "exec" request, writing its output to the
+// channel, and close the channel. Commands give automation access to
+// the service without a terminal, e.g.
+//
+//	ssh -p 2222 user@ca get-ca >> /etc/ssh/ca.pub
+//
+// The "cert" command issues a certificate, with the principals given as
+// its arguments or else those requested, and writes it out if it was not
+// added to a forwarded agent.
+func runExec(ch ssh.Channel, command string, caKeys []ssh.Signer, iss *issuance, requested []string) {
+	args := strings.Fields(command)
+	if len(args) == 0 {
+		args = []string{""}
+	}
+	switch args[0] {
+	case "get-ca":
+		chanCloser(ch, writeCAKeys(ch, caKeys) != nil)
+	case "cert":
+		if len(args) > 1 {
+			requested = args[1:]
+		}
+		message, cert, inAgent, err := iss.issue(requested, nil)
+		if err != nil {
+			fmt.Fprintf(ch.Stderr(), "%s: %s\n", err, message)
+			chanCloser(ch, true)
+			return
+		}
+		if inAgent {
+			fmt.Fprintf(ch.Stderr(), "%s\n%s\n", message, certDetails(cert))
+			chanCloser(ch, false)
+			return
+		}
+		_, err = ch.Write(ssh.MarshalAuthorizedKey(cert))
+		chanCloser(ch, err != nil)
+	default:
+		fmt.Fprintf(ch.Stderr(), "unknown command %q\n", command)
+		chanCloser(ch, true)
+	}
+}
+
+// Write the TrustedUserCAKeys entries for the CA keys
+func writeCAKeys(ch ssh.Channel, caKeys []ssh.Signer) error {
+	for _, caKey := range caKeys {
+		_, err := ch.Write(ssh.MarshalAuthorizedKey(caKey.PublicKey()))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
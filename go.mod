@@ -1,13 +1,20 @@
 module github.com/candlerb/sshtokenca
 
-go 1.14
+go 1.21
 
 require (
 	github.com/coreos/go-oidc v2.2.1+incompatible
 	github.com/jessevdk/go-flags v1.4.0
-	github.com/pquerna/cachecontrol v0.0.0-20180517163645-1555304b9b35 // indirect
+	github.com/mattn/go-sqlite3 v1.14.52
+	github.com/miekg/pkcs11 v1.0.3
 	golang.org/x/crypto v0.0.0-20200510223506-06a226fb4e37
 	golang.org/x/oauth2 v0.0.0-20200107190931-bf48bf16ab8d
-	gopkg.in/square/go-jose.v2 v2.5.1 // indirect
 	gopkg.in/yaml.v3 v3.0.0-20200506231410-2ff61e1afc86
 )
+
+require (
+	github.com/pquerna/cachecontrol v0.0.0-20180517163645-1555304b9b35 // indirect
+	golang.org/x/net v0.0.0-20190404232315-eb5bcb51f2a3 // indirect
+	golang.org/x/sys v0.0.0-20190412213103-97732733099d // indirect
+	gopkg.in/square/go-jose.v2 v2.5.1 // indirect
+)
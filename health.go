@@ -0,0 +1,171 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/candlerb/sshtokenca/util"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// How long the outcome of a CA key's test signature is reported before
+// another is made, so that frequent probes neither add to the signing
+// load nor keep asking an ssh-agent to confirm, or a token to be touched
+const healthSignInterval = time.Minute
+
+// The server's readiness, reported by serveHealth
+type healthState struct {
+	mu        sync.Mutex
+	live      *liveSettings
+	sites     []*site
+	reloadErr error
+
+	signMu sync.Mutex // held while a test signature is made
+	signed map[*site]signOutcome
+}
+
+// The outcome of the last test signature by a site's CA key
+type signOutcome struct {
+	err error
+	at  time.Time
+}
+
+var health = &healthState{signed: map[*site]signOutcome{}}
+
+// Record that the server is listening, with the settings in use and the
+// sites served: the top level and each tenant
+func (h *healthState) Ready(live *liveSettings, sites []*site) {
+	h.mu.Lock()
+	h.live, h.sites = live, sites
+	h.mu.Unlock()
+}
+
+// Record the outcome of the last settings reload
+func (h *healthState) Reloaded(err error) {
+	h.mu.Lock()
+	h.reloadErr = err
+	h.mu.Unlock()
+}
+
+// Return the error of the last settings reload, if it failed
+func (h *healthState) ReloadError() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.reloadErr
+}
+
+// Return why the server is not ready, or nil if it is. The server is not
+// ready in maintenance mode, so that load balancers send clients
+// elsewhere. The signing CA key of the top level and of each tenant is
+// checked by making a test signature, at most once per
+// healthSignInterval, so that a lost ssh-agent or PKCS#11 token is
+// noticed, and its certificate, if any, must not have expired.
+func (h *healthState) Check() error {
+	h.mu.Lock()
+	live, sites, reloadErr := h.live, h.sites, h.reloadErr
+	h.mu.Unlock()
+
+	if live == nil {
+		return errors.New("starting")
+	}
+	if reloadErr != nil {
+		return fmt.Errorf("settings reload failed: %s", reloadErr)
+	}
+	if maintenance.On() {
+		return errors.New("in maintenance mode")
+	}
+	for _, st := range sites {
+		settings := st.Get()
+		if settings == nil {
+			// a tenant removed by a reload is no longer served
+			continue
+		}
+		_, err := util.CheckCAValidity(st.caKeys[0], time.Now())
+		if err == nil {
+			err = h.testSign(st, settings)
+		}
+		if err != nil && st.tenant != "" {
+			return fmt.Errorf("tenant %s: %s", st.tenant, err)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Return the outcome of the last test signature by the CA key of st,
+// making another if it is older than healthSignInterval
+func (h *healthState) testSign(st *site, settings *util.Settings) error {
+	h.signMu.Lock()
+	defer h.signMu.Unlock()
+	h.mu.Lock()
+	last, ok := h.signed[st]
+	h.mu.Unlock()
+	if ok && time.Since(last.at) < healthSignInterval {
+		return last.err
+	}
+	err := checkCASign(st.caKeys[0], settings)
+	if err == errSigningQueueFull {
+		// busy rather than broken, so tried again at the next probe
+		return err
+	}
+	h.mu.Lock()
+	h.signed[st] = signOutcome{err: err, at: time.Now()}
+	h.mu.Unlock()
+	return err
+}
+
+// Check that caKey can sign with the settings given. The test signature
+// waits for the signing rate limit, like a certificate's.
+func checkCASign(caKey ssh.Signer, settings *util.Settings) error {
+	signer, err := util.NewCASigner(caKey, settings.SignatureAlgorithm)
+	if err != nil {
+		return err
+	}
+	if certSigner, ok := signer.(util.CertSigner); ok {
+		if err := certSigner.Check(); err != nil {
+			return fmt.Errorf("CA cannot sign: %s", err)
+		}
+		return nil
+	}
+	data := make([]byte, 32)
+	_, err = io.ReadFull(settings.Random(), data)
+	if err != nil {
+		return err
+	}
+	wait, err := signingLimiter.Wait(settings.SigningRate, settings.SigningBurst)
+	metrics.SigningWait(wait)
+	if err != nil {
+		return err
+	}
+	_, err = signer.Sign(settings.Random(), data)
+	if err != nil {
+		return fmt.Errorf("CA key cannot sign: %s", err)
+	}
+	return nil
+}
+
+// Serve a readiness check over http at /health on addr, separately from
+// the metrics, returning 200 when ready and 503 otherwise
+func serveHealth(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		err := health.Check()
+		if err != nil {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintf(w, "%s\n", err)
+			return
+		}
+		fmt.Fprintf(w, "ok\n")
+	})
+	logInfo("health_listening", logFields{"address": addr}, "Serving health check on http://%s/health", addr)
+	go func() {
+		err := http.ListenAndServe(addr, mux)
+		logFatal("health_failed", logFields{"address": addr, "error": err}, "Health check server failed: %s", err)
+	}()
+}
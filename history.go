@@ -0,0 +1,194 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The database/sql driver for the issuance history, registered only when
+// built with -tags sqlite, since it needs cgo
+const historyDriver = "sqlite3"
+
+const historySchema = `
+CREATE TABLE IF NOT EXISTS issuances (
+	id              INTEGER PRIMARY KEY,
+	timestamp       TEXT NOT NULL,
+	user            TEXT NOT NULL,
+	host            TEXT NOT NULL,
+	serial          TEXT NOT NULL,
+	key_id          TEXT NOT NULL,
+	principals      TEXT NOT NULL,
+	valid_after     TEXT NOT NULL,
+	valid_before    TEXT NOT NULL,
+	remote_addr     TEXT NOT NULL,
+	client_version  TEXT NOT NULL,
+	key_fingerprint TEXT NOT NULL,
+	session_id      TEXT NOT NULL DEFAULT '',
+	kex             TEXT NOT NULL DEFAULT '',
+	cipher          TEXT NOT NULL DEFAULT '',
+	mac             TEXT NOT NULL DEFAULT ''
+);
+CREATE INDEX IF NOT EXISTS issuances_user ON issuances (user, timestamp);
+CREATE INDEX IF NOT EXISTS issuances_host ON issuances (host, timestamp);
+`
+
+// Columns added since the table was first created, which a database made
+// by an older version lacks
+var historyAddedColumns = []string{"session_id", "kex", "cipher", "mac"}
+
+// The open databases, by path, which are kept open since, unlike the
+// audit log, they are not rotated
+var (
+	historyMu  sync.Mutex
+	historyDBs = map[string]*sql.DB{}
+)
+
+// Open the database at path, creating its table if need be
+func openHistory(path string) (*sql.DB, error) {
+	historyMu.Lock()
+	defer historyMu.Unlock()
+	if db, ok := historyDBs[path]; ok {
+		return db, nil
+	}
+	found := false
+	for _, d := range sql.Drivers() {
+		if d == historyDriver {
+			found = true
+		}
+	}
+	if !found {
+		return nil, errors.New("sqlite support not built in, rebuild with -tags sqlite")
+	}
+	db, err := sql.Open(historyDriver, path)
+	if err != nil {
+		return nil, err
+	}
+	// sqlite allows one writer at a time
+	db.SetMaxOpenConns(1)
+	_, err = db.Exec(historySchema)
+	if err == nil {
+		err = migrateHistory(db)
+	}
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	historyDBs[path] = db
+	return db, nil
+}
+
+// Add any columns missing from a table created by an older version
+func migrateHistory(db *sql.DB) error {
+	rows, err := db.Query(`SELECT name FROM pragma_table_info('issuances')`)
+	if err != nil {
+		return err
+	}
+	have := map[string]bool{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return err
+		}
+		have[name] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, c := range historyAddedColumns {
+		if have[c] {
+			continue
+		}
+		_, err = db.Exec(`ALTER TABLE issuances ADD COLUMN ` + c + ` TEXT NOT NULL DEFAULT ''`)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Insert a record of an issued certificate into the database at path.
+// Serials are kept as decimal text, as they may not fit an sqlite integer.
+func writeHistory(path string, record auditRecord) error {
+	db, err := openHistory(path)
+	if err != nil {
+		return err
+	}
+	principals, err := json.Marshal(record.Principals)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`INSERT INTO issuances (timestamp, user, host, serial, key_id, principals,
+		valid_after, valid_before, remote_addr, client_version, key_fingerprint,
+		session_id, kex, cipher, mac)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		record.Timestamp.UTC().Format(time.RFC3339Nano), record.User, record.Host,
+		strconv.FormatUint(record.Serial, 10), record.KeyID, string(principals),
+		record.ValidAfter.UTC().Format(time.RFC3339), record.ValidBefore.UTC().Format(time.RFC3339),
+		record.RemoteAddr, record.ClientVersion, record.KeyFingerprint,
+		record.SessionID, record.Kex, record.Cipher, record.MAC)
+	return err
+}
+
+// Return the most recent certificates issued to a user or host, newest
+// first, at most limit of them
+func readHistory(path, name string, limit int) ([]auditRecord, error) {
+	db, err := openHistory(path)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.Query(`SELECT timestamp, user, host, serial, key_id, principals,
+		valid_after, valid_before, remote_addr, client_version, key_fingerprint,
+		session_id, kex, cipher, mac
+		FROM issuances WHERE user = ? OR host = ? ORDER BY id DESC LIMIT ?`, name, name, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var records []auditRecord
+	for rows.Next() {
+		var r auditRecord
+		var timestamp, serial, principals, validAfter, validBefore string
+		err = rows.Scan(&timestamp, &r.User, &r.Host, &serial, &r.KeyID, &principals,
+			&validAfter, &validBefore, &r.RemoteAddr, &r.ClientVersion, &r.KeyFingerprint,
+			&r.SessionID, &r.Kex, &r.Cipher, &r.MAC)
+		if err != nil {
+			return nil, err
+		}
+		r.Timestamp, _ = time.Parse(time.RFC3339Nano, timestamp)
+		r.ValidAfter, _ = time.Parse(time.RFC3339, validAfter)
+		r.ValidBefore, _ = time.Parse(time.RFC3339, validBefore)
+		r.Serial, _ = strconv.ParseUint(serial, 10, 64)
+		_ = json.Unmarshal([]byte(principals), &r.Principals)
+		records = append(records, r)
+	}
+	return records, rows.Err()
+}
+
+// Print the most recent certificates issued to a user or host from the
+// database
+func printHistory(path, name string, limit int) error {
+	if path == "" {
+		return errors.New("no database is set in the settings")
+	}
+	records, err := readHistory(path, name, limit)
+	if err != nil {
+		return err
+	}
+	if len(records) == 0 {
+		fmt.Printf("No certificates have been issued to %s\n", name)
+		return nil
+	}
+	for _, r := range records {
+		fmt.Printf("%s serial %d key id %s principals %v valid until %s from %s key %s\n",
+			r.Timestamp.Format(time.RFC3339), r.Serial, r.KeyID, r.Principals,
+			r.ValidBefore.Format(time.RFC3339), r.RemoteAddr, r.KeyFingerprint)
+	}
+	return nil
+}
@@ -0,0 +1,8 @@
+//go:build sqlite
+// +build sqlite
+
+package main
+
+// The sqlite driver for the issuance history needs cgo, so is only built
+// with -tags sqlite
+import _ "github.com/mattn/go-sqlite3"
@@ -0,0 +1,127 @@
+//go:build sqlite
+// +build sqlite
+
+package main
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestHistoryRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "issued.db")
+
+	now := time.Now().Truncate(time.Second)
+	records := []auditRecord{
+		{
+			Timestamp:      now.Add(-time.Minute),
+			User:           "bob",
+			Serial:         1,
+			KeyID:          "bob_from:127.0.0.1",
+			Principals:     []string{"web", "db"},
+			ValidAfter:     now.Add(-2 * time.Minute),
+			ValidBefore:    now.Add(time.Hour),
+			RemoteAddr:     "127.0.0.1:50000",
+			ClientVersion:  "SSH-2.0-OpenSSH_8.2",
+			KeyFingerprint: "SHA256:bob",
+			SessionID:      "0a1b2c",
+			Kex:            "curve25519-sha256",
+			Cipher:         "chacha20-poly1305@openssh.com",
+			MAC:            "hmac-sha2-256-etm@openssh.com",
+		},
+		{
+			Timestamp:   now,
+			User:        "bob",
+			Host:        "web1",
+			Serial:      1<<64 - 1, // beyond an sqlite integer
+			KeyID:       "web1",
+			Principals:  []string{"web1.example.com"},
+			ValidAfter:  now,
+			ValidBefore: now.Add(24 * time.Hour),
+			RemoteAddr:  "127.0.0.1:50001",
+		},
+	}
+	for _, r := range records {
+		if err := writeHistory(path, r); err != nil {
+			t.Fatalf("could not write history: %v", err)
+		}
+	}
+
+	got, err := readHistory(path, "bob", 10)
+	if err != nil {
+		t.Fatalf("could not read history: %v", err)
+	}
+	if len(got) != 2 {
+		t.Fatalf("read %d records, want 2", len(got))
+	}
+	// newest first
+	for i, want := range []auditRecord{records[1], records[0]} {
+		r := got[i]
+		if !r.Timestamp.Equal(want.Timestamp) || r.User != want.User || r.Host != want.Host ||
+			r.Serial != want.Serial || r.KeyID != want.KeyID ||
+			!r.ValidAfter.Equal(want.ValidAfter) || !r.ValidBefore.Equal(want.ValidBefore) ||
+			r.RemoteAddr != want.RemoteAddr || r.ClientVersion != want.ClientVersion ||
+			r.KeyFingerprint != want.KeyFingerprint || len(r.Principals) != len(want.Principals) {
+			t.Errorf("record %d read as %+v, want %+v", i, r, want)
+			continue
+		}
+		for j := range want.Principals {
+			if r.Principals[j] != want.Principals[j] {
+				t.Errorf("record %d principals %v, want %v", i, r.Principals, want.Principals)
+			}
+		}
+	}
+
+	got, err = readHistory(path, "web1", 1)
+	if err != nil || len(got) != 1 || got[0].Host != "web1" {
+		t.Errorf("unexpected history for host web1 %+v: %v", got, err)
+	}
+	got, err = readHistory(path, "alice", 10)
+	if err != nil || len(got) != 0 {
+		t.Errorf("unexpected history for alice %+v: %v", got, err)
+	}
+}
+
+func TestHistoryMigration(t *testing.T) {
+	dir, err := ioutil.TempDir("", "history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "issued.db")
+
+	// a table as created before the connection columns were added
+	db, err := sql.Open(historyDriver, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec(`CREATE TABLE issuances (
+		id INTEGER PRIMARY KEY, timestamp TEXT NOT NULL, user TEXT NOT NULL,
+		host TEXT NOT NULL, serial TEXT NOT NULL, key_id TEXT NOT NULL,
+		principals TEXT NOT NULL, valid_after TEXT NOT NULL, valid_before TEXT NOT NULL,
+		remote_addr TEXT NOT NULL, client_version TEXT NOT NULL, key_fingerprint TEXT NOT NULL);
+		INSERT INTO issuances VALUES (1, '2020-01-01T00:00:00Z', 'bob', '', '1', 'bob', '[]',
+		'2020-01-01T00:00:00Z', '2020-01-01T01:00:00Z', '127.0.0.1:50000', '', '')`)
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = writeHistory(path, auditRecord{Timestamp: time.Now(), User: "bob", Serial: 2, SessionID: "0a1b2c"})
+	if err != nil {
+		t.Fatalf("could not write history to an old table: %v", err)
+	}
+	got, err := readHistory(path, "bob", 10)
+	if err != nil || len(got) != 2 || got[0].SessionID != "0a1b2c" || got[1].SessionID != "" {
+		t.Errorf("unexpected history after migration %+v: %v", got, err)
+	}
+}
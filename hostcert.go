@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"github.com/candlerb/sshtokenca/util"
+	"golang.org/x/crypto/ssh"
+	"time"
+)
+
+// Permissions extension carrying the name of a host which has
+// authenticated with its host key to have it certified
+const hostExtension = "host@sshtokenca"
+
+// Return the name of the host carried in perms, and whether there was one
+func hostName(perms *ssh.Permissions) (string, bool) {
+	if perms == nil {
+		return "", false
+	}
+	name, ok := perms.Extensions[hostExtension]
+	return name, ok
+}
+
+// Authenticate a host by its registered host key
+func acceptHost(h *util.HostPrincipals, pubKey ssh.PublicKey) (*ssh.Permissions, error) {
+	if !keyListed(pubKey, h.PublicKeys()) {
+		return nil, fmt.Errorf("unknown host key")
+	}
+	return &ssh.Permissions{
+		Extensions: map[string]string{
+			hostExtension:      h.Name,
+			clientKeyExtension: string(pubKey.Marshal()),
+		},
+	}, nil
+}
+
+// Given a host's public key, CA private key, host and some settings,
+// generate and sign an SSH host certificate with the host's principals,
+// and record it in the audit log. Host certificates carry no extensions,
+// which apply only to user certificates.
+func signHostCertificate(pubKey ssh.PublicKey, caKey ssh.Signer, host *util.HostPrincipals,
+	settings *util.Settings, conn *ssh.ServerConn) (*ssh.Certificate, error) {
+
+	fromT := time.Now().UTC()
+	toT, err := clampToCA(fromT.Add(settings.HostValidity), caKey, host.Name)
+	if err != nil {
+		return nil, err
+	}
+	fmtF := "2006-01-02T15:04"
+	fmtT := "2006-01-02T15:04MST"
+	identifier := fmt.Sprintf("%s_host_%s_from:%s_to:%s", settings.Organisation, host.Name, fromT.Format(fmtF), toT.Format(fmtT))
+
+	cert := &ssh.Certificate{
+		CertType:        ssh.HostCert,
+		Key:             pubKey,
+		Serial:          util.NextSerial(),
+		KeyId:           identifier,
+		ValidAfter:      uint64(fromT.Add(-*settings.ValidAfterSkew).Unix()),
+		ValidBefore:     uint64(toT.Unix()),
+		ValidPrincipals: host.Principals,
+	}
+	err = signCert(cert, caKey, settings)
+	if err != nil {
+		return nil, err
+	}
+	// the validity as signed, which a CA such as Vault sets itself
+	fromT = time.Unix(int64(cert.ValidAfter), 0).UTC()
+	toT = time.Unix(int64(cert.ValidBefore), 0).UTC()
+
+	kex, cipher, mac := connAlgorithms(conn.Permissions)
+	err = recordIssue(settings, auditRecord{
+		Timestamp:      time.Now().UTC(),
+		Host:           host.Name,
+		Serial:         cert.Serial,
+		KeyID:          cert.KeyId,
+		Principals:     cert.ValidPrincipals,
+		ValidAfter:     fromT,
+		ValidBefore:    toT,
+		RemoteAddr:     conn.RemoteAddr().String(),
+		ClientVersion:  string(conn.ClientVersion()),
+		KeyFingerprint: clientKeyFingerprint(conn.Permissions),
+		SessionID:      hex.EncodeToString(conn.SessionID()),
+		ServerVersion:  string(conn.ServerVersion()),
+		Kex:            kex,
+		Cipher:         cipher,
+		MAC:            mac,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	logInfo("host_certificate_issued", logFields{"host": host.Name, "serial": cert.Serial, "principals": host.Principals, "key_id": identifier, "valid_before": toT},
+		"completed making host certificate for %s principals %s expiring %s", host.Name, host.Principals, toT.Format(fmtT))
+	return cert, nil
+}
+
+// Service the session of a host, which may run the "host-cert" command to
+// have the host key it authenticated with certified, or "get-ca". The
+// session is closed at deadline.
+func handleHostChannels(chans <-chan ssh.NewChannel, host *util.HostPrincipals, settings *util.Settings,
+	sshConn *ssh.ServerConn, caKeys []ssh.Signer, deadline time.Time) {
+
+	defer sshConn.Close()
+	limit := time.After(time.Until(deadline))
+
+	var thisChan ssh.NewChannel
+	select {
+	case thisChan = <-chans:
+		if thisChan == nil {
+			return
+		}
+	case <-limit:
+		return
+	}
+	if thisChan.ChannelType() != "session" {
+		thisChan.Reject(ssh.Prohibited, "channel type is not a session")
+		return
+	}
+	ch, reqs, err := thisChan.Accept()
+	if err != nil {
+		logError("channel_failed", logFields{"host": host.Name, "error": err}, "did not accept channel request %s", err)
+		return
+	}
+
+	for {
+		select {
+		case req := <-reqs:
+			if req == nil {
+				return
+			}
+			if req.WantReply {
+				req.Reply(req.Type == "exec", nil)
+			}
+			if req.Type != "exec" {
+				continue
+			}
+			command, err := util.ExecCommand(req.Payload)
+			if err != nil {
+				logError("exec_failed", logFields{"host": host.Name, "error": err}, "invalid exec request: %s", err)
+				chanCloser(ch, true)
+				continue
+			}
+			logInfo("exec", logFields{"host": host.Name, "command": command}, "host exec command %q", command)
+			switch command {
+			case "get-ca":
+				chanCloser(ch, writeCAKeys(ch, caKeys) != nil)
+			case "host-cert":
+				if maintenance.On() {
+					fmt.Fprintf(ch.Stderr(), "%s\n", settings.MaintenanceMessage)
+					chanCloser(ch, true)
+					continue
+				}
+				start := time.Now()
+				cert, err := signHostCertificate(clientKey(sshConn.Permissions), caKeys[0], host, settings, sshConn)
+				if err != nil {
+					logError("certificate_failed", logFields{"host": host.Name, "remote_addr": sshConn.RemoteAddr().String(), "error": err}, "host certificate creation error %s", err)
+					fmt.Fprintf(ch.Stderr(), "Certification creation error\n")
+					chanCloser(ch, true)
+					continue
+				}
+				metrics.Issued(time.Since(start))
+				_, err = ch.Write(ssh.MarshalAuthorizedKey(cert))
+				chanCloser(ch, err != nil)
+			default:
+				fmt.Fprintf(ch.Stderr(), "unknown command %q\n", command)
+				chanCloser(ch, true)
+			}
+		case <-limit:
+			return
+		}
+	}
+}
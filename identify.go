@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"github.com/candlerb/sshtokenca/util"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/terminal"
+	"strings"
+	"time"
+)
+
+// Permissions extension marking a client whose key is not provisioned, let in
+// with identify_unknown only to be told the public key it presented
+const identifyExtension = "identify@sshtokenca"
+
+// Permissions for a user whose key is not provisioned, who presented key.
+// A certificate's own key is the one to provision. The key has already
+// counted against max_attempts when it was refused.
+func identify(c ssh.ConnMetadata, key ssh.PublicKey) *ssh.Permissions {
+	if cert, ok := key.(*ssh.Certificate); ok {
+		key = cert.Key
+	}
+	logInfo("identify", logFields{"user": c.User(), "remote_addr": c.RemoteAddr().String(), "key_fingerprint": ssh.FingerprintSHA256(key)},
+		"user %s from %s told the fingerprint of unregistered key %s", c.User(), c.RemoteAddr(), ssh.FingerprintSHA256(key))
+	return &ssh.Permissions{
+		Extensions: map[string]string{identifyExtension: string(key.Marshal())},
+	}
+}
+
+// Fail public key authentication. With identify_unknown, unless they may
+// log in with oidc, the key is remembered, so that once the client has
+// no more keys to offer it may be let in to be told the last of them,
+// whether or not the username is registered, so that the response does
+// not show which usernames are.
+func publicKeyRefused(c ssh.ConnMetadata, start time.Time, key ssh.PublicKey, reason error, settings *util.Settings) (*ssh.Permissions, error) {
+	if settings.IdentifyUnknown && settings.OpenIDC == nil && reason != util.ErrEmptyUsername {
+		refusedKeys.Replace(c.SessionID(), key)
+	}
+	return publicKeyFailed(c, start, reason, settings)
+}
+
+// Let in a client every one of whose keys was refused, to be told the
+// last of them, when it falls back to keyboard-interactive
+// authentication. Waiting for that, rather than letting in the first key
+// refused, gives a registered key offered after others the chance to log
+// in.
+func identifyRefused(c ssh.ConnMetadata, settings *util.Settings) (*ssh.Permissions, bool) {
+	key := refusedKeys.Take(c.SessionID())
+	if key == nil || !settings.IdentifyUnknown || settings.OpenIDC != nil {
+		return nil, false
+	}
+	return identify(c, key), true
+}
+
+// Return the public key of a user who is only to be told it, if the
+// connection is one
+func identifyKey(perms *ssh.Permissions) (ssh.PublicKey, bool) {
+	if perms == nil {
+		return nil, false
+	}
+	v, ok := perms.Extensions[identifyExtension]
+	if !ok {
+		return nil, false
+	}
+	key, err := ssh.ParsePublicKey([]byte(v))
+	if err != nil {
+		return nil, false
+	}
+	return key, true
+}
+
+// Tell a user who is not provisioned what to give an administrator to
+// be provisioned: what they authenticated with, and its value
+func identifyMessage(name, what, value string) string {
+	return fmt.Sprintf("Your %s is not registered with this service for user %s. To be\n"+
+		"registered, give your administrator your username and %s:\n\n    %s", what, name, what, value)
+}
+
+// Service the session of a user who is not provisioned, telling them the
+// fingerprint and public key of the key they presented, whatever they
+// ask for, then closing it. No certificate is issued. The session is
+// closed at deadline.
+func handleIdentifyChannels(chans <-chan ssh.NewChannel, sshConn *ssh.ServerConn, key ssh.PublicKey, deadline time.Time) {
+	defer sshConn.Close()
+	limit := time.After(time.Until(deadline))
+
+	var thisChan ssh.NewChannel
+	select {
+	case thisChan = <-chans:
+		if thisChan == nil {
+			return
+		}
+	case <-limit:
+		return
+	}
+	if thisChan.ChannelType() != "session" {
+		thisChan.Reject(ssh.Prohibited, "channel type is not a session")
+		return
+	}
+	ch, reqs, err := thisChan.Accept()
+	if err != nil {
+		logError("channel_failed", logFields{"user": sshConn.User(), "error": err}, "did not accept channel request %s", err)
+		return
+	}
+
+	message := identifyMessage(sshConn.User(), "public key",
+		strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key))))
+	message += fmt.Sprintf("\n\nwhose fingerprint is %s", ssh.FingerprintSHA256(key))
+	start, err := util.AwaitSessionStart(reqs, limit, func(string) bool { return false })
+	if err == util.ErrSessionClosed || err == util.ErrSessionTimeout {
+		return
+	}
+	served := make(chan struct{})
+	go func() {
+		util.ServeSessionRequests(reqs)
+		close(served)
+	}()
+	if err == nil && start.Shell {
+		termWriter(terminal.NewTerminal(ch, ""), message)
+	} else {
+		fmt.Fprintf(ch, "%s\n", message)
+	}
+	chanCloser(ch, false)
+
+	// the client closes its side in reply, so that the connection is
+	// closed cleanly
+	select {
+	case <-served:
+	case <-limit:
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/candlerb/sshtokenca/util"
+	"golang.org/x/crypto/ssh"
+)
+
+func newTestSigner(t *testing.T) ssh.Signer {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+// Load settings from yaml, as from a settings file
+func loadTestSettings(t *testing.T, yaml string) util.Settings {
+	dir, err := ioutil.TempDir("", "settings")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "settings.yaml")
+	if err := ioutil.WriteFile(path, []byte(yaml), 0600); err != nil {
+		t.Fatal(err)
+	}
+	settings, err := util.SettingsLoad(path)
+	if err != nil {
+		t.Fatalf("could not load settings: %v", err)
+	}
+	return settings
+}
+
+// Authenticate as user with keys, offered in order, falling back to
+// keyboard-interactive, and return the permissions the server granted
+func identifyConnect(t *testing.T, settings *util.Settings, user string, keys ...ssh.Signer) *ssh.Permissions {
+	config := newServerConfig(context.Background(), &site{live: newLiveSettings(settings)}, newTestSigner(t))
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	granted := make(chan *ssh.Permissions, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			granted <- nil
+			return
+		}
+		defer conn.Close()
+		sshConn, chans, reqs, err := ssh.NewServerConn(conn, config)
+		if err != nil {
+			granted <- nil
+			return
+		}
+		defer sshConn.Close()
+		go ssh.DiscardRequests(reqs)
+		go func() {
+			for ch := range chans {
+				ch.Reject(ssh.Prohibited, "no channels")
+			}
+		}()
+		granted <- sshConn.Permissions
+		sshConn.Wait()
+	}()
+
+	client, err := ssh.Dial("tcp", listener.Addr().String(), &ssh.ClientConfig{
+		User: user,
+		Auth: []ssh.AuthMethod{
+			ssh.PublicKeys(keys...),
+			ssh.KeyboardInteractive(func(string, string, []string, []bool) ([]string, error) {
+				return nil, fmt.Errorf("no answers")
+			}),
+		},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatalf("could not authenticate as %s: %v", user, err)
+	}
+	defer client.Close()
+	return <-granted
+}
+
+func TestIdentifyAfterAllKeysRefused(t *testing.T) {
+	registered := newTestSigner(t)
+	unknown := newTestSigner(t)
+	other := newTestSigner(t)
+
+	settings := loadTestSettings(t, fmt.Sprintf(`validity: 1h
+organisation: acme
+identify_unknown: true
+user_principals:
+    - name: bob
+      authorized_key: %s
+      principals: [web]
+`, ssh.MarshalAuthorizedKey(registered.PublicKey())))
+
+	// a registered key offered after an unregistered one still logs in
+	perms := identifyConnect(t, &settings, "bob", unknown, registered)
+	if _, ok := identifyKey(perms); ok {
+		t.Errorf("registered key offered second was only identified")
+	}
+	if key := clientKey(perms); key == nil || string(key.Marshal()) != string(registered.PublicKey().Marshal()) {
+		t.Errorf("registered key offered second did not log in, permissions %+v", perms)
+	}
+
+	// with no registered key, the last key refused is identified
+	for _, user := range []string{"bob", "alice"} {
+		perms = identifyConnect(t, &settings, user, unknown, other)
+		key, ok := identifyKey(perms)
+		if !ok || string(key.Marshal()) != string(other.PublicKey().Marshal()) {
+			t.Errorf("%s with no registered key was not told the last key offered, permissions %+v", user, perms)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"github.com/candlerb/sshtokenca/util"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/terminal"
+	"net"
+	"strings"
+	"time"
+)
+
+// The environment variable a client may set, with e.g.
+// ssh -o SetEnv=SSHTOKENCA_PRINCIPALS=web1,web2, to request principals
+const principalsEnv = "SSHTOKENCA_PRINCIPALS"
+
+// A connection's certificate issuance, which is made once the client's
+// session asks for it
+type issuance struct {
+	user       *util.UserPrincipals
+	principals []string // the user's principals
+	patterns   []string // patterns which requested principals may match
+	settings   *util.Settings
+	sshConn    *ssh.ServerConn
+	caKey      ssh.Signer
+	refusal    string // why no certificate may be issued, if set
+	totp       bool   // whether a TOTP code must be given first
+	agent      bool   // whether the client asked to forward its agent
+}
+
+// Issue a certificate with the requested principals, or the user's
+// principals if none are requested. term is used to prompt for a TOTP
+// code, and is nil if there is no terminal. Returns a message for the
+// user, the certificate if one was issued, and whether it was added to
+// an agent.
+func (iss *issuance) issue(requested []string, term *terminal.Terminal) (string, *ssh.Certificate, bool, error) {
+	if iss.refusal != "" {
+		return iss.refusal, nil, false, fmt.Errorf("Certificate refused")
+	}
+	if maintenance.On() {
+		return iss.settings.MaintenanceMessage, nil, false, fmt.Errorf("Certificate refused")
+	}
+	if wait := recentIssues.Wait(connTenant(iss.sshConn.Permissions), iss.user.Name, iss.settings.IssueCooldown); wait > 0 {
+		logWarn("issue_cooldown", logFields{"user": iss.user.Name, "remote_addr": iss.sshConn.RemoteAddr().String(), "wait": wait},
+			"user %s asked for another certificate within issue_cooldown", iss.user.Name)
+		return fmt.Sprintf("A certificate was issued to you within the last %s; try again in %s",
+			iss.settings.IssueCooldown, wait.Round(time.Second)), nil, false, fmt.Errorf("Certificate refused")
+	}
+	principals := util.GrantPrincipals(iss.principals, iss.patterns, requested)
+	if len(requested) > 0 {
+		logInfo("principals_requested", logFields{"user": iss.user.Name, "requested": requested, "granted": principals},
+			"user %s requested principals %s, granted %s", iss.user.Name, requested, principals)
+	}
+	if len(principals) == 0 {
+		if len(requested) == 0 {
+			return fmt.Sprintf("Request principals with %s or the \"cert\" command", principalsEnv), nil, false, fmt.Errorf("Certificate refused")
+		}
+		return "None of the requested principals are allowed", nil, false, fmt.Errorf("Certificate refused")
+	}
+	// without an agent, only the key the user authenticated with can be
+	// certified, which is always the one for a host certificate
+	if (!iss.agent || iss.user.CertificateType() == ssh.HostCert) && clientKey(iss.sshConn.Permissions) == nil {
+		logWarn("no_agent", logFields{"user": iss.user.Name, "remote_addr": iss.sshConn.RemoteAddr().String()},
+			"user %s did not forward an agent", iss.user.Name)
+		return noAgentMessage(iss.user.Name, iss.settings), nil, false, fmt.Errorf("No agent forwarded")
+	}
+	if iss.totp {
+		if term == nil {
+			return "A verification code is required; connect with a terminal", nil, false, fmt.Errorf("Certificate refused")
+		}
+		message, err := promptTOTP(term, iss.user, iss.settings, iss.sshConn)
+		if err != nil {
+			return message, nil, false, err
+		}
+	}
+	return addCertificate(iss.user, principals, iss.settings, iss.sshConn, iss.caKey)
+}
+
+// Explain to a user who has not forwarded an agent how to connect again
+// with forwarding, using the ca_host, if set, for the ssh command and
+// ~/.ssh/config entry
+func noAgentMessage(name string, settings *util.Settings) string {
+	host, port := "<this service>", ""
+	if settings.CAHost != "" {
+		host = settings.CAHost
+		if h, p, err := net.SplitHostPort(settings.CAHost); err == nil {
+			host, port = h, p
+		}
+	}
+	command := "ssh -A"
+	if port != "" {
+		command += " -p " + port
+	}
+	command += fmt.Sprintf(" %s@%s", name, host)
+
+	rule := strings.Repeat("*", 72)
+	lines := []string{
+		rule,
+		"Your ssh agent was not forwarded, so there is nowhere to put your",
+		"certificate. Disconnect, and connect again with agent forwarding:",
+		"",
+		"    " + command,
+	}
+	if settings.CAHost != "" {
+		lines = append(lines,
+			"",
+			"or forward your agent here every time, with this in ~/.ssh/config:",
+			"",
+			"    Host "+host,
+			"        User "+name)
+		if port != "" {
+			lines = append(lines, "        Port "+port)
+		}
+		lines = append(lines, "        ForwardAgent yes")
+	}
+	lines = append(lines, rule)
+	return strings.Join(lines, "\n")
+}
+
+// Describe an issued certificate for the user to keep a record of: the
+// fingerprint of its key, as ssh-add -l shows it, its serial, principals
+// and expiry
+func certDetails(cert *ssh.Certificate) string {
+	expiry := time.Unix(int64(cert.ValidBefore), 0)
+	return fmt.Sprintf("Your certificate:\n"+
+		"    Fingerprint: %s\n"+
+		"    Serial:      %d\n"+
+		"    Principals:  %s\n"+
+		"    Expires:     %s (in %s)",
+		ssh.FingerprintSHA256(cert.Key), cert.Serial, strings.Join(cert.ValidPrincipals, ", "),
+		expiry.UTC().Format("2006-01-02 15:04:05 MST"), time.Until(expiry).Round(time.Minute))
+}
+
+// Parse a list of principals separated by commas or spaces
+func parsePrincipals(s string) []string {
+	return strings.FieldsFunc(s, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t'
+	})
+}
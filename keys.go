@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"github.com/candlerb/sshtokenca/util"
+	"golang.org/x/crypto/ssh"
+	"os"
+	"strings"
+)
+
+// Where the secret unlocking a key given on the command line may be
+// found, and what to call the key when prompting for it
+type keySource struct {
+	name     string // e.g. "Server private key"
+	passFile string // file holding the key password, if given
+	passEnv  string // environment variable which may hold the key password
+	agent    bool   // whether the key is always in the ssh-agent
+	ca       bool   // whether the key is a CA key
+}
+
+// The source of the server private key, -t
+func serverKeySource(options Options) keySource {
+	return keySource{
+		name:     "Server private key",
+		passFile: options.KeyPassFile,
+		passEnv:  keyPassphraseEnv,
+	}
+}
+
+// The source of the certificate authority private keys, -c
+func caKeySource(options Options) keySource {
+	return keySource{
+		name:     "Certificate Authority private key",
+		passFile: options.CAPassFile,
+		passEnv:  caPassphraseEnv,
+		agent:    options.CAAgent,
+		ca:       true,
+	}
+}
+
+// Check that the CA keys given in ca_names, at the top level and for each
+// tenant, are among those loaded
+func checkCANames(settings *util.Settings, caKeys []ssh.Signer, tenantKeys map[string][]ssh.Signer) error {
+	err := settings.CheckCANames(caKeys)
+	if err != nil {
+		return err
+	}
+	for _, t := range settings.Tenants {
+		err = t.Settings().CheckCANames(tenantKeys[t.Name])
+		if err != nil {
+			return fmt.Errorf("tenant %s: %s", t.Name, err)
+		}
+	}
+	return nil
+}
+
+// Print the public key of each CA key, as a line for sshd's
+// TrustedUserCAKeys file, or as a cert-authority line for an
+// authorized_keys or known_hosts file
+func printCAPublicKeys(caKeys []ssh.Signer, format string) {
+	for _, caKey := range caKeys {
+		line := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(caKey.PublicKey())))
+		switch format {
+		case "authorized_keys":
+			line = "cert-authority " + line
+		case "known_hosts":
+			line = "@cert-authority * " + line
+		}
+		fmt.Println(line)
+	}
+}
+
+// Load a private key, detecting from spec where it is held:
+//
+//	agent:SHA256:...    in the ssh-agent at $SSH_AUTH_SOCK, by fingerprint
+//	pkcs11:...          in an HSM or smartcard, by PKCS#11 URI
+//	vault://...         in Vault's SSH secrets engine, for CA keys only
+//	anything else       in an OpenSSH private key file
+//
+// The password, PIN or Vault token is read or prompted for as needed. A
+// CA key file's certificate is loaded with it, if it has one.
+func loadKey(spec string, src keySource, options Options) (ssh.Signer, error) {
+	if fingerprint, ok := util.AgentKeyRef(spec); ok || src.agent {
+		if !ok {
+			fingerprint = spec
+		}
+		return util.LoadAgentSigner(os.Getenv("SSH_AUTH_SOCK"), fingerprint)
+	}
+
+	if util.IsVaultURI(spec) {
+		if !src.ca {
+			return nil, fmt.Errorf("vault keys can only be CA keys")
+		}
+		uri, err := util.ParseVaultURI(spec)
+		if err != nil {
+			return nil, err
+		}
+		token, _, err := readPassphrase(options.VaultTokenFile, vaultTokenEnv, "\nVault token: ")
+		if err != nil {
+			return nil, fmt.Errorf("could not read vault token: %s", err)
+		}
+		return util.LoadVaultSigner(uri, string(token))
+	}
+
+	if util.IsPKCS11URI(spec) {
+		uri, err := util.ParsePKCS11URI(spec)
+		if err != nil {
+			return nil, err
+		}
+		if uri.PIN == "" {
+			pin, err := promptSecret(fmt.Sprintf("\n%s token PIN for %s: ", src.name, uri.Object))
+			if err != nil {
+				return nil, fmt.Errorf("could not read PIN: %s", err)
+			}
+			uri.PIN = string(pin)
+		}
+		return util.LoadPKCS11Signer(uri)
+	}
+
+	key, err := util.LoadPrivateKey(spec)
+	_, passphraseNeeded := err.(*ssh.PassphraseMissingError)
+	if passphraseNeeded {
+		pw, source, err2 := readPassphrase(src.passFile, src.passEnv, fmt.Sprintf("\n%s password for %s: ", src.name, spec))
+		if err2 != nil {
+			return nil, fmt.Errorf("could not read password: %s", err2)
+		}
+		key, err = util.LoadPrivateKeyWithPassword(spec, pw)
+		if err != nil {
+			err = fmt.Errorf("%s with the password from %s", err, source)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if src.ca {
+		return util.LoadCACertificate(key, spec)
+	}
+	return key, nil
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+)
+
+// Open the listeners for the server: the sockets passed by systemd if
+// socket activated, otherwise each --listen address, or the -i and -p
+// address if none are given. If any address cannot be bound, all are
+// closed and an error returned.
+func openListeners(options Options) ([]net.Listener, bool, error) {
+	listeners, err := systemdListeners()
+	if err != nil || listeners != nil {
+		return listeners, true, err
+	}
+
+	addrs := options.Listen
+	if len(addrs) == 0 {
+		addrs = []string{strings.Join([]string{options.IPAddress, options.Port}, ":")}
+	}
+	for _, addr := range addrs {
+		listener, err := net.Listen("tcp", addr)
+		if err != nil {
+			closeListeners(listeners)
+			return nil, false, err
+		}
+		listeners = append(listeners, listener)
+	}
+	return listeners, false, nil
+}
+
+func closeListeners(listeners []net.Listener) {
+	for _, listener := range listeners {
+		listener.Close()
+	}
+}
+
+// Wait for SIGINT or SIGTERM, then close done and the listeners
+func closeOnSignal(listeners []net.Listener, done chan struct{}) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	s := <-sig
+	logInfo("shutdown", logFields{"signal": s.String()}, "%s received, shutting down", s)
+	close(done)
+	closeListeners(listeners)
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// Log output format, "text" or "json", set from the command line
+var logFormat = "text"
+
+// Structured fields attached to a log event, such as "user" or
+// "remote_addr". Error values are logged as their message.
+type logFields map[string]interface{}
+
+func logInfo(event string, fields logFields, format string, args ...interface{}) {
+	logEvent("info", event, fields, format, args...)
+}
+
+func logWarn(event string, fields logFields, format string, args ...interface{}) {
+	logEvent("warning", event, fields, format, args...)
+}
+
+func logError(event string, fields logFields, format string, args ...interface{}) {
+	logEvent("error", event, fields, format, args...)
+}
+
+// Log the event and exit
+func logFatal(event string, fields logFields, format string, args ...interface{}) {
+	logEvent("fatal", event, fields, format, args...)
+	removePidFile()
+	os.Exit(1)
+}
+
+// Write a single log event. In text format only the message is written,
+// in json format the message and fields are written as one json object
+// per line.
+func logEvent(level, event string, fields logFields, format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	if logFormat != "json" {
+		log.Print(msg)
+		return
+	}
+	record := map[string]interface{}{}
+	for k, v := range fields {
+		if v == nil {
+			continue
+		}
+		if err, ok := v.(error); ok {
+			v = err.Error()
+		}
+		record[k] = v
+	}
+	record["timestamp"] = time.Now().UTC().Format(time.RFC3339Nano)
+	record["level"] = level
+	record["event"] = event
+	record["message"] = strings.TrimSpace(msg)
+	line, err := json.Marshal(record)
+	if err != nil {
+		log.Printf("could not marshal log event %s: %s", event, err)
+		return
+	}
+	os.Stderr.Write(append(line, '\n'))
+}
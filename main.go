@@ -1,16 +1,30 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
 	"github.com/candlerb/sshtokenca/util"
 	flags "github.com/jessevdk/go-flags"
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/crypto/ssh/terminal"
+	"io/ioutil"
 	"net"
 	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 )
 
 const VERSION = "0.0.5-candlerb"
+
+// Build metadata, set with e.g.
+// go build -ldflags "-X main.commit=$(git rev-parse --short HEAD) -X main.buildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+var (
+	commit    = "unknown"
+	buildDate = "unknown"
+)
+
 const usage = `<options> <yamlfile>
 
 SSH Agent CA version %s
@@ -20,6 +34,11 @@ A proof-of-concept SSH server forwarded agent certificate authority
     sshtokenca -h
     sshtokenca -p <privatekey> -c <caprivatekey>
                -i <ipaddress> -p <port> settings.yaml
+    sshtokenca --testOIDC settings.yaml
+    sshtokenca --check settings.yaml
+    sshtokenca --revokeSerial <serial> --revokeKeyID <keyid> settings.yaml
+    sshtokenca -c <caprivatekey> --issue-dryrun <user> settings.yaml
+    sshtokenca --example > settings.yaml
 
 Application Arguments:
 
@@ -28,17 +47,72 @@ Application Arguments:
 
 // flag options
 type Options struct {
-	PrivateKey   string `short:"t" long:"privateKey" required:"true" description:"server ssh private key (password protected)"`
-	CAPrivateKey string `short:"c" long:"caPrivateKey" required:"true" description:"certificate authority private key (password protected)"`
-	IPAddress    string `short:"i" long:"ipAddress" default:"0.0.0.0" description:"ipaddress"`
-	Port         string `short:"p" long:"port" default:"2222" description:"port"`
-	Args         struct {
-		YamlFile string `description:"settings yaml file"`
-	} `positional-args:"yes" required:"yes"`
+	PrivateKey     string   `short:"t" long:"privateKey" description:"server ssh private key file, agent:SHA256:... or pkcs11: URI"`
+	CAPrivateKey   []string `short:"c" long:"caPrivateKey" description:"certificate authority private key file, agent:SHA256:..., pkcs11: or vault:// URI; may be repeated, the first is used for signing"`
+	KeyPassFile    string   `long:"keyPassphraseFile" description:"file holding the server private key password"`
+	CAPassFile     string   `long:"caPassphraseFile" description:"file holding the certificate authority private key password"`
+	CAAgent        bool     `long:"caAgent" description:"sign using the ssh-agent at $SSH_AUTH_SOCK; -c gives the fingerprint of the CA key, which agent: may also mark"`
+	VaultTokenFile string   `long:"vaultTokenFile" description:"file holding the token for a vault:// CA"`
+	IPAddress      string   `short:"i" long:"ipAddress" default:"0.0.0.0" description:"ipaddress"`
+	Port           string   `short:"p" long:"port" default:"2222" description:"port"`
+	Listen         []string `long:"listen" description:"address and port to listen on, e.g. [::]:2222; may be repeated, and overrides -i and -p"`
+	MetricsAddr    string   `long:"metricsAddr" description:"address to serve prometheus metrics on, e.g. 127.0.0.1:9222"`
+	HealthAddr     string   `long:"healthAddr" description:"address to serve a readiness check on, e.g. 127.0.0.1:9223"`
+	ControlSocket  string   `long:"controlSocket" description:"path of a unix socket taking status, reload and maintenance commands"`
+	PidFile        string   `long:"pidfile" description:"file to write the process id to, refusing to start if it names a running process"`
+	LogFormat      string   `long:"logFormat" default:"text" choice:"text" choice:"json" description:"log output format"`
+	RequireEnv     bool     `long:"requireEnv" description:"fail if the settings file refers to an unset environment variable"`
+	TestOIDC       bool     `long:"testOIDC" description:"check the oidc provider configuration and exit"`
+	Check          bool     `long:"check" description:"check the settings file, print a summary and exit"`
+	RevokeSerial   []uint64 `long:"revokeSerial" description:"revoke the certificate with this serial, write the KRL and exit; may be repeated"`
+	RevokeKeyID    []string `long:"revokeKeyID" description:"revoke the certificates with this key id, write the KRL and exit; may be repeated"`
+	WriteKRL       bool     `long:"writeKRL" description:"write the KRL of revoked certificates and exit"`
+	History        string   `long:"history" value-name:"USER" description:"list the certificates recently issued to a user or host from the database and exit"`
+	HistoryLimit   int      `long:"historyLimit" default:"20" description:"how many certificates --history lists"`
+	IssueDryRun    string   `long:"issue-dryrun" value-name:"USER" description:"print the certificate which would be issued to a user and exit; needs -c"`
+	DryRunFormat   string   `long:"dryrunFormat" default:"text" choice:"text" choice:"json" description:"--issue-dryrun output format"`
+	CAPubKey       bool     `long:"ca-pubkey" description:"print the public key of each CA key given with -c and exit"`
+	CAPubKeyFormat string   `long:"caPubkeyFormat" default:"plain" choice:"plain" choice:"authorized_keys" choice:"known_hosts" description:"--ca-pubkey output: plain for TrustedUserCAKeys, or a cert-authority line for authorized_keys or known_hosts"`
+	Example        bool     `long:"example" description:"print an example settings file and exit"`
+	Version        bool     `long:"version" description:"print the version and exit"`
+	Args           struct {
+		YamlFile string `description:"settings yaml file, or https URL to fetch it from"`
+	} `positional-args:"yes"`
+}
+
+// Environment variables which may hold the key passphrases, for
+// unattended startup
+const (
+	keyPassphraseEnv = "SSHTOKENCA_KEY_PASSPHRASE"
+	caPassphraseEnv  = "SSHTOKENCA_CA_PASSPHRASE"
+	vaultTokenEnv    = "VAULT_TOKEN"
+)
+
+// Environment variable holding the basic auth password for a settings URL
+const settingsPasswordEnv = "SSHTOKENCA_SETTINGS_PASSWORD"
+
+// Load the settings from a file, or fetch them if given an https URL,
+// warning of any public key listed for more than one user
+func loadSettings(yamlFile string) (util.Settings, error) {
+	var settings util.Settings
+	var err error
+	if util.IsSettingsURL(yamlFile) {
+		settings, err = util.SettingsLoadURL(yamlFile, os.Getenv(settingsPasswordEnv))
+	} else {
+		settings, err = util.SettingsLoad(yamlFile)
+	}
+	if err != nil {
+		return settings, err
+	}
+	for _, shared := range settings.SharedKeys() {
+		logWarn("shared_key", logFields{"path": yamlFile}, "WARNING: %s; set forbid_shared_keys to refuse this", shared)
+	}
+	return settings, nil
 }
 
 func hardexit(msg string) {
 	fmt.Printf("\n\n> %s\n\nAborting startup.\n", msg)
+	removePidFile()
 	os.Exit(1)
 }
 
@@ -52,48 +126,277 @@ func main() {
 		os.Exit(1)
 	}
 
-	fmt.Println("SSH Agent CA")
+	if options.Version {
+		fmt.Printf("sshtokenca %s (commit %s, built %s)\n", VERSION, commit, buildDate)
+		os.Exit(0)
+	}
+	if options.Example {
+		fmt.Print(util.ExampleSettings())
+		os.Exit(0)
+	}
+	if options.Args.YamlFile == "" {
+		parser.WriteHelp(os.Stderr)
+		os.Exit(1)
+	}
+
+	if options.IssueDryRun == "" && !options.CAPubKey {
+		fmt.Println("SSH Agent CA")
+	}
+	logFormat = options.LogFormat
 
 	// load settings
-	settings, err := util.SettingsLoad(options.Args.YamlFile)
+	util.RequireEnv = options.RequireEnv
+	util.OIDCDiscoveryRetry = func(issuer string, attempt int, err error, wait time.Duration) {
+		logWarn("oidc_discovery_retry", logFields{"issuer": issuer, "attempt": attempt, "error": err},
+			"oidc provider discovery for %s failed (attempt %d), retrying in %s: %s", issuer, attempt, wait, err)
+	}
+	settings, err := loadSettings(options.Args.YamlFile)
 	if err != nil {
 		hardexit(fmt.Sprintf("Settings could not be loaded : %s", err))
 	}
 
+	if options.Check {
+		checkSettings(options.Args.YamlFile, settings)
+		os.Exit(0)
+	}
+
+	if len(options.RevokeSerial) > 0 || len(options.RevokeKeyID) > 0 || options.WriteKRL {
+		var caKeys []ssh.PublicKey
+		if settings.KRLFile != "" {
+			if len(options.CAPrivateKey) == 0 {
+				hardexit("The CA private key (-c) is required to write the KRL")
+			}
+			caKeys = krlCAKeys(options, settings)
+		}
+		err = revoke(options.RevokeSerial, options.RevokeKeyID, caKeys, settings)
+		if err != nil {
+			hardexit(fmt.Sprintf("Revocation failed: %s", err))
+		}
+		os.Exit(0)
+	}
+
+	if options.History != "" {
+		err = printHistory(settings.Database, options.History, options.HistoryLimit)
+		if err != nil {
+			hardexit(fmt.Sprintf("Could not read the history: %s", err))
+		}
+		os.Exit(0)
+	}
+
+	if options.TestOIDC {
+		testOIDC(settings)
+		os.Exit(0)
+	}
+
+	if options.CAPubKey {
+		if len(options.CAPrivateKey) == 0 {
+			hardexit("The CA private key (-c) is required")
+		}
+		caKeys := loadCAKeys(options.CAPrivateKey, options, settings)
+		printCAPublicKeys(caKeys, options.CAPubKeyFormat)
+		os.Exit(0)
+	}
+
+	if options.IssueDryRun != "" {
+		if len(options.CAPrivateKey) == 0 {
+			hardexit("The CA private key (-c) is required")
+		}
+		caKeys := loadCAKeys(options.CAPrivateKey, options, settings)
+		err = issueDryRun(options.IssueDryRun, options.DryRunFormat, caKeys, &settings)
+		if err != nil {
+			hardexit(fmt.Sprintf("No certificate would be issued: %s", err))
+		}
+		os.Exit(0)
+	}
+
+	if options.PrivateKey == "" || len(options.CAPrivateKey) == 0 {
+		hardexit("Both the server private key (-t) and CA private key (-c) are required")
+	}
+
+	// refuse to start a second server with the same pid file
+	if options.PidFile != "" {
+		err = writePidFile(options.PidFile)
+		if err != nil {
+			hardexit(fmt.Sprintf("Could not write the pid file, %s", err))
+		}
+	}
+
+	// report not ready while the keys are loaded
+	if options.HealthAddr != "" {
+		serveHealth(options.HealthAddr)
+	}
+
 	// check ip
-	if net.IP(options.IPAddress) == nil {
+	listenFromSettings(parser, &options, settings)
+	if net.ParseIP(options.IPAddress) == nil {
 		hardexit(fmt.Sprintf("Invalid ip address %s", options.IPAddress))
 	}
 
-	// load server private key
-	privateKey, err := util.LoadPrivateKey(options.PrivateKey)
-	_, passphraseNeeded := err.(*ssh.PassphraseMissingError)
-	if passphraseNeeded {
-		fmt.Printf("\nServer private key password: ")
-		pvtPW, err2 := terminal.ReadPassword(0)
-		if err2 != nil {
-			hardexit(fmt.Sprintf("Could not read password: %s", err))
+	// open the database now, so as not to fail at the first issuance
+	if settings.Database != "" {
+		_, err = openHistory(settings.Database)
+		if err != nil {
+			hardexit(fmt.Sprintf("Database could not be opened, %s", err))
 		}
-		privateKey, err = util.LoadPrivateKeyWithPassword(options.PrivateKey, pvtPW)
 	}
+
+	// load server private key
+	privateKey, err := loadKey(options.PrivateKey, serverKeySource(options), options)
 	if err != nil {
 		hardexit(fmt.Sprintf("Private key could not be loaded, %s", err))
 	}
+	err = util.CheckKeyStrength(privateKey.PublicKey(), settings.MinRSABits)
+	if err != nil {
+		hardexit(fmt.Sprintf("Private key is too weak, %s", err))
+	}
+
+	caKeys := loadCAKeys(options.CAPrivateKey, options, settings)
+	tenantKeys := loadTenantCAKeys(options, settings)
+	err = checkCANames(&settings, caKeys, tenantKeys)
+	if err != nil {
+		hardexit(fmt.Sprintf("CA keys do not match the settings, %s", err))
+	}
+
+	Serve(options, privateKey, caKeys, tenantKeys, settings)
+	removePidFile()
+}
+
+// Take the address and port to listen on from the listen_address and
+// listen_port settings, unless given by -i and -p
+func listenFromSettings(parser *flags.Parser, options *Options, settings util.Settings) {
+	if settings.ListenAddress != "" && !optionGiven(parser, "ipAddress") {
+		options.IPAddress = settings.ListenAddress
+	}
+	if settings.ListenPort != 0 && !optionGiven(parser, "port") {
+		options.Port = strconv.Itoa(settings.ListenPort)
+	}
+}
+
+// Report whether an option was given on the command line, rather than
+// taking its default
+func optionGiven(parser *flags.Parser, longName string) bool {
+	option := parser.FindOptionByLongName(longName)
+	return option.IsSet() && !option.IsSetDefault()
+}
 
-	// load certificate authority private key
-	caKey, err := util.LoadPrivateKey(options.CAPrivateKey)
-	_, passphraseNeeded = err.(*ssh.PassphraseMissingError)
-	if passphraseNeeded {
-		fmt.Printf("\nCertificate Authority private key password: ")
-		caPW, err2 := terminal.ReadPassword(0)
-		if err2 != nil {
-			hardexit(fmt.Sprintf("Could not read password: %s", err))
+// Load the certificate authority private keys given by specs. The first
+// signs certificates, so must always load. Under the "any" policy we carry
+// on with those of the others which load, otherwise all must load.
+func loadCAKeys(specs []string, options Options, settings util.Settings) []ssh.Signer {
+	var caKeys []ssh.Signer
+	for _, spec := range specs {
+		caKey, err := loadKey(spec, caKeySource(options), options)
+		if err == nil {
+			// check the signature algorithm suits the CA key
+			_, err = util.NewCASigner(caKey, settings.SignatureAlgorithm)
 		}
-		caKey, err = util.LoadPrivateKeyWithPassword(options.CAPrivateKey, caPW)
+		if err == nil {
+			err = util.CheckKeyStrength(caKey.PublicKey(), settings.MinRSABits)
+		}
+		if err == nil {
+			err = checkCAExpiry(spec, caKey, settings)
+		}
+		if err != nil {
+			if settings.CALoadPolicy != "any" || len(caKeys) == 0 {
+				hardexit(fmt.Sprintf("CA key %s could not be loaded, %s", spec, err))
+			}
+			logWarn("ca_key_failed", logFields{"ca_key": spec, "error": err}, "WARNING: CA key %s could not be loaded, continuing without it: %s", spec, err)
+			continue
+		}
+		caKeys = append(caKeys, caKey)
 	}
+	return caKeys
+}
+
+// Refuse a CA key whose own certificate is not currently valid, and warn
+// if it expires within the ca_expiry_warning period
+func checkCAExpiry(spec string, caKey ssh.Signer, settings util.Settings) error {
+	expiry, err := util.CheckCAValidity(caKey, time.Now())
 	if err != nil {
-		hardexit(fmt.Sprintf("CA Private key could not be loaded, %s", err))
+		return err
 	}
+	if !expiry.IsZero() && time.Until(expiry) < settings.CAExpiryWarning {
+		logWarn("ca_expiring", logFields{"ca_key": spec, "expiry": expiry},
+			"WARNING: the certificate of CA key %s expires at %s", spec, expiry.UTC().Format(time.RFC3339))
+	}
+	return nil
+}
+
+// Read a key passphrase from file if given, or the environment variable
+// env if it is set, otherwise prompt for it on the terminal. Returns where
+// the passphrase came from, for error messages.
+func readPassphrase(file string, env string, prompt string) ([]byte, string, error) {
+	if file != "" {
+		pw, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, "", err
+		}
+		pw = bytes.TrimSuffix(pw, []byte("\n"))
+		pw = bytes.TrimSuffix(pw, []byte("\r"))
+		return pw, file, nil
+	}
+	if pw, ok := os.LookupEnv(env); ok {
+		return []byte(pw), "$" + env, nil
+	}
+	if !terminal.IsTerminal(0) {
+		return nil, "", fmt.Errorf("no terminal to prompt on; set %s", env)
+	}
+	pw, err := promptSecret(prompt)
+	return pw, "the terminal", err
+}
+
+// Prompt for a password or PIN on the terminal, without echoing it. The
+// prompt is written to stderr, so that printed output such as --ca-pubkey
+// may be redirected.
+func promptSecret(prompt string) ([]byte, error) {
+	if !terminal.IsTerminal(0) {
+		return nil, fmt.Errorf("no terminal to prompt on")
+	}
+	fmt.Fprint(os.Stderr, prompt)
+	return terminal.ReadPassword(0)
+}
 
-	Serve(options, privateKey, caKey, settings)
+// Print a summary of settings which have loaded and validated, without
+// starting the server
+func checkSettings(yamlFile string, settings util.Settings) {
+	fmt.Printf("Settings OK:  %s\n", yamlFile)
+	fmt.Printf("Organisation: %s\n", settings.Organisation)
+	fmt.Printf("Validity:     %s\n", settings.Validity)
+	var extensions []string
+	for k := range settings.Extensions {
+		extensions = append(extensions, k)
+	}
+	sort.Strings(extensions)
+	fmt.Printf("Extensions:   %s\n", strings.Join(extensions, " "))
+	fmt.Printf("Users:        %d\n", len(settings.Users))
+	for _, u := range settings.Users {
+		fmt.Printf("    %s: %s\n", u.Name, strings.Join(settings.UserPrincipalList(u), ", "))
+	}
+	for _, t := range settings.Tenants {
+		fmt.Printf("Tenant:       %s (%s) on %s, %d users\n", t.Name, t.Settings().Organisation, t.Listen, len(t.Settings().Users))
+	}
+}
+
+// Report the oidc provider configuration discovered from the settings,
+// without starting the server
+func testOIDC(settings util.Settings) {
+	if settings.OpenIDC == nil {
+		hardexit("No oidc provider is configured in the settings file")
+	}
+	info, err := settings.OpenIDC.ProviderInfo()
+	if err != nil {
+		hardexit(fmt.Sprintf("Could not read oidc provider configuration: %s", err))
+	}
+	fmt.Printf("Issuer:                 %s\n", info.Issuer)
+	fmt.Printf("Authorization endpoint: %s\n", info.AuthURL)
+	fmt.Printf("Token endpoint:         %s\n", info.TokenURL)
+	fmt.Printf("JWKS URI:               %s\n", info.JWKSURL)
+	fmt.Printf("Userinfo endpoint:      %s\n", info.UserInfoURL)
+	fmt.Printf("Supported scopes:       %s\n", strings.Join(info.ScopesSupported, " "))
+	fmt.Printf("Requested scopes:       %s\n", strings.Join(settings.OpenIDC.Scopes, " "))
+	authReq, err := settings.OpenIDC.NewAuthRequest()
+	if err != nil {
+		hardexit(fmt.Sprintf("Could not start oidc auth request: %s", err))
+	}
+	fmt.Printf("Sample auth code URL:\n%s\n", settings.OpenIDC.AuthCodeURL(authReq))
 }
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+)
+
+// Whether the server is in maintenance mode, in which it accepts
+// connections but issues no certificates
+type maintenanceMode struct {
+	on int32
+}
+
+var maintenance = &maintenanceMode{}
+
+// Report whether the server is in maintenance mode
+func (m *maintenanceMode) On() bool {
+	return atomic.LoadInt32(&m.on) == 1
+}
+
+// Enter maintenance mode if the server is not in it, or leave it if it
+// is, reporting whether it is now in maintenance mode
+func (m *maintenanceMode) Toggle() bool {
+	for {
+		old := atomic.LoadInt32(&m.on)
+		if atomic.CompareAndSwapInt32(&m.on, old, 1-old) {
+			return old == 0
+		}
+	}
+}
+
+// Enter or leave maintenance mode, for the reason given, logging the
+// change
+func (m *maintenanceMode) Set(on bool, reason string) {
+	v := int32(0)
+	if on {
+		v = 1
+	}
+	if atomic.SwapInt32(&m.on, v) == v {
+		return
+	}
+	m.logChange(on, reason)
+}
+
+func (m *maintenanceMode) logChange(on bool, reason string) {
+	if on {
+		logInfo("maintenance_on", logFields{"reason": reason}, "%s, entering maintenance mode; no certificates will be issued", reason)
+	} else {
+		logInfo("maintenance_off", logFields{"reason": reason}, "%s, leaving maintenance mode; issuing certificates again", reason)
+	}
+}
+
+// toggleMaintenanceOnSigusr1 puts the server into maintenance mode, or
+// takes it out, each time the process receives SIGUSR1. Sessions already
+// issued a certificate are unaffected.
+func toggleMaintenanceOnSigusr1() {
+	sigusr1 := make(chan os.Signal, 1)
+	signal.Notify(sigusr1, syscall.SIGUSR1)
+	go func() {
+		for range sigusr1 {
+			maintenance.logChange(maintenance.Toggle(), "SIGUSR1 received")
+		}
+	}()
+}
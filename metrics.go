@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Issuance statistics, exposed in the Prometheus text format by
+// serveMetrics. The counters are always maintained, but are only
+// published when a metrics address is given.
+var metrics = newMetricsRegistry()
+
+// Upper bounds in seconds of the issuance latency histogram buckets
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type metricsRegistry struct {
+	mu           sync.Mutex
+	connections  uint64
+	issued       uint64
+	authFailures map[string]uint64
+	latency      histogram
+	signingWait  histogram
+}
+
+type histogram struct {
+	counts []uint64 // per bucket, not cumulative
+	sum    float64
+	count  uint64
+}
+
+func newMetricsRegistry() *metricsRegistry {
+	return &metricsRegistry{
+		authFailures: map[string]uint64{},
+		latency:      histogram{counts: make([]uint64, len(latencyBuckets))},
+		signingWait:  histogram{counts: make([]uint64, len(latencyBuckets))},
+	}
+}
+
+// Count an incoming tcp connection
+func (m *metricsRegistry) Connection() {
+	m.mu.Lock()
+	m.connections++
+	m.mu.Unlock()
+}
+
+// Count a failed authentication attempt by method, e.g. "publickey"
+func (m *metricsRegistry) AuthFailure(method string) {
+	m.mu.Lock()
+	m.authFailures[method]++
+	m.mu.Unlock()
+}
+
+// Return how many certificates have been issued
+func (m *metricsRegistry) IssuedCount() uint64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.issued
+}
+
+// Count a certificate issued and record how long issuance took
+func (m *metricsRegistry) Issued(elapsed time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.issued++
+	m.latency.observe(elapsed.Seconds())
+}
+
+// Record how long a certificate waited for the signing rate limiter
+func (m *metricsRegistry) SigningWait(wait time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.signingWait.observe(wait.Seconds())
+}
+
+func (h *histogram) observe(v float64) {
+	for i, le := range latencyBuckets {
+		if v <= le {
+			h.counts[i]++
+			break
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+// Write all metrics in the Prometheus text exposition format
+func (m *metricsRegistry) Write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fmt.Fprintln(w, "# HELP sshtokenca_connections_total Incoming TCP connections.")
+	fmt.Fprintln(w, "# TYPE sshtokenca_connections_total counter")
+	fmt.Fprintf(w, "sshtokenca_connections_total %d\n", m.connections)
+
+	fmt.Fprintln(w, "# HELP sshtokenca_certificates_issued_total Certificates successfully added to a client agent.")
+	fmt.Fprintln(w, "# TYPE sshtokenca_certificates_issued_total counter")
+	fmt.Fprintf(w, "sshtokenca_certificates_issued_total %d\n", m.issued)
+
+	fmt.Fprintln(w, "# HELP sshtokenca_auth_failures_total Failed authentication attempts by method.")
+	fmt.Fprintln(w, "# TYPE sshtokenca_auth_failures_total counter")
+	methods := make([]string, 0, len(m.authFailures))
+	for method := range m.authFailures {
+		methods = append(methods, method)
+	}
+	sort.Strings(methods)
+	for _, method := range methods {
+		fmt.Fprintf(w, "sshtokenca_auth_failures_total{method=%q} %d\n", method, m.authFailures[method])
+	}
+
+	fmt.Fprintln(w, "# HELP sshtokenca_issuance_duration_seconds Time taken to issue a certificate.")
+	fmt.Fprintln(w, "# TYPE sshtokenca_issuance_duration_seconds histogram")
+	m.latency.write(w, "sshtokenca_issuance_duration_seconds")
+
+	fmt.Fprintln(w, "# HELP sshtokenca_signing_wait_seconds Time spent queued for the CA signing rate limit.")
+	fmt.Fprintln(w, "# TYPE sshtokenca_signing_wait_seconds histogram")
+	m.signingWait.write(w, "sshtokenca_signing_wait_seconds")
+}
+
+func (h *histogram) write(w io.Writer, name string) {
+	var cumulative uint64
+	for i, le := range latencyBuckets {
+		cumulative += h.counts[i]
+		fmt.Fprintf(w, "%s_bucket{le=\"%g\"} %d\n", name, le, cumulative)
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, h.count)
+	fmt.Fprintf(w, "%s_sum %g\n", name, h.sum)
+	fmt.Fprintf(w, "%s_count %d\n", name, h.count)
+}
+
+// Serve the metrics over http at /metrics on addr
+func serveMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		metrics.Write(w)
+	})
+	logInfo("metrics_listening", logFields{"address": addr}, "Serving metrics on http://%s/metrics", addr)
+	go func() {
+		err := http.ListenAndServe(addr, mux)
+		logFatal("metrics_failed", logFields{"address": addr, "error": err}, "Metrics server failed: %s", err)
+	}()
+}
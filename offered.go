@@ -0,0 +1,84 @@
+package main
+
+import (
+	"golang.org/x/crypto/ssh"
+	"sync"
+	"time"
+)
+
+// How long the key offered on a connection is remembered for a later step
+// of its authentication, which must finish within the session timeout in
+// any case
+const offerLifetime = 10 * time.Minute
+
+// Remembers a key a client offered for public key authentication on each
+// connection, by session id, for a later step of its authentication
+type offerTracker struct {
+	mu     sync.Mutex
+	offers map[string]offer
+	lastGC time.Time
+}
+
+type offer struct {
+	key ssh.PublicKey
+	at  time.Time
+}
+
+// The first plain key offered on each connection, so that the refresh
+// token from an oidc login on that connection can be kept for that key
+// alone, once the client's agent has proved it holds it
+var offeredKeys = &offerTracker{offers: map[string]offer{}}
+
+// The last key refused on each connection, which with identify_unknown
+// the client is told once it has no more keys to offer
+var refusedKeys = &offerTracker{offers: map[string]offer{}}
+
+// Record that key was offered on the connection with sessionID, unless
+// another was offered first
+func (t *offerTracker) Offered(sessionID []byte, key ssh.PublicKey) {
+	now := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.gc(now)
+	if _, ok := t.offers[string(sessionID)]; ok {
+		return
+	}
+	t.offers[string(sessionID)] = offer{key: key, at: now}
+}
+
+// Record that key was offered on the connection with sessionID, in place
+// of any offered before
+func (t *offerTracker) Replace(sessionID []byte, key ssh.PublicKey) {
+	now := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.gc(now)
+	t.offers[string(sessionID)] = offer{key: key, at: now}
+}
+
+// Return and forget the key recorded on the connection with
+// sessionID, or nil if none was
+func (t *offerTracker) Take(sessionID []byte) ssh.PublicKey {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	o, ok := t.offers[string(sessionID)]
+	if !ok {
+		return nil
+	}
+	delete(t.offers, string(sessionID))
+	return o.key
+}
+
+// Drop the offers of connections which never logged in, at most once per
+// offerLifetime. Must be called with the lock held.
+func (t *offerTracker) gc(now time.Time) {
+	if now.Sub(t.lastGC) < offerLifetime {
+		return
+	}
+	for id, o := range t.offers {
+		if now.Sub(o.at) >= offerLifetime {
+			delete(t.offers, id)
+		}
+	}
+	t.lastGC = now
+}
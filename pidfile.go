@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// The pid file written at startup, which every way of exiting removes
+var pidFile string
+
+// Write the process id to the pid file at path. If the file names a
+// process which is still running, another server is using it, so the
+// file is left alone and an error returned. A file left behind by a
+// process which has gone is replaced.
+func writePidFile(path string) error {
+	if pid, ok := readPidFile(path); ok {
+		if processRunning(pid) {
+			return fmt.Errorf("pid file %s names process %d, which is still running", path, pid)
+		}
+		os.Remove(path)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	pidFile = path
+	_, err = fmt.Fprintf(f, "%d\n", os.Getpid())
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Remove the pid file written at startup, if any, on shutdown or when
+// startup fails, provided it still names this process
+func removePidFile() {
+	if pidFile == "" {
+		return
+	}
+	if pid, ok := readPidFile(pidFile); ok && pid == os.Getpid() {
+		os.Remove(pidFile)
+	}
+}
+
+// Return the process id in the pid file at path, if it holds one
+func readPidFile(path string) (int, bool) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, false
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil || pid <= 0 {
+		return 0, false
+	}
+	return pid, true
+}
+
+// Report whether a process with the given id exists, even if it belongs
+// to another user
+func processRunning(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
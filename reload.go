@@ -0,0 +1,88 @@
+package main
+
+import (
+	"github.com/candlerb/sshtokenca/util"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// liveSettings holds the settings currently in use by the server. The
+// settings may be replaced at any time by a reload, so each connection
+// should take a snapshot with Get and use that throughout.
+type liveSettings struct {
+	v      atomic.Value
+	loaded atomic.Value // when the settings were loaded
+
+	// further checks of reloaded settings against what was loaded at
+	// startup, if set
+	check func(settings *util.Settings) error
+}
+
+func newLiveSettings(settings *util.Settings) *liveSettings {
+	l := &liveSettings{}
+	l.Set(settings)
+	return l
+}
+
+// Get the current settings
+func (l *liveSettings) Get() *util.Settings {
+	return l.v.Load().(*util.Settings)
+}
+
+// Set replaces the current settings
+func (l *liveSettings) Set(settings *util.Settings) {
+	l.v.Store(settings)
+	l.loaded.Store(time.Now())
+}
+
+// Return when the current settings were loaded
+func (l *liveSettings) Loaded() time.Time {
+	return l.loaded.Load().(time.Time)
+}
+
+// Reload the settings from yamlFilePath. If the new settings cannot be
+// loaded the current settings are kept.
+func (l *liveSettings) Reload(yamlFilePath string) error {
+	settings, err := loadSettings(yamlFilePath)
+	if err != nil {
+		return err
+	}
+	if l.check != nil {
+		err = l.check(&settings)
+		if err != nil {
+			return err
+		}
+	}
+	l.Set(&settings)
+	return nil
+}
+
+// reloadOnSighup reloads the settings from yamlFilePath each time the
+// process receives SIGHUP. Connections in progress keep the settings they
+// started with.
+func reloadOnSighup(live *liveSettings, yamlFilePath string) {
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	go func() {
+		for range sighup {
+			reloadSettings(live, yamlFilePath, "SIGHUP received")
+		}
+	}()
+}
+
+// Reload the settings from yamlFilePath, for the reason given, logging and
+// recording the outcome for the health check
+func reloadSettings(live *liveSettings, yamlFilePath string, reason string) error {
+	logInfo("settings_reload", logFields{"path": yamlFilePath, "reason": reason}, "%s, reloading settings from %s", reason, yamlFilePath)
+	err := live.Reload(yamlFilePath)
+	health.Reloaded(err)
+	if err != nil {
+		logError("settings_reload_failed", logFields{"path": yamlFilePath, "error": err}, "settings reload failed, keeping previous settings: %s", err)
+		return err
+	}
+	logInfo("settings_reloaded", logFields{"path": yamlFilePath}, "settings reloaded")
+	return nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/candlerb/sshtokenca/util"
+	"golang.org/x/crypto/ssh"
+	"time"
+)
+
+// Revoke certificates by serial and key id, recording them in the
+// revoked_file, then write the KRL of all the revoked certificates from
+// caKeys to the krl_file, if one is set
+func revoke(serials []uint64, keyIDs []string, caKeys []ssh.PublicKey, settings util.Settings) error {
+	if settings.RevokedFile == "" {
+		return errors.New("no revoked_file is set in the settings")
+	}
+	revoked, err := util.LoadRevocations(settings.RevokedFile)
+	if err != nil {
+		return fmt.Errorf("revoked_file: %s", err)
+	}
+	for _, serial := range serials {
+		if revoked.RevokeSerial(serial) {
+			fmt.Printf("Revoked serial %d\n", serial)
+		} else {
+			fmt.Printf("Serial %d was already revoked\n", serial)
+		}
+	}
+	for _, keyID := range keyIDs {
+		if revoked.RevokeKeyID(keyID) {
+			fmt.Printf("Revoked key id %s\n", keyID)
+		} else {
+			fmt.Printf("Key id %s was already revoked\n", keyID)
+		}
+	}
+	if len(serials) > 0 || len(keyIDs) > 0 {
+		err = revoked.Save(settings.RevokedFile)
+		if err != nil {
+			return fmt.Errorf("revoked_file: %s", err)
+		}
+	}
+
+	if settings.KRLFile == "" {
+		fmt.Printf("No krl_file is set, so no KRL was written\n")
+		return nil
+	}
+	err = revoked.WriteKRL(settings.KRLFile, caKeys, time.Now())
+	if err != nil {
+		return fmt.Errorf("krl_file: %s", err)
+	}
+	fmt.Printf("Wrote KRL of %d serials and %d key ids for %d CA keys to %s\n",
+		len(revoked.Serials), len(revoked.KeyIDs), len(caKeys), settings.KRLFile)
+	return nil
+}
+
+// The public keys of the server's and every tenant's CA keys, whose
+// certificates the KRL revokes
+func krlCAKeys(options Options, settings util.Settings) []ssh.PublicKey {
+	var caKeys []ssh.PublicKey
+	for _, caKey := range loadCAKeys(options.CAPrivateKey, options, settings) {
+		caKeys = append(caKeys, caKey.PublicKey())
+	}
+	for _, keys := range loadTenantCAKeys(options, settings) {
+		for _, caKey := range keys {
+			caKeys = append(caKeys, caKey.PublicKey())
+		}
+	}
+	return caKeys
+}
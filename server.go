@@ -1,14 +1,17 @@
 package main
 
 import (
-	"bytes"
 	"context"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"github.com/candlerb/sshtokenca/util"
+	oidc "github.com/coreos/go-oidc"
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/crypto/ssh/agent"
 	"golang.org/x/crypto/ssh/terminal"
-	"log"
+	"golang.org/x/oauth2"
+	"io"
 	"net"
 	"strings"
 	"time"
@@ -24,47 +27,182 @@ import (
 // https://godoc.org/golang.org/x/crypto/ssh#ServerConn and the Scalingo
 // blog posting at
 // https://scalingo.com/blog/writing-a-replacement-to-openssh-using-go-22.html
-func Serve(options Options, privateKey ssh.Signer, caKey ssh.Signer, settings util.Settings) {
+// The settings are reloaded from the yaml file on SIGHUP.
+// The first of caKeys signs certificates, except for users whose ca names
+// another in ca_names; all of them are returned by get-ca, so that a new
+// CA key can be distributed before it is used.
+// Each tenant is served on its own listener, signing with its CA keys in
+// tenantKeys.
+func Serve(options Options, privateKey ssh.Signer, caKeys []ssh.Signer, tenantKeys map[string][]ssh.Signer, initialSettings util.Settings) {
 	ctx := context.Background()
+	live := newLiveSettings(&initialSettings)
+	live.check = func(settings *util.Settings) error {
+		err := checkTenantsUnchanged(&initialSettings, settings)
+		if err != nil {
+			return err
+		}
+		return checkCANames(settings, caKeys, tenantKeys)
+	}
+	reloadOnSighup(live, options.Args.YamlFile)
+	toggleMaintenanceOnSigusr1()
 
 	// configure server
+	top := &site{live: live, caKeys: caKeys}
+	sshConfig := newServerConfig(ctx, top, privateKey)
+
+	if options.MetricsAddr != "" {
+		serveMetrics(options.MetricsAddr)
+	}
+
+	// setup net listeners
+	logInfo("starting", logFields{"organisation": initialSettings.Organisation}, "\n\nStarting server connection for %s...", initialSettings.Organisation)
+	listeners, activated, err := openListeners(options)
+	if err != nil {
+		logFatal("listen_failed", logFields{"error": err}, "Failed to listen: %s", err)
+	}
+	sites := make([]*site, len(listeners))
+	for i := range sites {
+		sites[i] = top
+	}
+	tenantListeners, tenantSites, err := openTenantListeners(live, tenantKeys)
+	if err != nil {
+		closeListeners(listeners)
+		logFatal("listen_failed", logFields{"error": err}, "Failed to listen: %s", err)
+	}
+	listeners = append(listeners, tenantListeners...)
+	sites = append(sites, tenantSites...)
+	if initialSettings.ProxyProtocol {
+		logInfo("proxy_protocol", logFields{}, "Expecting PROXY protocol headers on incoming connections")
+	}
+	for i, listener := range listeners {
+		if sites[i].tenant != "" {
+			logInfo("listening", logFields{"address": listener.Addr().String(), "tenant": sites[i].tenant}, "Listening on %s for tenant %s", listener.Addr(), sites[i].tenant)
+			continue
+		}
+		logInfo("listening", logFields{"address": listener.Addr().String(), "socket_activated": activated}, "Listening on %s", listener.Addr())
+	}
+
+	health.Ready(live, append([]*site{top}, tenantSites...))
+
+	// accept connections on each listener until shut down
+	done := make(chan struct{})
+	for i, listener := range listeners {
+		config := sshConfig
+		if sites[i] != top {
+			config = newServerConfig(ctx, sites[i], privateKey)
+		}
+		go acceptLoop(listener, done, config, sites[i])
+	}
+	if options.ControlSocket != "" {
+		control, err := serveControl(options.ControlSocket, live, options.Args.YamlFile)
+		if err != nil {
+			logFatal("control_failed", logFields{"path": options.ControlSocket, "error": err}, "Failed to open control socket: %s", err)
+		}
+		listeners = append(listeners, control)
+	}
+	closeOnSignal(listeners, done)
+}
+
+// Return the ssh server configuration for the connections to a site,
+// authenticating users with the settings in force for it
+func newServerConfig(ctx context.Context, st *site, privateKey ssh.Signer) *ssh.ServerConfig {
 	sshConfig := &ssh.ServerConfig{
 		// public key callback taken directly from ssh.ServerConn example
 		PublicKeyCallback: func(c ssh.ConnMetadata, pubKey ssh.PublicKey) (*ssh.Permissions, error) {
+			start := time.Now()
+			settings := st.Get()
+			if settings == nil {
+				authFailureDelay(start)
+				return nil, errTenantRemoved
+			}
+			if err := checkClientVersion(c, settings); err != nil {
+				return nil, err
+			}
 			u, err := settings.UserByName(c.User())
 			if err != nil {
-				return nil, err
+				if h, err := settings.HostByName(c.User()); err == nil {
+					perms, err := acceptHost(h, pubKey)
+					if err != nil {
+						return publicKeyRefused(c, start, pubKey, err, settings)
+					}
+					return perms, nil
+				}
+				return publicKeyRefused(c, start, pubKey, err, settings)
 			}
-			for _, key := range u.PublicKeys() {
-				if bytes.Equal(pubKey.Marshal(), key.Marshal()) {
-					return nil, nil
+			if cert, ok := pubKey.(*ssh.Certificate); ok {
+				// a certificate from a trusted CA for this user stands
+				// in for their registered key
+				err := checkClientCert(cert, settings, c)
+				if err != nil {
+					return publicKeyRefused(c, start, pubKey, err, settings)
+				}
+				if !settings.KeyTypeAccepted(cert.Key.Type()) {
+					return refuse(fmt.Sprintf("Key type %s is no longer accepted; please use Ed25519", cert.Key.Type())), nil
+				}
+				logInfo("certificate_auth", logFields{"user": c.User(), "remote_addr": c.RemoteAddr().String(), "key_id": cert.KeyId, "serial": cert.Serial},
+					"user %s authenticated with certificate %s serial %d", c.User(), cert.KeyId, cert.Serial)
+				return accept(u, cert.Key), nil
+			}
+			if keyListed(pubKey, u.PublicKeys()) {
+				if !settings.KeyTypeAccepted(pubKey.Type()) {
+					// let the user in, but only to tell them why
+					// they won't get a certificate
+					logWarn("key_type_refused", logFields{"user": c.User(), "remote_addr": c.RemoteAddr().String(), "key_type": pubKey.Type()},
+						"user %s presented key type %s which is no longer accepted", c.User(), pubKey.Type())
+					return refuse(fmt.Sprintf("Key type %s is no longer accepted; please use Ed25519", pubKey.Type())), nil
+				}
+				return accept(u, pubKey), nil
+			}
+			if settings.OpenIDC != nil && u.OIDCSubject != "" {
+				// a key with a refresh token kept for it logs in once
+				// the handshake has proved the client holds it
+				if settings.OpenIDC.HasRefreshToken(u.Name, pubKey) {
+					return refreshPending(u, pubKey), nil
+				}
+				if settings.OpenIDC.RefreshEnabled() {
+					offeredKeys.Offered(c.SessionID(), pubKey)
 				}
 			}
-			return nil, fmt.Errorf("unknown public key")
+			return publicKeyRefused(c, start, pubKey, fmt.Errorf("unknown public key"), settings)
 		},
 		KeyboardInteractiveCallback: func(c ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
-			if settings.OpenIDC == nil {
-				return nil, fmt.Errorf("OpenIDC not configured")
+			settings := st.Get()
+			if settings == nil {
+				return nil, errTenantRemoved
 			}
-			instruction := "Visit this URL to obtain auth code:\n" + settings.OpenIDC.AuthCodeURL("") + "\n"
-			answers, err := client(c.User(), instruction, []string{"Enter your auth code: "}, []bool{true})
-			if err != nil {
+			if err := checkClientVersion(c, settings); err != nil {
 				return nil, err
 			}
-			if len(answers) != 1 {
-				return nil, fmt.Errorf("Unexpected number of answers: %d", len(answers))
+			if settings.OpenIDC == nil {
+				if perms, ok := identifyRefused(c, settings); ok {
+					return perms, nil
+				}
+				return nil, fmt.Errorf("OpenIDC not configured")
+			}
+			login := oidcAuthCode
+			if settings.OpenIDC.DeviceFlow {
+				login = oidcDevice
 			}
-			idToken, err := settings.OpenIDC.CodeToIDToken(ctx, answers[0])
+			idToken, token, err := login(ctx, c, client, settings)
 			if err != nil {
+				authFailed(c, "keyboard-interactive", settings)
 				return nil, err
 			}
 			u, err := settings.UserByName(c.User())
 			if err != nil {
-				return nil, err
+				return claimedLogin(c, client, settings, idToken)
+			}
+			matchCtx, cancel := context.WithTimeout(ctx, settings.OIDCTimeout)
+			matched, err := settings.OpenIDC.MatchSubject(matchCtx, token, idToken, u.OIDCSubject)
+			cancel()
+			if err != nil {
+				logWarn("oidc_userinfo_failed", logFields{"user": c.User(), "subject": idToken.Subject, "error": err},
+					"userinfo lookup for %s failed: %s", idToken.Subject, err)
 			}
-			if idToken.Subject != u.OIDCSubject {
+			if !matched {
 				// User authenticated successfully but we don't know them.
 				// Let them know their Subject anyway
+				authFailed(c, "keyboard-interactive", settings)
 				msg := fmt.Sprintf("Not authorized for this service: %v", idToken.Subject)
 				_, err := client(c.User(), msg, []string{}, []bool{})
 				if err != nil {
@@ -72,74 +210,763 @@ func Serve(options Options, privateKey ssh.Signer, caKey ssh.Signer, settings ut
 				}
 				return nil, fmt.Errorf("unknown oidc subject %s for %q", idToken.Subject, c.User())
 			}
-			return nil, nil
+			if reason := accountRefusal(u); reason != "" {
+				return refuse(reason), nil
+			}
+			perms, err := addGroups(&ssh.Permissions{}, settings, idToken)
+			if err != nil {
+				authFailed(c, "keyboard-interactive", settings)
+				return nil, err
+			}
+			offered := offeredKeys.Take(c.SessionID())
+			if settings.OpenIDC.RefreshEnabled() && token.RefreshToken != "" && offered != nil {
+				// kept once the session's agent proves it holds the key
+				if perms.Extensions == nil {
+					perms.Extensions = map[string]string{}
+				}
+				perms.Extensions[refreshTokenExtension] = token.RefreshToken
+				perms.Extensions[refreshKeyExtension] = string(offered.Marshal())
+			}
+			return perms, nil
 		},
 	}
 	sshConfig.AddHostKey(privateKey)
+	return sshConfig
+}
 
-	// setup net listener
-	log.Printf("\n\nStarting server connection for %s...", settings.Organisation)
-	addr_port := strings.Join([]string{options.IPAddress, options.Port}, ":")
-	listener, err := net.Listen("tcp", addr_port)
-	if err != nil {
-		log.Fatalf("Failed to listen on %s", addr_port)
-	} else {
-		log.Printf("Listening on %s", addr_port)
+// The error for a client whose version is not in allowed_client_versions
+var errClientVersion = errors.New("client version not allowed")
+
+// Refuse a client whose version is not allowed, before it authenticates,
+// so that it never reaches the identity provider or a user's key
+func checkClientVersion(c ssh.ConnMetadata, settings *util.Settings) error {
+	if settings.ClientVersionAllowed(string(c.ClientVersion())) {
+		return nil
 	}
+	logWarn("client_version_denied", logFields{"user": c.User(), "remote_addr": c.RemoteAddr().String(), "client_version": string(c.ClientVersion())},
+		"refusing authentication from %s, whose client version %s is not allowed", c.RemoteAddr(), c.ClientVersion())
+	return errClientVersion
+}
 
+// Accept connections on listener and service them, until done is closed.
+// Each connection is serviced in its own goroutine, from the handshake to
+// the certificate being added to the agent, so that a slow client or
+// agent holds up no other. State shared between connections, such as the
+// serial counter, metrics and audit log, is synchronised where it is kept.
+func acceptLoop(listener net.Listener, done chan struct{}, sshConfig *ssh.ServerConfig, st *site) {
 	for {
 		// make tcp connection
 		tcpConn, err := listener.Accept()
 		if err != nil {
-			log.Printf("failed to accept incoming connection (%s)", err)
+			select {
+			case <-done:
+				return
+			default:
+			}
+			logError("accept_failed", logFields{"error": err}, "failed to accept incoming connection (%s)", err)
 			continue
 		}
+		metrics.Connection()
 
-		// provide handshake
-		sshConn, chans, reqs, err := ssh.NewServerConn(tcpConn, sshConfig)
-		if err != nil {
-			log.Printf("failed to handshake (%s)", err)
+		// service the connection, if there is room
+		current := st.Get()
+		if current == nil {
+			logWarn("tenant_removed", logFields{"remote_addr": tcpConn.RemoteAddr().String(), "tenant": st.tenant},
+				"refusing connection from %s for tenant %s, which has been removed", tcpConn.RemoteAddr(), st.tenant)
+			tcpConn.Close()
+			continue
+		}
+		if !connLimiter.Acquire(current.MaxConcurrent) {
+			logWarn("too_many_connections", logFields{"remote_addr": tcpConn.RemoteAddr().String(), "max_concurrent": current.MaxConcurrent},
+				"refusing connection from %s, already servicing %d connections", tcpConn.RemoteAddr(), current.MaxConcurrent)
+			tcpConn.Close()
 			continue
 		}
-		go ssh.DiscardRequests(reqs)
+		go serveConn(tcpConn, sshConfig, st, current)
+	}
+}
+
+// Handshake with a client, issue their certificate and service their
+// session. The connection's slot in connLimiter is released on return.
+// The whole connection, from handshake to the end of the session, is
+// closed once session_timeout has passed. current is the site's settings
+// when the connection was accepted.
+func serveConn(tcpConn net.Conn, sshConfig *ssh.ServerConfig, st *site, current *util.Settings) {
+	caKeys := st.caKeys
+	defer connLimiter.Release()
+	defer func() {
+		if r := recover(); r != nil {
+			logError("panic", logFields{"remote_addr": tcpConn.RemoteAddr().String(), "error": r}, "INTERNAL ERROR: panic servicing %s: %v", tcpConn.RemoteAddr(), r)
+			tcpConn.Close()
+		}
+	}()
 
-		// report remote address, user and key
-		log.Printf("new ssh connection for user %s from %s (%s)", sshConn.User(), sshConn.RemoteAddr(), sshConn.ClientVersion())
+	deadline := time.Now().Add(current.SessionTimeout)
+	timer := time.AfterFunc(current.SessionTimeout, func() { tcpConn.Close() })
+	defer timer.Stop()
 
-		// extract user
-		user, err := settings.UserByName(sshConn.User())
+	// behind a load balancer, take the client address from the PROXY
+	// protocol header, so that it is used for the checks and logs below
+	if current.ProxyProtocol {
+		conn, err := util.ReadProxyHeader(tcpConn)
 		if err != nil {
-			log.Printf("INTERNAL ERROR: unable to find user %s", sshConn.User())
+			logWarn("proxy_header_failed", logFields{"remote_addr": tcpConn.RemoteAddr().String(), "error": err},
+				"refusing connection from %s with bad proxy header: %s", tcpConn.RemoteAddr(), err)
+			tcpConn.Close()
+			return
+		}
+		tcpConn = conn
+	}
+
+	// refuse clients from networks which are not allowed, or which
+	// have recently failed to authenticate too often
+	if ip := net.ParseIP(remoteIP(tcpConn.RemoteAddr())); ip == nil || !current.NetworkAllowed(ip) {
+		logWarn("network_denied", logFields{"remote_addr": tcpConn.RemoteAddr().String()},
+			"refusing connection from %s, which is not in an allowed network", tcpConn.RemoteAddr())
+		tcpConn.Close()
+		return
+	}
+	if authFailures.Blocked(tcpConn.RemoteAddr(), current.MaxAttempts, current.AttemptWindow) {
+		logWarn("rate_limited", logFields{"remote_addr": tcpConn.RemoteAddr().String()},
+			"refusing connection from %s after too many authentication failures", tcpConn.RemoteAddr())
+		tcpConn.Close()
+		return
+	}
+
+	// provide handshake, watching it for the algorithms negotiated
+	kexConn := util.NewKexConn(tcpConn)
+	sshConn, chans, reqs, err := ssh.NewServerConn(kexConn, sshConfig)
+	if err != nil {
+		logError("handshake_failed", logFields{"remote_addr": tcpConn.RemoteAddr().String(), "error": err}, "failed to handshake (%s)", err)
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+
+	// report remote address, user and key, and the crypto negotiated
+	fingerprint := clientKeyFingerprint(sshConn.Permissions)
+	logInfo("connection", logFields{"user": sshConn.User(), "remote_addr": sshConn.RemoteAddr().String(), "client_version": string(sshConn.ClientVersion()), "key_fingerprint": fingerprint},
+		"new ssh connection for user %s from %s (%s) with key %s", sshConn.User(), sshConn.RemoteAddr(), sshConn.ClientVersion(), fingerprint)
+	algs, _ := kexConn.Algorithms()
+	setAlgorithms(sshConn.Permissions, algs)
+	setTenant(sshConn.Permissions, st.tenant)
+	sessionID := hex.EncodeToString(sshConn.SessionID())
+	logInfo("negotiated", logFields{"user": sshConn.User(), "remote_addr": sshConn.RemoteAddr().String(), "session_id": sessionID,
+		"server_version": string(sshConn.ServerVersion()), "kex": algs.Kex, "host_key": algs.HostKey, "cipher": algs.Cipher(), "mac": algs.MAC()},
+		"ssh connection from %s negotiated kex %s, host key %s, cipher %s, mac %s for session %s",
+		sshConn.RemoteAddr(), algs.Kex, algs.HostKey, algs.Cipher(), algs.MAC(), sessionID)
+
+	// extract user, using the settings in force for the remainder
+	// of this connection
+	settings := st.Get()
+	if settings == nil {
+		logWarn("tenant_removed", logFields{"remote_addr": sshConn.RemoteAddr().String(), "tenant": st.tenant}, "tenant %s has been removed", st.tenant)
+		sshConn.Close()
+		return
+	}
+	if key, ok := identifyKey(sshConn.Permissions); ok {
+		handleIdentifyChannels(chans, sshConn, key, deadline)
+		return
+	}
+	if name, ok := hostName(sshConn.Permissions); ok {
+		host, err := settings.HostByName(name)
+		if err != nil {
+			logError("host_not_found", logFields{"host": name, "remote_addr": sshConn.RemoteAddr().String()}, "INTERNAL ERROR: unable to find host %s", name)
 			sshConn.Close()
-			continue
+			return
 		}
+		handleHostChannels(chans, host, settings, sshConn, caKeys, deadline)
+		return
+	}
+	user, err := settings.UserByName(sshConn.User())
+	if name, ok := claimedUser(sshConn.Permissions); ok {
+		user, err = settings.ClaimedUser(name)
+	}
+	if err != nil {
+		logError("user_not_found", logFields{"user": sshConn.User(), "remote_addr": sshConn.RemoteAddr().String()}, "INTERNAL ERROR: unable to find user %s", sshConn.User())
+		sshConn.Close()
+		return
+	}
+	caKey, err := settings.UserCAKey(user, caKeys)
+	if err != nil {
+		logError("ca_not_found", logFields{"user": user.Name, "error": err}, "INTERNAL ERROR: no CA key for user %s: %s", user.Name, err)
+		sshConn.Close()
+		return
+	}
+
+	// a key with a refresh token kept for it has now been proved
+	if reason := refreshLogin(sshConn, user, settings); reason != "" {
+		sshConn.Permissions.Extensions[refusalExtension] = reason
+	}
 
-		message, err := addCertificate(user, settings, sshConn, caKey)
+	// the certificate is issued once the session asks for it, with any
+	// principals requested
+	iss := &issuance{
+		user:       user,
+		principals: settings.UserPrincipalList(user),
+		patterns:   user.PrincipalPatterns,
+		settings:   settings,
+		sshConn:    sshConn,
+		caKey:      caKey,
+		totp:       totpRequired(sshConn.Permissions),
+	}
 
-		// accept all channels
-		go handleChannels(chans, user, settings, sshConn, message, err)
+	// OIDC users may be restricted to the principals their groups allow,
+	// which leaves no room for patterns
+	if groups, ok := oidcGroups(sshConn.Permissions); ok {
+		iss.principals = settings.PrincipalsForGroups(user, groups)
+		iss.patterns = nil
+		logInfo("oidc_groups", logFields{"user": user.Name, "groups": groups, "principals": iss.principals},
+			"user %s has groups %s granting principals %s", user.Name, groups, iss.principals)
+		if len(iss.principals) == 0 {
+			iss.refusal = "None of your groups grant any of your principals"
+		}
+	}
+	if reason := refusal(sshConn.Permissions); reason != "" {
+		logInfo("certificate_refused", logFields{"user": user.Name, "remote_addr": sshConn.RemoteAddr().String(), "reason": reason},
+			"refusing certificate for %s: %s", user.Name, reason)
+		iss.refusal = reason
 	}
+
+	// accept all channels
+	handleChannels(chans, iss, caKeys, deadline)
 }
 
-func addCertificate(user *util.UserPrincipals, settings util.Settings,
-	sshConn *ssh.ServerConn, caKey ssh.Signer) (string, error) {
+// Log in with oidc by asking the user to paste back the auth code, or the
+// URL their browser was redirected to
+func oidcAuthCode(ctx context.Context, c ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge,
+	settings *util.Settings) (*oidc.IDToken, *oauth2.Token, error) {
+	authReq, err := settings.OpenIDC.NewAuthRequest()
+	if err != nil {
+		return nil, nil, err
+	}
+	instruction := "Visit this URL to obtain auth code:\n" + settings.OpenIDC.AuthCodeURL(authReq) + "\n"
+	answers, err := client(c.User(), instruction, []string{"Enter your auth code or redirect URL: "}, []bool{true})
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(answers) != 1 {
+		return nil, nil, fmt.Errorf("Unexpected number of answers: %d", len(answers))
+	}
+
+	// a provider which does not respond fails the login, rather than
+	// holding the connection until the session timeout
+	ctx, cancel := context.WithTimeout(ctx, settings.OIDCTimeout)
+	defer cancel()
+	idToken, token, err := settings.OpenIDC.CodeToIDToken(ctx, authReq, answers[0])
+	if ctx.Err() == context.DeadlineExceeded {
+		msg := "The identity provider did not respond in time; please try again"
+		client(c.User(), msg, []string{}, []bool{})
+		return nil, nil, fmt.Errorf("oidc token exchange timed out after %s", settings.OIDCTimeout)
+	}
+	return idToken, token, err
+}
+
+// Log in with the oidc device flow, showing the user where to approve the
+// login and waiting, within the session timeout, until they have
+func oidcDevice(ctx context.Context, c ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge,
+	settings *util.Settings) (*oidc.IDToken, *oauth2.Token, error) {
+	da, err := settings.OpenIDC.StartDeviceAuth(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	instruction := fmt.Sprintf("Visit %s and enter the code %s\n", da.VerificationURI, da.UserCode)
+	if da.VerificationURIComplete != "" {
+		instruction += fmt.Sprintf("or visit %s\n", da.VerificationURIComplete)
+	}
+	_, err = client(c.User(), instruction+"Waiting for approval...\n", []string{}, []bool{})
+	if err != nil {
+		return nil, nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, settings.SessionTimeout)
+	defer cancel()
+	return settings.OpenIDC.DeviceToIDToken(ctx, da)
+}
+
+// Count a failed authentication attempt by method, and against the
+// client's address for rate limiting
+func authFailed(c ssh.ConnMetadata, method string, settings *util.Settings) {
+	metrics.AuthFailure(method)
+	if settings.MaxAttempts > 0 {
+		authFailures.Failure(c.RemoteAddr(), settings.AttemptWindow)
+	}
+}
+
+// Permissions extension used to carry a reason for refusing a certificate
+// to a user who has nevertheless authenticated
+const refusalExtension = "refusal@sshtokenca"
+
+// Permissions for an authenticated user who must not be issued a
+// certificate
+func refuse(reason string) *ssh.Permissions {
+	return &ssh.Permissions{
+		Extensions: map[string]string{refusalExtension: reason},
+	}
+}
+
+// Permissions extension marking a user who has authenticated with their
+// public key but must still give a TOTP code
+const totpExtension = "totp@sshtokenca"
+
+// Permissions extension used to carry the public key a user authenticated
+// with, in wire format, so that it can be certified if they have no agent
+const clientKeyExtension = "pubkey@sshtokenca"
+
+// Permissions extensions carrying the algorithms negotiated by the
+// connection's key exchange, for the audit log
+const (
+	kexExtension    = "kex@sshtokenca"
+	cipherExtension = "cipher@sshtokenca"
+	macExtension    = "mac@sshtokenca"
+)
+
+// Record the algorithms negotiated by the connection, if they are known,
+// in its permissions
+func setAlgorithms(perms *ssh.Permissions, algs util.KexAlgorithms) {
+	if perms == nil || algs.Kex == "" {
+		return
+	}
+	if perms.Extensions == nil {
+		perms.Extensions = map[string]string{}
+	}
+	perms.Extensions[kexExtension] = algs.Kex
+	perms.Extensions[cipherExtension] = algs.Cipher()
+	perms.Extensions[macExtension] = algs.MAC()
+}
+
+// Return the kex, cipher and MAC negotiated by the connection, or ""
+// where they are not known
+func connAlgorithms(perms *ssh.Permissions) (string, string, string) {
+	if perms == nil {
+		return "", "", ""
+	}
+	return perms.Extensions[kexExtension], perms.Extensions[cipherExtension], perms.Extensions[macExtension]
+}
+
+// Return why a user who has authenticated may not have a certificate, if
+// their account is disabled or has expired
+func accountRefusal(u *util.UserPrincipals) string {
+	if !u.IsEnabled() {
+		return "Your account is disabled; no certificate can be issued"
+	}
+	if u.Expired(time.Now()) {
+		return fmt.Sprintf("Your account expired at %s; no certificate can be issued", u.Expiry().Format(time.RFC3339))
+	}
+	return ""
+}
+
+// Permissions for a user whose public key, or certificate for key, has
+// been accepted
+func accept(u *util.UserPrincipals, key ssh.PublicKey) *ssh.Permissions {
+	if reason := accountRefusal(u); reason != "" {
+		return refuse(reason)
+	}
+	perms := &ssh.Permissions{
+		Extensions: map[string]string{clientKeyExtension: string(key.Marshal())},
+	}
+	if u.RequiresTOTP() {
+		perms.Extensions[totpExtension] = ""
+	}
+	return perms
+}
+
+// Return the public key the user authenticated with, if any
+func clientKey(perms *ssh.Permissions) ssh.PublicKey {
+	if perms == nil {
+		return nil
+	}
+	v, ok := perms.Extensions[clientKeyExtension]
+	if !ok {
+		return nil
+	}
+	key, err := ssh.ParsePublicKey([]byte(v))
+	if err != nil {
+		return nil
+	}
+	return key
+}
+
+// Return the SHA256 fingerprint of the public key the user authenticated
+// with, which tells apart the devices of a user with several keys, or ""
+// if there is none
+func clientKeyFingerprint(perms *ssh.Permissions) string {
+	key := clientKey(perms)
+	if key == nil {
+		return ""
+	}
+	return ssh.FingerprintSHA256(key)
+}
+
+// Report whether perms require a TOTP code before issuing a certificate
+func totpRequired(perms *ssh.Permissions) bool {
+	if perms == nil {
+		return false
+	}
+	_, ok := perms.Extensions[totpExtension]
+	return ok
+}
+
+// Permissions extension used to carry the groups of an oidc user,
+// separated by newlines, when the groups claim is in use
+const groupsExtension = "groups@sshtokenca"
+
+// Add the user's groups to perms, if the oidc groups claim is in use
+func addGroups(perms *ssh.Permissions, settings *util.Settings, idToken *oidc.IDToken) (*ssh.Permissions, error) {
+	if settings.OpenIDC.GroupsClaim == "" {
+		return perms, nil
+	}
+	groups, err := settings.OpenIDC.Groups(idToken)
+	if err != nil {
+		return nil, err
+	}
+	if perms.Extensions == nil {
+		perms.Extensions = map[string]string{}
+	}
+	perms.Extensions[groupsExtension] = strings.Join(groups, "\n")
+	return perms, nil
+}
+
+// Permissions extensions carrying the refresh token from a user's oidc
+// login, and the key they first offered on the connection, for which it
+// is kept once their agent proves it holds the key
+const (
+	refreshTokenExtension = "refresh@sshtokenca"
+	refreshKeyExtension   = "refresh-key@sshtokenca"
+)
+
+// Permissions extension marking a user who offered a public key for which
+// a refresh token is kept, whose login is completed with the refresh
+// token once the handshake has proved they hold the key
+const refreshPendingExtension = "refresh-pending@sshtokenca"
+
+// Permissions for a user who offered key, for which a refresh token is
+// kept. The provider is only asked to refresh it after the handshake, as
+// the callback is also called for keys the client has not signed with.
+func refreshPending(u *util.UserPrincipals, key ssh.PublicKey) *ssh.Permissions {
+	perms := accept(u, key)
+	if clientKey(perms) != nil {
+		perms.Extensions[refreshPendingExtension] = ""
+	}
+	return perms
+}
+
+// Complete the login of a user who authenticated with a key for which a
+// refresh token is kept, if the provider still vouches for them, adding
+// their groups to the connection's permissions. Otherwise returns why no
+// certificate can be issued.
+func refreshLogin(sshConn *ssh.ServerConn, u *util.UserPrincipals, settings *util.Settings) string {
+	if sshConn.Permissions == nil {
+		return ""
+	}
+	if _, ok := sshConn.Permissions.Extensions[refreshPendingExtension]; !ok {
+		return ""
+	}
+	const renewFailed = "Your oidc login could not be renewed; please connect again to log in"
+	pubKey := clientKey(sshConn.Permissions)
+	if settings.OpenIDC == nil || pubKey == nil {
+		return renewFailed
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), settings.OIDCTimeout)
+	defer cancel()
+	idToken, token, err := settings.OpenIDC.RefreshIDToken(ctx, u.Name, pubKey)
+	if err != nil {
+		authFailed(sshConn, "refresh", settings)
+		logWarn("oidc_refresh_failed", logFields{"user": u.Name, "remote_addr": sshConn.RemoteAddr().String(), "error": err},
+			"oidc refresh for %s failed, the full login is needed: %s", u.Name, err)
+		return renewFailed
+	}
+	matched, err := settings.OpenIDC.MatchSubject(ctx, token, idToken, u.OIDCSubject)
+	if err != nil {
+		logWarn("oidc_userinfo_failed", logFields{"user": u.Name, "subject": idToken.Subject, "error": err},
+			"userinfo lookup for %s failed: %s", idToken.Subject, err)
+	}
+	if !matched {
+		authFailed(sshConn, "refresh", settings)
+		logWarn("oidc_refresh_failed", logFields{"user": u.Name, "remote_addr": sshConn.RemoteAddr().String(), "subject": idToken.Subject},
+			"oidc refresh for %s gave unknown subject %s", u.Name, idToken.Subject)
+		return renewFailed
+	}
+	if _, err := addGroups(sshConn.Permissions, settings, idToken); err != nil {
+		logWarn("oidc_refresh_failed", logFields{"user": u.Name, "remote_addr": sshConn.RemoteAddr().String(), "error": err},
+			"oidc refresh for %s gave no groups: %s", u.Name, err)
+		return renewFailed
+	}
+	logInfo("oidc_refresh", logFields{"user": u.Name, "remote_addr": sshConn.RemoteAddr().String(), "fingerprint": ssh.FingerprintSHA256(pubKey)},
+		"user %s logged in with an oidc refresh token for key %s", u.Name, ssh.FingerprintSHA256(pubKey))
+	return ""
+}
+
+// Keep the refresh token from a user's oidc login, if any, for the key
+// they first offered on the connection, once their agent has shown it
+// holds that key by signing a fresh challenge, so that they can log in
+// with it next time without the full oidc flow
+func keepRefreshToken(agentC agent.Agent, user *util.UserPrincipals, sshConn *ssh.ServerConn, settings *util.Settings) {
+	if sshConn.Permissions == nil || settings.OpenIDC == nil {
+		return
+	}
+	refreshToken, ok := sshConn.Permissions.Extensions[refreshTokenExtension]
+	if !ok {
+		return
+	}
+	pubKey, err := ssh.ParsePublicKey([]byte(sshConn.Permissions.Extensions[refreshKeyExtension]))
+	if err != nil {
+		return
+	}
+	fingerprint := ssh.FingerprintSHA256(pubKey)
+	challenge := make([]byte, 32)
+	if _, err := io.ReadFull(settings.Random(), challenge); err != nil {
+		logError("refresh_token_failed", logFields{"user": user.Name, "error": err}, "could not make a challenge for %s: %s", user.Name, err)
+		return
+	}
+	challenge = append(sshConn.SessionID(), challenge...)
+	sig, err := agentC.Sign(pubKey, challenge)
+	if err == nil {
+		err = pubKey.Verify(challenge, sig)
+	}
+	if err != nil {
+		logWarn("refresh_token_failed", logFields{"user": user.Name, "fingerprint": fingerprint, "error": err},
+			"agent of %s did not prove it holds key %s, so no refresh token was kept: %s", user.Name, fingerprint, err)
+		return
+	}
+	err = settings.OpenIDC.SaveRefreshToken(user.Name, pubKey, refreshToken)
+	if err != nil {
+		logError("refresh_token_failed", logFields{"user": user.Name, "error": err}, "could not keep refresh token for %s: %s", user.Name, err)
+		return
+	}
+	logInfo("refresh_token_kept", logFields{"user": user.Name, "fingerprint": fingerprint},
+		"kept refresh token for %s for key %s", user.Name, fingerprint)
+}
+
+// Permissions extension carrying the name of an oidc user with no
+// user_principals entry, taken from the oidc username claim
+const claimedUserExtension = "claimed@sshtokenca"
+
+// Return the name of the user carried in perms who has no user_principals
+// entry, and whether there was one
+func claimedUser(perms *ssh.Permissions) (string, bool) {
+	if perms == nil {
+		return "", false
+	}
+	name, ok := perms.Extensions[claimedUserExtension]
+	return name, ok
+}
+
+// Permissions for an oidc user with no user_principals entry, who must
+// log in with the username given by the oidc username claim
+func claimedLogin(c ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge, settings *util.Settings,
+	idToken *oidc.IDToken) (*ssh.Permissions, error) {
+	if settings.OpenIDC.UsernameClaim == "" {
+		authFailed(c, "keyboard-interactive", settings)
+		if settings.IdentifyUnknown {
+			logInfo("identify", logFields{"user": c.User(), "remote_addr": c.RemoteAddr().String(), "subject": idToken.Subject},
+				"unknown user %s from %s told their oidc subject %s", c.User(), c.RemoteAddr(), idToken.Subject)
+			msg := identifyMessage(c.User(), "oidc subject", idToken.Subject)
+			if _, err := client(c.User(), msg, []string{}, []bool{}); err != nil {
+				return nil, err
+			}
+		}
+		return nil, fmt.Errorf("user %s not found", c.User())
+	}
+	if _, err := settings.HostByName(c.User()); err == nil {
+		authFailed(c, "keyboard-interactive", settings)
+		return nil, fmt.Errorf("%s is a host, not a user", c.User())
+	}
+	name, err := settings.OpenIDC.ClaimedUsername(idToken)
+	if err != nil {
+		authFailed(c, "keyboard-interactive", settings)
+		msg := fmt.Sprintf("Not authorized for this service: %s", err)
+		if _, err := client(c.User(), msg, []string{}, []bool{}); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("oidc subject %s for %q refused: %s", idToken.Subject, c.User(), err)
+	}
+	if name != c.User() {
+		authFailed(c, "keyboard-interactive", settings)
+		msg := fmt.Sprintf("Please log in as %s", name)
+		if _, err := client(c.User(), msg, []string{}, []bool{}); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("oidc subject %s has username %s, not %s", idToken.Subject, name, c.User())
+	}
+	logInfo("claimed_user", logFields{"user": name, "subject": idToken.Subject, "remote_addr": c.RemoteAddr().String()},
+		"oidc subject %s logged in as %s from the %s claim", idToken.Subject, name, settings.OpenIDC.UsernameClaim)
+	perms := &ssh.Permissions{
+		Extensions: map[string]string{claimedUserExtension: name},
+	}
+	perms, err = addGroups(perms, settings, idToken)
+	if err != nil {
+		authFailed(c, "keyboard-interactive", settings)
+		return nil, err
+	}
+	return perms, nil
+}
+
+// Return the oidc groups carried in perms, and whether there were any
+func oidcGroups(perms *ssh.Permissions) ([]string, bool) {
+	if perms == nil {
+		return nil, false
+	}
+	v, ok := perms.Extensions[groupsExtension]
+	if !ok {
+		return nil, false
+	}
+	if v == "" {
+		return []string{}, true
+	}
+	return strings.Split(v, "\n"), true
+}
+
+// Return the refusal reason carried in perms, if any
+func refusal(perms *ssh.Permissions) string {
+	if perms == nil {
+		return ""
+	}
+	return perms.Extensions[refusalExtension]
+}
+
+// Issue a certificate to the user's forwarded agent. If they have not
+// forwarded an agent, the key they authenticated with is certified
+// instead, to be given to them in the session. Returns a message for the
+// user, the certificate, and whether it was added to the agent.
+func addCertificate(user *util.UserPrincipals, principals []string, settings *util.Settings,
+	sshConn *ssh.ServerConn, caKey ssh.Signer) (string, *ssh.Certificate, bool, error) {
+	start := time.Now()
+
+	// a host certificate is for the host key the automation presented,
+	// so it is never put in an agent
+	if user.CertificateType() == ssh.HostCert {
+		return certifyClientKey(user, principals, settings, sshConn, caKey, start,
+			"Your host key has been certified. Install this certificate as the\n"+
+				"-cert.pub file alongside the host private key, or fetch it with the\n"+
+				"\"cert\" command:")
+	}
+
 	// https://lists.gt.net/openssh/dev/72190
-	agentChan, reqs, err := sshConn.OpenChannel("auth-agent@openssh.com", nil)
+	agentChan, reqs, err := openAgentChannel(sshConn, settings.AgentTimeout)
+	if err == errAgentTimeout {
+		logWarn("agent_timeout", logFields{"user": user.Name, "remote_addr": sshConn.RemoteAddr().String(), "timeout": settings.AgentTimeout},
+			"agent channel for %s was not opened within %s", user.Name, settings.AgentTimeout)
+		return "Your agent did not respond", nil, false, err
+	}
 	if err != nil {
-		return "Could not open agent channel. Connect using agent forwarding (ssh -A)", err
+		if clientKey(sshConn.Permissions) == nil {
+			return "Could not open agent channel. Connect using agent forwarding (ssh -A)", nil, false, err
+		}
+		return certifyClientKey(user, principals, settings, sshConn, caKey, start,
+			"No forwarded agent, so your key has been certified instead. Save this\n"+
+				"certificate as the -cert.pub file alongside your private key, e.g.\n"+
+				"~/.ssh/id_ed25519-cert.pub, or fetch it with the \"cert\" command:")
 	}
 	defer agentChan.Close()
 	go ssh.DiscardRequests(reqs)
 
 	agentConn := agent.NewClient(agentChan)
+	// each exchange with the agent has agent_timeout, but signing, which
+	// may wait for the signing rate or a remote CA, does not count
+	agentOp := func(op func() error) error {
+		ctx, cancel := context.WithTimeout(context.Background(), settings.AgentTimeout)
+		defer cancel()
+		return withAgentTimeout(ctx, func() { agentChan.Close() }, op)
+	}
+	agentTimedOut := func(what string) (string, *ssh.Certificate, bool, error) {
+		logWarn("agent_timeout", logFields{"user": user.Name, "remote_addr": sshConn.RemoteAddr().String(), "timeout": settings.AgentTimeout},
+			"agent of %s did not %s within %s", user.Name, what, settings.AgentTimeout)
+		return "Your agent did not respond; no certificate was added", nil, false, errAgentTimeout
+	}
 
-	err = addCertToAgent(agentConn, caKey, user, settings)
+	var cert *ssh.Certificate
+	err = agentOp(func() error {
+		cert = reusableCert(agentConn, caKey, user, principals, settings)
+		return nil
+	})
+	if err == errAgentTimeout {
+		return agentTimedOut("list its keys")
+	}
+	if cert != nil {
+		agentOp(func() error {
+			keepRefreshToken(agentConn, user, sshConn, settings)
+			return nil
+		})
+		validBefore := time.Unix(int64(cert.ValidBefore), 0).UTC()
+		logInfo("certificate_reused", logFields{"user": user.Name, "serial": cert.Serial, "valid_before": validBefore},
+			"user %s already holds certificate serial %d valid until %s, so none was issued", user.Name, cert.Serial, validBefore.Format(time.RFC3339))
+		return fmt.Sprintf("Your agent already holds a certificate valid for another %s, so no new one was issued",
+			time.Until(validBefore).Round(time.Minute)), cert, true, nil
+	}
+
+	privKey, pubKey, err := generateCertKey(settings)
+	if err == nil {
+		cert, err = signCertificate(pubKey, caKey, user, principals, settings, sshConn)
+	}
+	if err != nil {
+		logError("certificate_failed", logFields{"user": user.Name, "remote_addr": sshConn.RemoteAddr().String(), "error": err}, "certificate creation error %s", err)
+		return "Certification creation error", nil, false, err
+	}
+	err = agentOp(func() error {
+		return addCertToAgent(agentConn, privKey, cert, caKey, user, settings)
+	})
+	if err == errAgentTimeout {
+		return agentTimedOut(fmt.Sprintf("accept certificate serial %d", cert.Serial))
+	}
+	if err != nil {
+		logError("certificate_failed", logFields{"user": user.Name, "remote_addr": sshConn.RemoteAddr().String(), "serial": cert.Serial, "error": err},
+			"agent of %s refused certificate serial %d: %s", user.Name, cert.Serial, err)
+		return "Your agent did not accept the certificate", nil, false, err
+	}
+	metrics.Issued(time.Since(start))
+	agentOp(func() error {
+		keepRefreshToken(agentConn, user, sshConn, settings)
+		return nil
+	})
+	return "Certification generation complete. Run 'ssh-add -l' to view", cert, true, nil
+}
+
+// Certify the key the user authenticated with, returning the certificate
+// after message, for the user to install themselves
+func certifyClientKey(user *util.UserPrincipals, principals []string, settings *util.Settings,
+	sshConn *ssh.ServerConn, caKey ssh.Signer, start time.Time, message string) (string, *ssh.Certificate, bool, error) {
+	pubKey := clientKey(sshConn.Permissions)
+	if pubKey == nil {
+		return "There is no key to certify", nil, false, fmt.Errorf("no client key")
+	}
+	cert, err := signCertificate(pubKey, caKey, user, principals, settings, sshConn)
 	if err != nil {
-		log.Printf("certificate creation error %s\n", err)
-		return "Certification creation error", err
+		logError("certificate_failed", logFields{"user": user.Name, "remote_addr": sshConn.RemoteAddr().String(), "error": err}, "certificate creation error %s", err)
+		return "Certification creation error", nil, false, err
 	}
+	metrics.Issued(time.Since(start))
+	return message + "\n\n" + strings.TrimSpace(string(ssh.MarshalAuthorizedKey(cert))), cert, false, nil
+}
+
+// How many tries a user has to give their TOTP code
+const totpAttempts = 3
 
-	return "Certification generation complete. Run 'ssh-add -l' to view", nil
+// Prompt for the TOTP code of a user who has authenticated with their
+// public key, returning an error unless it is given correctly. The
+// version of x/crypto/ssh in use cannot ask for a further authentication
+// method after a public key succeeds, so the code is read in the session,
+// which must be completed within the session timeout.
+func promptTOTP(term *terminal.Terminal, user *util.UserPrincipals, settings *util.Settings, sshConn *ssh.ServerConn) (string, error) {
+	for i := 0; i < totpAttempts; i++ {
+		code, err := term.ReadPassword("Verification code: ")
+		if err != nil {
+			return "Could not read verification code", err
+		}
+		step, ok := user.CheckTOTP(code, time.Now())
+		if ok && usedTOTPSteps.Use(connTenant(sshConn.Permissions), user.Name, step) {
+			return "", nil
+		}
+		authFailed(sshConn, "totp", settings)
+		if ok {
+			logWarn("totp_reused", logFields{"user": user.Name, "remote_addr": sshConn.RemoteAddr().String()},
+				"user %s gave a verification code which had already been used", user.Name)
+			termWriter(term, "Verification code already used; wait for the next one")
+			continue
+		}
+		logWarn("totp_failed", logFields{"user": user.Name, "remote_addr": sshConn.RemoteAddr().String()},
+			"user %s gave an incorrect verification code", user.Name)
+		termWriter(term, "Incorrect verification code")
+	}
+	return "Too many incorrect verification codes", fmt.Errorf("Certificate refused")
 }
 
 // write to the connection terminal, ignoring errors
@@ -159,72 +986,114 @@ func chanCloser(c ssh.Channel, isError bool) {
 	// https://tools.ietf.org/html/rfc4254#section-6.10
 	_, err := c.SendRequest("exit-status", false, ssh.Marshal(status))
 	if err != nil {
-		log.Printf("Could not close ssh client connection: %s", err)
+		logError("close_failed", logFields{"error": err}, "Could not close ssh client connection: %s", err)
 	}
 	c.Close()
 }
 
-// Service the incoming channel. The certErr channel indicates when the
-// certificate has finished generation
-func handleChannels(chans <-chan ssh.NewChannel, user *util.UserPrincipals,
-	settings util.Settings, sshConn *ssh.ServerConn, message string, result error) {
+// Service the client's session. The certificate is issued by iss when the
+// session starts a shell or runs the "cert" command, with the principals
+// requested by an "env" request for SSHTOKENCA_PRINCIPALS, if any. Only
+// one session is accepted; other channels are refused. The session is
+// closed at deadline.
+func handleChannels(chans <-chan ssh.NewChannel, iss *issuance, caKeys []ssh.Signer, deadline time.Time) {
+	user, settings, sshConn := iss.user, iss.settings, iss.sshConn
 
 	defer sshConn.Close()
-	limit := time.After(10 * time.Second)
+	limit := time.After(time.Until(deadline))
 
-	// Only accept a *single* channel request
-	select {
-	case thisChan := <-chans:
-		if thisChan == nil {
+	// wait for the session, refusing anything else the client opens first
+	var thisChan ssh.NewChannel
+	for thisChan == nil {
+		select {
+		case newChan := <-chans:
+			if newChan == nil {
+				return
+			}
+			if newChan.ChannelType() != "session" {
+				newChan.Reject(ssh.Prohibited, "channel type is not a session")
+				continue
+			}
+			thisChan = newChan
+		case <-limit:
+			// Forced timeout, close session
 			return
 		}
+	}
+	go rejectChannels(chans, "only one session is allowed")
 
-		if thisChan.ChannelType() != "session" {
-			thisChan.Reject(ssh.Prohibited, "channel type is not a session")
-			return
-		}
+	// accept channel
+	ch, reqs, err := thisChan.Accept()
+	if err != nil {
+		logError("channel_failed", logFields{"user": user.Name, "error": err}, "did not accept channel request %s", err)
+		return
+	}
 
-		// accept channel
-		ch, reqs, err := thisChan.Accept()
-		if err != nil {
-			log.Println("did not accept channel request", err)
-			return
-		}
+	// wait for a "shell" request to return the result text, or an
+	// "exec" request to run a command
+	start, err := util.AwaitSessionStart(reqs, limit, func(name string) bool { return name == principalsEnv })
+	if err == util.ErrSessionClosed || err == util.ErrSessionTimeout {
+		return
+	} else if err != nil {
+		logError("exec_failed", logFields{"user": user.Name, "error": err}, "invalid exec request: %s", err)
+		chanCloser(ch, true)
+		return
+	}
+	logInfo("request", logFields{"user": user.Name, "requests": start.Requests}, "Received requests: %s", strings.Join(start.Requests, ", "))
+	iss.agent = start.Agent
+	var requested []string
+	if value, ok := start.Env[principalsEnv]; ok {
+		requested = parsePrincipals(value)
+	}
 
-		// wait for a "shell" request to return the result text
-		for {
-			select {
-			case req := <-reqs:
-				if req == nil {
-					return
-				}
-				log.Printf("Received request: %s\n", req.Type)
-				ok := (req.Type == "auth-agent-req@openssh.com") ||
-					(req.Type == "pty-req") ||
-					(req.Type == "shell")
-				if req.WantReply {
-					req.Reply(ok, nil)
-				}
-				if req.Type == "shell" {
-					// terminal
-					term := terminal.NewTerminal(ch, "")
-					termWriter(term, settings.Banner)
-					termWriter(term, fmt.Sprintf("welcome, %s", user.Name))
-					if result != nil {
-						termWriter(term, result.Error())
-					}
-					termWriter(term, message)
-					termWriter(term, "goodbye\n")
-					log.Println("closing the connection")
-					chanCloser(ch, result != nil)
-				}
-			case <-limit:
-				// Forced timeout, close session
-				return
-			}
+	// window changes and the like may come while the certificate is issued
+	served := make(chan struct{})
+	go func() {
+		util.ServeSessionRequests(reqs)
+		close(served)
+	}()
+
+	if start.Shell {
+		// terminal
+		term := terminal.NewTerminal(ch, "")
+		// a banner showing the certificate waits for it
+		banner := settings.UserBanner(user)
+		if !util.BannerUsesCert(banner) {
+			termWriter(term, util.ExpandBanner(banner, user.Name, nil))
+		}
+		termWriter(term, fmt.Sprintf("welcome, %s", user.Name))
+		message, cert, _, result := iss.issue(requested, term)
+		if result != nil {
+			termWriter(term, result.Error())
+		} else if util.BannerUsesCert(banner) {
+			termWriter(term, util.ExpandBanner(banner, user.Name, cert))
+		}
+		termWriter(term, message)
+		if cert != nil {
+			termWriter(term, certDetails(cert))
 		}
+		if result != nil && settings.SupportURL != "" {
+			termWriter(term, fmt.Sprintf("For help, see %s", settings.SupportURL))
+		}
+		termWriter(term, "goodbye\n")
+		logInfo("disconnect", logFields{"user": user.Name, "remote_addr": sshConn.RemoteAddr().String()}, "closing the connection")
+		chanCloser(ch, result != nil)
+	} else {
+		logInfo("exec", logFields{"user": user.Name, "command": start.Command}, "exec command %q", start.Command)
+		runExec(ch, start.Command, caKeys, iss, requested)
+	}
+
+	// the client closes its side in reply, so that the connection is
+	// closed cleanly
+	select {
+	case <-served:
 	case <-limit:
-		// Forced timeout, close session
-		return
+	}
+}
+
+// Refuse the channels the client opens, until the connection is closed
+func rejectChannels(chans <-chan ssh.NewChannel, reason string) {
+	for newChan := range chans {
+		newChan.Reject(ssh.Prohibited, reason)
 	}
 }
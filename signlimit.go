@@ -0,0 +1,56 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// The longest a certificate will wait to be signed before the issuance
+// fails, so that a backlog cannot build up indefinitely
+const maxSigningWait = 10 * time.Second
+
+// The error when a signature would wait longer than maxSigningWait
+var errSigningQueueFull = errors.New("signing queue full, try again later")
+
+// Limits the rate of CA signing operations across all connections, to
+// smooth the CPU load of bursts of issuance with expensive (e.g. RSA) CA
+// keys. This is a GCRA, or virtual scheduling, limiter.
+type signLimiter struct {
+	mu  sync.Mutex
+	tat time.Time // theoretical arrival time of the next signature
+}
+
+var signingLimiter = &signLimiter{}
+
+// Wait until a signature may be made at rate per second, allowing bursts
+// of up to burst signatures. A rate of zero means no limit. Returns how
+// long the caller waited.
+func (l *signLimiter) Wait(rate float64, burst int) (time.Duration, error) {
+	if rate <= 0 {
+		return 0, nil
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	interval := time.Duration(float64(time.Second) / rate)
+
+	l.mu.Lock()
+	now := time.Now()
+	if l.tat.Before(now) {
+		l.tat = now
+	}
+	wait := l.tat.Add(-time.Duration(burst-1) * interval).Sub(now)
+	if wait < 0 {
+		wait = 0
+	}
+	if wait > maxSigningWait {
+		l.mu.Unlock()
+		return 0, errSigningQueueFull
+	}
+	l.tat = l.tat.Add(interval)
+	l.mu.Unlock()
+
+	time.Sleep(wait)
+	return wait, nil
+}
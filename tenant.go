@@ -0,0 +1,105 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/candlerb/sshtokenca/util"
+	"golang.org/x/crypto/ssh"
+	"net"
+	"strings"
+)
+
+// What the connections to a listener are served with: the settings in
+// force, which are those of a tenant if it has one, and the CA keys to
+// sign with
+type site struct {
+	live   *liveSettings
+	tenant string       // the tenant's name, or "" for the top level
+	caKeys []ssh.Signer // the first signs certificates
+}
+
+// The error for a connection to a tenant which a reload has removed
+var errTenantRemoved = errors.New("tenant removed")
+
+// Permissions extension naming the tenant a connection is for, absent
+// at the top level
+const tenantExtension = "tenant@sshtokenca"
+
+// Record the tenant a connection is for, if any
+func setTenant(perms *ssh.Permissions, tenant string) {
+	if perms == nil || tenant == "" {
+		return
+	}
+	if perms.Extensions == nil {
+		perms.Extensions = map[string]string{}
+	}
+	perms.Extensions[tenantExtension] = tenant
+}
+
+// Return the tenant a connection is for, or "" at the top level
+func connTenant(perms *ssh.Permissions) string {
+	if perms == nil {
+		return ""
+	}
+	return perms.Extensions[tenantExtension]
+}
+
+// Return the settings currently in force for the site, or nil if a
+// reload has removed its tenant
+func (st *site) Get() *util.Settings {
+	settings := st.live.Get()
+	if st.tenant == "" {
+		return settings
+	}
+	t, err := settings.TenantByName(st.tenant)
+	if err != nil {
+		return nil
+	}
+	return t.Settings()
+}
+
+// Refuse reloaded settings whose tenants are not among those loaded at
+// startup, with the same listen address and CA keys, since a listener is
+// opened and CA keys loaded for each tenant only at startup. A tenant may
+// be removed.
+func checkTenantsUnchanged(initial, settings *util.Settings) error {
+	for _, t := range settings.Tenants {
+		was, err := initial.TenantByName(t.Name)
+		if err != nil {
+			return fmt.Errorf("tenant %s cannot be added without a restart", t.Name)
+		}
+		if t.Listen != was.Listen {
+			return fmt.Errorf("tenant %s: listen cannot be changed without a restart", t.Name)
+		}
+		if strings.Join(t.CAKeys, "\x00") != strings.Join(was.CAKeys, "\x00") {
+			return fmt.Errorf("tenant %s: ca_keys cannot be changed without a restart", t.Name)
+		}
+	}
+	return nil
+}
+
+// Load the CA keys of each tenant, by name
+func loadTenantCAKeys(options Options, settings util.Settings) map[string][]ssh.Signer {
+	tenantKeys := map[string][]ssh.Signer{}
+	for _, t := range settings.Tenants {
+		tenantKeys[t.Name] = loadCAKeys(t.CAKeys, options, *t.Settings())
+	}
+	return tenantKeys
+}
+
+// Open a listener for each tenant, with the site it serves. If any
+// address cannot be bound, all are closed and an error returned.
+func openTenantListeners(live *liveSettings, tenantKeys map[string][]ssh.Signer) ([]net.Listener, []*site, error) {
+	var listeners []net.Listener
+	var sites []*site
+	for _, t := range live.Get().Tenants {
+		listener, err := net.Listen("tcp", t.Listen)
+		if err != nil {
+			closeListeners(listeners)
+			return nil, nil, err
+		}
+		listeners = append(listeners, listener)
+		sites = append(sites, &site{live: live, tenant: t.Name, caKeys: tenantKeys[t.Name]})
+	}
+	return listeners, sites, nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// How long the step of a user's last accepted TOTP code is remembered,
+// which is longer than any code is accepted for
+const totpStepLifetime = 2 * time.Minute
+
+// Remembers the time step of the last TOTP code accepted from each user,
+// by tenant and name, so that a code cannot be used twice, nor one older
+// than a code already used
+type totpTracker struct {
+	mu     sync.Mutex
+	last   map[string]totpUse
+	lastGC time.Time
+}
+
+type totpUse struct {
+	step uint64
+	at   time.Time
+}
+
+var usedTOTPSteps = &totpTracker{last: map[string]totpUse{}}
+
+// Record that the user name of tenant gave the code for step, reporting
+// false, and recording nothing, if a code for that step or a later one
+// has already been accepted from them
+func (t *totpTracker) Use(tenant, name string, step uint64) bool {
+	now := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.gc(now)
+	key := issueKey(tenant, name)
+	if last, ok := t.last[key]; ok && step <= last.step {
+		return false
+	}
+	t.last[key] = totpUse{step: step, at: now}
+	return true
+}
+
+// Drop the steps of codes which can no longer be accepted, at most once
+// per totpStepLifetime. Must be called with the lock held.
+func (t *totpTracker) gc(now time.Time) {
+	if now.Sub(t.lastGC) < totpStepLifetime {
+		return
+	}
+	for key, use := range t.last {
+		if now.Sub(use.at) >= totpStepLifetime {
+			delete(t.last, key)
+		}
+	}
+	t.lastGC = now
+}
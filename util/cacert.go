@@ -0,0 +1,109 @@
+package util
+
+import (
+	"bytes"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// A CA key with a certificate of its own, such as one issued by an
+// intermediate CA, whose validity limits the certificates it signs. It
+// signs as the plain key, and its PublicKey is the plain key, since
+// hosts trust the key itself.
+type CertifiedSigner struct {
+	ssh.Signer
+	Certificate *ssh.Certificate
+}
+
+// A signer whose public key is a certificate, as ssh.NewCertSigner makes,
+// presented as the plain key it certifies. OpenSSH refuses certificates
+// whose signature key is itself a certificate, since it has no chains.
+type plainKeySigner struct {
+	ssh.Signer
+	key ssh.PublicKey
+}
+
+func (s *plainKeySigner) PublicKey() ssh.PublicKey {
+	return s.key
+}
+
+// A plainKeySigner which can choose the signature algorithm, as an RSA
+// key can
+type plainKeyAlgorithmSigner struct {
+	plainKeySigner
+}
+
+func (s *plainKeyAlgorithmSigner) SignWithAlgorithm(rand io.Reader, data []byte, algorithm string) (*ssh.Signature, error) {
+	return s.Signer.(ssh.AlgorithmSigner).SignWithAlgorithm(rand, data, algorithm)
+}
+
+// Return the CA key with its certificate held apart, as a CertifiedSigner,
+// if its public key is a certificate, so that it signs as the plain key.
+// Otherwise key is returned as it is.
+func certifiedSigner(key ssh.Signer) ssh.Signer {
+	cert, ok := key.PublicKey().(*ssh.Certificate)
+	if !ok {
+		return key
+	}
+	plain := plainKeySigner{Signer: key, key: cert.Key}
+	if _, ok := key.(ssh.AlgorithmSigner); ok {
+		return &CertifiedSigner{Signer: &plainKeyAlgorithmSigner{plain}, Certificate: cert}
+	}
+	return &CertifiedSigner{Signer: &plain, Certificate: cert}
+}
+
+// Return the certificate of a CA key, if it has one
+func CACertificate(key ssh.Signer) (*ssh.Certificate, bool) {
+	if cs, ok := key.(*CertifiedSigner); ok {
+		return cs.Certificate, true
+	}
+	cert, ok := key.PublicKey().(*ssh.Certificate)
+	return cert, ok
+}
+
+// Load the certificate of the CA key loaded from path, from path-cert.pub
+// as ssh-keygen names it, if there is one, returning the key with its
+// certificate. Otherwise key is returned as it is.
+func LoadCACertificate(key ssh.Signer, path string) (ssh.Signer, error) {
+	certPath := path + "-cert.pub"
+	data, err := ioutil.ReadFile(certPath)
+	if os.IsNotExist(err) {
+		return key, nil
+	} else if err != nil {
+		return nil, err
+	}
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", certPath, err)
+	}
+	cert, ok := pub.(*ssh.Certificate)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a certificate", certPath)
+	}
+	if !bytes.Equal(cert.Key.Marshal(), key.PublicKey().Marshal()) {
+		return nil, fmt.Errorf("%s is not a certificate for the key in %s", certPath, path)
+	}
+	return &CertifiedSigner{Signer: key, Certificate: cert}, nil
+}
+
+// Check a CA key's certificate, if it has one, is valid at t, returning
+// when it expires, or the zero time if it has no certificate or never
+// expires
+func CheckCAValidity(key ssh.Signer, t time.Time) (time.Time, error) {
+	cert, ok := CACertificate(key)
+	if !ok || cert.ValidBefore == ssh.CertTimeInfinity {
+		return time.Time{}, nil
+	}
+	validAfter := time.Unix(int64(cert.ValidAfter), 0)
+	validBefore := time.Unix(int64(cert.ValidBefore), 0)
+	if t.Before(validAfter) {
+		return validBefore, fmt.Errorf("CA certificate %s is not valid until %s", cert.KeyId, validAfter.UTC().Format(time.RFC3339))
+	} else if !t.Before(validBefore) {
+		return validBefore, fmt.Errorf("CA certificate %s expired at %s", cert.KeyId, validBefore.UTC().Format(time.RFC3339))
+	}
+	return validBefore, nil
+}
@@ -0,0 +1,153 @@
+package util
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"golang.org/x/crypto/ssh"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+// Return a CA key and a certificate for it valid from validAfter to
+// validBefore, signed by another key
+func certifiedCAKey(t *testing.T, validAfter, validBefore time.Time) (ssh.Signer, *ssh.Certificate) {
+	keys := []ssh.Signer{}
+	for i := 0; i < 2; i++ {
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		key, err := ssh.NewSignerFromKey(priv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+	}
+	cert := &ssh.Certificate{
+		CertType:    ssh.UserCert,
+		Key:         keys[0].PublicKey(),
+		KeyId:       "intermediate",
+		ValidAfter:  uint64(validAfter.Unix()),
+		ValidBefore: uint64(validBefore.Unix()),
+	}
+	err := cert.SignCert(rand.Reader, keys[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keys[0], cert
+}
+
+func TestCACertificate(t *testing.T) {
+	now := time.Now()
+	key, cert := certifiedCAKey(t, now.Add(-time.Hour), now.Add(time.Hour))
+
+	dir, err := ioutil.TempDir("", "cacert")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := dir + "/ca"
+	loaded, err := LoadCACertificate(key, path)
+	if err != nil || loaded != key {
+		t.Errorf("key without a certificate file changed: %v", err)
+	}
+	err = ioutil.WriteFile(path+"-cert.pub", ssh.MarshalAuthorizedKey(cert), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded, err = LoadCACertificate(key, path)
+	if err != nil {
+		t.Fatalf("could not load CA certificate: %v", err)
+	}
+	if c, ok := CACertificate(loaded); !ok || c.KeyId != "intermediate" {
+		t.Errorf("CA certificate not found")
+	}
+	if _, ok := CACertificate(key); ok {
+		t.Errorf("plain key has a CA certificate")
+	}
+
+	expiry, err := CheckCAValidity(loaded, now)
+	if err != nil || expiry.Unix() != int64(cert.ValidBefore) {
+		t.Errorf("unexpected CA validity %v: %v", expiry, err)
+	}
+	_, err = CheckCAValidity(loaded, now.Add(2*time.Hour))
+	t.Logf("Error (expected): %v", err)
+	if err == nil {
+		t.Errorf("expired CA certificate passed")
+	}
+
+	// certificates are signed by, and checked against, the plain key
+	signer, err := NewCASigner(loaded, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := signTestCert(t, signer)
+	if string(signed.SignatureKey.Marshal()) != string(key.PublicKey().Marshal()) {
+		t.Errorf("certificate not signed by the plain CA key")
+	}
+	checker := &ssh.CertChecker{}
+	if err := checker.CheckCert("test", signed); err != nil {
+		t.Errorf("certificate signed by certified CA key does not check: %v", err)
+	}
+
+	other, _ := certifiedCAKey(t, now, now)
+	_, err = LoadCACertificate(other, path)
+	t.Logf("Error (expected): %v", err)
+	if err == nil {
+		t.Errorf("certificate for another key accepted")
+	}
+}
+
+func TestCAChain(t *testing.T) {
+	now := time.Now()
+	for _, name := range []string{"ed25519", "rsa"} {
+		root := testKeyMatrix(t)[name]
+		intermediate := testKeyMatrix(t)[name]
+		intermediateCert := &ssh.Certificate{
+			CertType:    ssh.UserCert,
+			Key:         intermediate.PublicKey(),
+			KeyId:       "intermediate",
+			ValidAfter:  uint64(now.Add(-time.Hour).Unix()),
+			ValidBefore: uint64(now.Add(time.Hour).Unix()),
+		}
+		err := intermediateCert.SignCert(rand.Reader, root)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// a key whose public key is its certificate, as an agent may hold
+		certKey, err := ssh.NewCertSigner(intermediateCert, intermediate)
+		if err != nil {
+			t.Fatal(err)
+		}
+		caKey, err := NewCASigner(certKey, "")
+		if err != nil {
+			t.Fatalf("%s: NewCASigner failed: %v", name, err)
+		}
+		if c, ok := CACertificate(caKey); !ok || c != intermediateCert {
+			t.Errorf("%s: intermediate certificate not kept with the CA key", name)
+		}
+
+		cert := signTestCert(t, caKey)
+		if _, isCert := cert.SignatureKey.(*ssh.Certificate); isCert {
+			t.Errorf("%s: signature key is a certificate", name)
+		}
+		if !bytes.Equal(cert.SignatureKey.Marshal(), intermediate.PublicKey().Marshal()) {
+			t.Errorf("%s: signature key is not the intermediate key", name)
+		}
+		checker := ssh.CertChecker{}
+		err = checker.CheckCert("test", cert)
+		if err != nil {
+			t.Errorf("%s: certificate did not verify with the intermediate key: %v", name, err)
+		}
+		err = checker.CheckCert("", intermediateCert)
+		if err != nil {
+			t.Errorf("%s: intermediate certificate did not verify with the root: %v", name, err)
+		}
+		if !bytes.Equal(intermediateCert.SignatureKey.Marshal(), root.PublicKey().Marshal()) {
+			t.Errorf("%s: intermediate certificate not signed by the root", name)
+		}
+	}
+}
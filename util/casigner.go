@@ -0,0 +1,105 @@
+package util
+
+import (
+	"crypto"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"io"
+)
+
+// Signature algorithms which may be used with an RSA CA key, and the
+// hash each uses
+var rsaSignatureAlgorithms = map[string]crypto.Hash{
+	ssh.SigAlgoRSA:        crypto.SHA1,
+	ssh.SigAlgoRSASHA2256: crypto.SHA256,
+	ssh.SigAlgoRSASHA2512: crypto.SHA512,
+}
+
+// The default for RSA CA keys, since OpenSSH 8.2 and later reject
+// ssh-rsa (SHA-1) signatures
+const defaultRSASignatureAlgorithm = ssh.SigAlgoRSASHA2512
+
+// A signer, such as an ssh-agent key, which can choose the hash but not
+// the algorithm name
+type optsSigner interface {
+	SignWithOpts(rand io.Reader, data []byte, opts crypto.SignerOpts) (*ssh.Signature, error)
+}
+
+// An ssh.Signer which always signs using a fixed algorithm
+type caSigner struct {
+	ssh.Signer
+	algorithm string
+}
+
+func (s *caSigner) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
+	switch key := s.Signer.(type) {
+	case ssh.AlgorithmSigner:
+		return key.SignWithAlgorithm(rand, data, s.algorithm)
+	case optsSigner:
+		return key.SignWithOpts(rand, data, rsaSignatureAlgorithms[s.algorithm])
+	}
+	return s.Signer.Sign(rand, data)
+}
+
+// Return a signer for the CA key which signs certificates with the given
+// signature algorithm. For RSA keys the algorithm may be ssh-rsa,
+// rsa-sha2-256 or rsa-sha2-512, defaulting to rsa-sha2-512. Other key
+// types only have one algorithm, so it must be empty or match the key.
+// A CertSigner is returned as it is, since it chooses the algorithm
+// itself. A key whose public key is a certificate signs as the plain
+// key it certifies.
+func NewCASigner(key ssh.Signer, algorithm string) (ssh.Signer, error) {
+	if _, ok := key.(CertSigner); ok {
+		return key, nil
+	}
+	key = certifiedSigner(key)
+	if cs, ok := key.(*CertifiedSigner); ok {
+		signer, err := NewCASigner(cs.Signer, algorithm)
+		if err != nil {
+			return nil, err
+		}
+		return &CertifiedSigner{Signer: signer, Certificate: cs.Certificate}, nil
+	}
+	keyType := key.PublicKey().Type()
+	if keyType != ssh.KeyAlgoRSA {
+		if algorithm != "" && algorithm != keyType {
+			return nil, fmt.Errorf("signature_algorithm %s cannot be used with a %s CA key", algorithm, keyType)
+		}
+		return key, nil
+	}
+
+	if algorithm == "" {
+		algorithm = defaultRSASignatureAlgorithm
+	}
+	if _, ok := rsaSignatureAlgorithms[algorithm]; !ok {
+		return nil, fmt.Errorf("signature_algorithm %s cannot be used with an RSA CA key", algorithm)
+	}
+	switch key.(type) {
+	case ssh.AlgorithmSigner, optsSigner:
+	default:
+		if algorithm != ssh.SigAlgoRSA {
+			return nil, fmt.Errorf("CA key does not support signature_algorithm %s", algorithm)
+		}
+	}
+	return &caSigner{Signer: key, algorithm: algorithm}, nil
+}
+
+// Sign cert with the CA key and signature algorithm, as NewCASigner
+// allows. Signing gives the certificate a fresh 32 byte nonce from
+// random, so none is ever reused. A CA which makes whole certificates,
+// such as Vault, replaces cert with the one it makes.
+func SignCert(cert *ssh.Certificate, caKey ssh.Signer, algorithm string, random io.Reader) error {
+	signer, err := NewCASigner(caKey, algorithm)
+	if err != nil {
+		return err
+	}
+	if certSigner, ok := signer.(CertSigner); ok {
+		signed, err := certSigner.SignCertificate(cert)
+		if err != nil {
+			return err
+		}
+		*cert = *signed
+		return nil
+	}
+	return cert.SignCert(random, signer)
+}
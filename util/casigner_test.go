@@ -0,0 +1,203 @@
+package util
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"golang.org/x/crypto/ssh"
+	"testing"
+)
+
+func signTestCert(t *testing.T, caKey ssh.Signer) *ssh.Certificate {
+	privKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubKey, err := ssh.NewPublicKey(&privKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := &ssh.Certificate{
+		CertType:        ssh.UserCert,
+		Key:             pubKey,
+		ValidPrincipals: []string{"test"},
+		ValidBefore:     ssh.CertTimeInfinity,
+	}
+	err = cert.SignCert(rand.Reader, caKey)
+	if err != nil {
+		t.Fatalf("could not sign certificate: %v", err)
+	}
+	return cert
+}
+
+func TestCASignerRSA(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ssh.NewSignerFromKey(rsaKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for algorithm, expected := range map[string]string{
+		"":                    ssh.SigAlgoRSASHA2512,
+		ssh.SigAlgoRSASHA2256: ssh.SigAlgoRSASHA2256,
+		ssh.SigAlgoRSA:        ssh.SigAlgoRSA,
+	} {
+		caKey, err := NewCASigner(key, algorithm)
+		if err != nil {
+			t.Fatalf("NewCASigner %q failed: %v", algorithm, err)
+		}
+		cert := signTestCert(t, caKey)
+		if cert.Signature.Format != expected {
+			t.Errorf("algorithm %q gave signature %s, expected %s", algorithm, cert.Signature.Format, expected)
+		}
+		checker := ssh.CertChecker{}
+		err = checker.CheckCert("test", cert)
+		if err != nil {
+			t.Errorf("certificate signed with %s did not verify: %v", cert.Signature.Format, err)
+		}
+	}
+}
+
+func TestCASignerIncompatible(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ssh.NewSignerFromKey(ecKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = NewCASigner(key, ssh.SigAlgoRSASHA2512)
+	t.Logf("Error (expected): %v", err)
+	if err == nil {
+		t.Errorf("rsa signature algorithm accepted for ecdsa key")
+	}
+	_, err = NewCASigner(key, "")
+	if err != nil {
+		t.Errorf("default signature algorithm failed for ecdsa key: %v", err)
+	}
+}
+
+// Generate a key of each type a CA or client may have
+func testKeyMatrix(t *testing.T) map[string]ssh.Signer {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := map[string]interface{}{
+		"rsa":     rsaKey,
+		"ed25519": edKey,
+	}
+	for name, curve := range map[string]elliptic.Curve{
+		"ecdsa-p256": elliptic.P256(),
+		"ecdsa-p384": elliptic.P384(),
+		"ecdsa-p521": elliptic.P521(),
+	} {
+		ecKey, err := ecdsa.GenerateKey(curve, rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys[name] = ecKey
+	}
+	signers := map[string]ssh.Signer{}
+	for name, key := range keys {
+		signer, err := ssh.NewSignerFromKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		signers[name] = signer
+	}
+	return signers
+}
+
+func TestCASignerKeyTypes(t *testing.T) {
+	keys := testKeyMatrix(t)
+	for caName, key := range keys {
+		caKey, err := NewCASigner(key, "")
+		if err != nil {
+			t.Fatalf("NewCASigner %s failed: %v", caName, err)
+		}
+		checker := ssh.CertChecker{}
+		for clientName, client := range keys {
+			cert := &ssh.Certificate{
+				CertType:        ssh.UserCert,
+				Key:             client.PublicKey(),
+				ValidPrincipals: []string{"test"},
+				ValidBefore:     ssh.CertTimeInfinity,
+			}
+			err = cert.SignCert(rand.Reader, caKey)
+			if err != nil {
+				t.Errorf("%s CA could not sign %s key: %v", caName, clientName, err)
+				continue
+			}
+			if caName == "rsa" && cert.Signature.Format != defaultRSASignatureAlgorithm {
+				t.Errorf("rsa CA signed %s key with %s", clientName, cert.Signature.Format)
+			}
+			if !bytes.Equal(cert.SignatureKey.Marshal(), key.PublicKey().Marshal()) {
+				t.Errorf("%s CA certificate for %s key has the wrong signature key", caName, clientName)
+			}
+			err = checker.CheckCert("test", cert)
+			if err != nil {
+				t.Errorf("%s CA certificate for %s key did not verify: %v", caName, clientName, err)
+			}
+		}
+	}
+}
+
+func TestCertNonces(t *testing.T) {
+	settings := settingsLoad(t)
+	keys := testKeyMatrix(t)
+	for name, algorithm := range map[string]string{"ed25519": "", "rsa": ssh.SigAlgoRSASHA2256} {
+		caKey := keys[name]
+		checker := &ssh.CertChecker{
+			IsUserAuthority: func(auth ssh.PublicKey) bool {
+				return bytes.Equal(auth.Marshal(), caKey.PublicKey().Marshal())
+			},
+		}
+		nonces := map[string]bool{}
+		var lastSerial uint64
+		for i := 0; i < 10; i++ {
+			// otherwise identical certificates, as the server builds
+			cert := &ssh.Certificate{
+				CertType:        ssh.UserCert,
+				Key:             keys["ecdsa-p256"].PublicKey(),
+				Serial:          NextSerial(),
+				KeyId:           "same",
+				ValidPrincipals: []string{"test"},
+				ValidBefore:     ssh.CertTimeInfinity,
+			}
+			err := SignCert(cert, caKey, algorithm, settings.Random())
+			if err != nil {
+				t.Fatalf("%s: could not sign certificate: %v", name, err)
+			}
+			if len(cert.Nonce) != 32 {
+				t.Errorf("%s: nonce is %d bytes", name, len(cert.Nonce))
+			}
+			if nonces[string(cert.Nonce)] {
+				t.Errorf("%s: nonce reused for otherwise identical certificates", name)
+			}
+			nonces[string(cert.Nonce)] = true
+			if cert.Serial <= lastSerial || cert.Serial != LastSerial() {
+				t.Errorf("%s: serial %d follows %d, last issued %d", name, cert.Serial, lastSerial, LastSerial())
+			}
+			lastSerial = cert.Serial
+			if err := checker.CheckCert("test", cert); err != nil {
+				t.Errorf("%s: certificate does not check: %v", name, err)
+			}
+		}
+	}
+	err := SignCert(&ssh.Certificate{Key: keys["ed25519"].PublicKey()}, keys["ed25519"], ssh.SigAlgoRSA, settings.Random())
+	t.Logf("Error (expected): %v", err)
+	if err == nil {
+		t.Errorf("certificate signed with a signature algorithm unsuited to the CA key")
+	}
+}
@@ -0,0 +1,170 @@
+package util
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	oidc "github.com/coreos/go-oidc"
+	"golang.org/x/oauth2"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// The grant type for polling the token endpoint in the device flow
+const deviceCodeGrantType = "urn:ietf:params:oauth:grant-type:device_code"
+
+// The unit of the polling interval given by the provider, which tests
+// shorten
+var devicePollUnit = time.Second
+
+// A device authorization (RFC 8628), showing the user where to approve
+// the login, which is then polled for by DeviceToIDToken
+type DeviceAuth struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete"`
+	ExpiresIn               int    `json:"expires_in"`
+	Interval                int    `json:"interval"`
+
+	// the name of VerificationURI in the draft standard, used by Google
+	VerificationURL string `json:"verification_url"`
+}
+
+// A token endpoint response, successful or not
+type deviceTokenResponse struct {
+	AccessToken      string `json:"access_token"`
+	TokenType        string `json:"token_type"`
+	RefreshToken     string `json:"refresh_token"`
+	ExpiresIn        int    `json:"expires_in"`
+	IDToken          string `json:"id_token"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+// Start a device flow login, returning the code the user must enter at
+// the verification URL
+func (app *OpenIDC) StartDeviceAuth(ctx context.Context) (*DeviceAuth, error) {
+	if app.deviceAuthURL == "" {
+		return nil, errors.New("provider has no device_authorization_endpoint")
+	}
+	form := url.Values{
+		"client_id": {app.ClientID},
+		"scope":     {strings.Join(app.Scopes, " ")},
+	}
+	da := &DeviceAuth{}
+	status, err := app.postForm(ctx, app.deviceAuthURL, form, da)
+	if err != nil {
+		return nil, fmt.Errorf("device authorization request failed: %s", err)
+	} else if status != http.StatusOK || da.DeviceCode == "" {
+		return nil, fmt.Errorf("device authorization request failed: status %d", status)
+	}
+	if da.VerificationURI == "" {
+		da.VerificationURI = da.VerificationURL
+	}
+	if da.VerificationURI == "" {
+		return nil, errors.New("device authorization response has no verification_uri")
+	}
+	return da, nil
+}
+
+// Poll the token endpoint at the interval the provider asks for until the
+// user approves the device login, it is refused, or it expires, returning
+// the verified ID token and the OAuth2 token
+func (app *OpenIDC) DeviceToIDToken(ctx context.Context, da *DeviceAuth) (*oidc.IDToken, *oauth2.Token, error) {
+	interval := time.Duration(da.Interval) * devicePollUnit
+	if interval <= 0 {
+		interval = 5 * devicePollUnit
+	}
+	expires := time.Now().Add(time.Duration(da.ExpiresIn) * devicePollUnit)
+	form := url.Values{
+		"grant_type":  {deviceCodeGrantType},
+		"device_code": {da.DeviceCode},
+		"client_id":   {app.ClientID},
+	}
+	if app.ClientSecret != "" {
+		form.Set("client_secret", app.ClientSecret)
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		case <-time.After(interval):
+		}
+		if da.ExpiresIn > 0 && time.Now().After(expires) {
+			return nil, nil, errors.New("device code expired before the login was approved")
+		}
+
+		resp := &deviceTokenResponse{}
+		status, err := app.postForm(ctx, app.oauth2.Endpoint.TokenURL, form, resp)
+		if err != nil {
+			return nil, nil, fmt.Errorf("device token request failed: %s", err)
+		}
+		switch resp.Error {
+		case "":
+			if status != http.StatusOK {
+				return nil, nil, fmt.Errorf("device token request failed: status %d", status)
+			}
+		case "authorization_pending":
+			continue
+		case "slow_down":
+			interval += 5 * devicePollUnit
+			continue
+		case "access_denied":
+			return nil, nil, errors.New("device login was denied")
+		case "expired_token":
+			return nil, nil, errors.New("device code expired before the login was approved")
+		default:
+			return nil, nil, fmt.Errorf("device token request failed: %s %s", resp.Error, resp.ErrorDescription)
+		}
+
+		if resp.IDToken == "" {
+			return nil, nil, errors.New("device token response has no id_token")
+		}
+		idToken, err := app.verifier.Verify(ctx, resp.IDToken)
+		if err != nil {
+			return nil, nil, err
+		}
+		token := &oauth2.Token{
+			AccessToken:  resp.AccessToken,
+			TokenType:    resp.TokenType,
+			RefreshToken: resp.RefreshToken,
+		}
+		if resp.ExpiresIn > 0 {
+			token.Expiry = time.Now().Add(time.Duration(resp.ExpiresIn) * time.Second)
+		}
+		return idToken, token, nil
+	}
+}
+
+// Post a form to the provider, decoding the json response into v, which
+// is done for error responses too
+func (app *OpenIDC) postForm(ctx context.Context, endpoint string, form url.Values, v interface{}) (int, error) {
+	req, err := http.NewRequest("POST", endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	client := &http.Client{Timeout: app.DiscoveryTimeout}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return resp.StatusCode, err
+	}
+	err = json.Unmarshal(body, v)
+	if err != nil {
+		return resp.StatusCode, fmt.Errorf("status %d: %s", resp.StatusCode, err)
+	}
+	return resp.StatusCode, nil
+}
@@ -0,0 +1,92 @@
+package util
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A provider with a device authorization endpoint whose token endpoint
+// gives each of responses in turn
+func deviceProvider(t *testing.T, responses []string) *httptest.Server {
+	var server *httptest.Server
+	polls := 0
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/device":
+			if r.FormValue("client_id") != "XXXXXXXX" {
+				t.Errorf("device request without client_id")
+			}
+			fmt.Fprint(w, `{"device_code":"dc","user_code":"ABCD-EFGH","verification_url":"https://idp.example.com/device","expires_in":60,"interval":1}`)
+		case "/token":
+			if r.FormValue("grant_type") != deviceCodeGrantType || r.FormValue("device_code") != "dc" {
+				t.Errorf("unexpected token request %v", r.Form)
+			}
+			if polls >= len(responses) {
+				t.Errorf("too many polls")
+				return
+			}
+			if strings.Contains(responses[polls], "error") {
+				w.WriteHeader(http.StatusBadRequest)
+			}
+			fmt.Fprint(w, responses[polls])
+			polls++
+		default:
+			fmt.Fprintf(w, `{"issuer":%q,"authorization_endpoint":"%[1]s/auth","token_endpoint":"%[1]s/token","jwks_uri":"%[1]s/keys","device_authorization_endpoint":"%[1]s/device"}`, server.URL)
+		}
+	}))
+	return server
+}
+
+func TestDeviceFlow(t *testing.T) {
+	defer func(d time.Duration) { devicePollUnit = d }(devicePollUnit)
+	devicePollUnit = time.Millisecond
+
+	server := deviceProvider(t, []string{
+		`{"error":"authorization_pending"}`,
+		`{"error":"slow_down"}`,
+		`{"access_token":"at","token_type":"Bearer"}`,
+	})
+	defer server.Close()
+	app := &OpenIDC{Issuer: server.URL, ClientID: "XXXXXXXX", DeviceFlow: true}
+	err := app.Init(context.Background())
+	if err != nil {
+		t.Fatalf("discovery failed: %v", err)
+	}
+	da, err := app.StartDeviceAuth(context.Background())
+	if err != nil {
+		t.Fatalf("device authorization failed: %v", err)
+	}
+	if da.UserCode != "ABCD-EFGH" || da.VerificationURI != "https://idp.example.com/device" {
+		t.Errorf("unexpected device authorization %+v", da)
+	}
+	_, _, err = app.DeviceToIDToken(context.Background(), da)
+	t.Logf("Error (expected): %v", err)
+	if err == nil || !strings.Contains(err.Error(), "no id_token") {
+		t.Errorf("token without id_token accepted")
+	}
+
+	server = deviceProvider(t, []string{`{"error":"authorization_pending"}`, `{"error":"access_denied"}`})
+	defer server.Close()
+	app = &OpenIDC{Issuer: server.URL, ClientID: "XXXXXXXX", DeviceFlow: true}
+	err = app.Init(context.Background())
+	if err != nil {
+		t.Fatalf("discovery failed: %v", err)
+	}
+	_, _, err = app.DeviceToIDToken(context.Background(), &DeviceAuth{DeviceCode: "dc", Interval: 1})
+	t.Logf("Error (expected): %v", err)
+	if err == nil || !strings.Contains(err.Error(), "denied") {
+		t.Errorf("denied device login did not fail as expected")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, _, err = app.DeviceToIDToken(ctx, &DeviceAuth{DeviceCode: "dc", Interval: 1})
+	if err != context.Canceled {
+		t.Errorf("polling did not stop when cancelled: %v", err)
+	}
+}
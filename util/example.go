@@ -0,0 +1,207 @@
+package util
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// The description and a placeholder value of a setting, for the example
+// settings file. Settings which are not required are commented out.
+type exampleSetting struct {
+	description string
+	value       string
+	required    bool
+}
+
+// Example settings by yaml key, with nested settings given as
+// "parent.key". TestExampleSettings checks there is an entry for every
+// field of Settings, UserPrincipals, HostPrincipals and OpenIDC.
+var exampleSettings = map[string]exampleSetting{
+	"validity":            {"certificate validity, from 1m to 24h", "3h", true},
+	"validity_rounding":   {"round each certificate's expiry down to a multiple of this period", "15m", false},
+	"valid_after_skew":    {"how long before issue certificates become valid, for fast client clocks; by default 30s, 0s for none, at most 10m", "30s", false},
+	"host_validity":       {"host certificate validity, by default 720h", "2160h", false},
+	"agent_lifetime":      {"how long the client's agent keeps the certificate, at most validity", "30m", false},
+	"agent_confirm":       {"ask the client's agent to confirm each use of the certificate", "true", false},
+	"organisation":        {"organisation name, used in the certificate key id", "acmeinc", true},
+	"banner":              {"greeting shown to connecting users; %u, %s and %e are the username, certificate serial and expiry", "|\n    acmeinc ssh user certificate service", true},
+	"banner_file":         {"file holding the greeting, relative to this file, in place of banner", "/etc/sshtokenca/banner.txt", false},
+	"support_url":         {"shown to users when a certificate cannot be issued", "https://wiki.example.com/ssh-ca", false},
+	"maintenance_message": {"shown to users in place of a certificate in maintenance mode, toggled by SIGUSR1", "The CA is down for maintenance until 14:00 UTC", false},
+	"ca_host":             {"host, or host:port, users connect to, for the ssh command shown to those who have not forwarded an agent", "ca.example.com:2222", false},
+	"audit_log":           {"file to which a json record of each certificate issued is appended", "/var/log/sshtokenca/audit.log", false},
+	"database":            {"sqlite file in which each certificate issued is recorded; needs -tags sqlite", "/var/lib/sshtokenca/issued.db", false},
+	"revoked_file":        {"file recording the serials and key ids revoked with --revokeSerial and --revokeKeyID", "/var/lib/sshtokenca/revoked.yaml", false},
+	"krl_file":            {"OpenSSH KRL of the revoked certificates, for sshd's RevokedKeys", "/var/lib/sshtokenca/revoked.krl", false},
+	"random_source":       {"\"system\", or the path of a character device to read randomness from", "system", false},
+	"signature_algorithm": {"algorithm for signing with an RSA CA key: rsa-sha2-512, rsa-sha2-256 or ssh-rsa",
+		"rsa-sha2-512", false},
+	"signing_rate":   {"most certificates signed per second", "5", false},
+	"signing_burst":  {"certificates which may be signed at once under signing_rate", "10", false},
+	"ca_load_policy": {"\"all\" CA keys must load at startup, or \"any\" besides the first, signing, key may", "all", false},
+	"min_rsa_bits":   {"fewest bits allowed in an RSA server or CA key, by default 2048; DSA keys are always refused", "3072", false},
+	"ca_names": {"names for CA keys given with -c, by SHA256 fingerprint, for users' ca",
+		"{old: \"SHA256:...\", new: \"SHA256:...\"}", false},
+	"ca_expiry_warning": {"warn at startup if a CA key's certificate expires within this period, by default 168h", "168h", false},
+	"max_attempts":      {"authentication failures from an address before it is refused for attempt_window", "20", false},
+	"attempt_window":    {"period over which max_attempts is counted", "10m", false},
+	"max_concurrent":    {"most connections serviced at once", "100", false},
+	"session_timeout": {"how long a connection may last, including any oidc or TOTP prompts",
+		"2m", false},
+	"oidc_timeout": {"how long the oidc token exchange and verification may take, by default 30s",
+		"30s", false},
+	"reuse_remaining": {"reuse a certificate already in the agent with at least this long left, rather than issue another",
+		"30m", false},
+	"issue_cooldown": {"least time between the certificates signed for a user",
+		"1m", false},
+	"identify_unknown": {"tell clients whose key is not registered the key or oidc subject to give an administrator",
+		"true", false},
+	"agent_timeout": {"how long the client's forwarded agent may take to respond, by default 10s",
+		"10s", false},
+	"listen_address":   {"ip address to listen on, unless -i or --listen is given; by default 0.0.0.0", "0.0.0.0", false},
+	"listen_port":      {"port to listen on, unless -p or --listen is given; by default 2222", "2222", false},
+	"proxy_protocol":   {"require a PROXY protocol header on each connection", "true", false},
+	"allowed_networks": {"networks from which clients may connect", "[10.0.0.0/8, \"2001:db8::/32\"]", false},
+	"denied_networks":  {"networks from which clients may not connect", "[10.99.0.0/16]", false},
+	"allowed_client_versions": {"regular expressions, one of which the client's ssh version string must match",
+		"\n    - '^SSH-2\\.0-OpenSSH_(8\\.[89]|9\\.)'", false},
+	"trusted_user_ca_keys": {"CA keys whose user certificates are accepted in place of a user's key", "\n    - ssh-ed25519 AAAA... ca@example.com", false},
+	"extensions": {"certificate extensions",
+		"\n    permit-agent-forwarding: \"\"\n    permit-port-forwarding: \"\"\n    permit-pty: \"\"", true},
+	"forbid_shared_keys":       {"refuse to start if a public key is listed for more than one user", "true", false},
+	"accepted_key_types":       {"client key types which may be used, with shell-style wildcards", "[ssh-ed25519, \"ecdsa-sha2-*\", \"sk-*\"]", false},
+	"allow_wildcard_principal": {"allow principals containing wildcards", "true", false},
+	"default_principals":       {"principals added to every user's own, unless they set no_default_principals", "[staff]", false},
+	"user_principals":          {"users, each with a public key and/or oidc subject, and their principals", "", true},
+	"users_files":              {"further files of user_principals, relative to this file, merged with those here", "[/etc/sshtokenca/users.d/ops.yaml]", false},
+	"host_principals":          {"hosts, each with its host public key and hostnames, whose host key may be certified", "", false},
+	"group_principals": {"principals allowed by each oidc group, with oidc groups_claim",
+		"\n    admins: [web, database, root]\n    developers: [web]", false},
+	"oidc":    {"OpenID Connect provider, for users with an oidc_subject", "", false},
+	"tenants": {"further organisations served by this process, each on its own listen address", "", false},
+
+	"user_principals.name":           {"login name", "jane", true},
+	"user_principals.authorized_key": {"public key", "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIDV258rTR192bEbliZMYxjqVNWYxoKQkh67ds1vZcg1I jane@example.com", true},
+	"user_principals.fingerprint":    {"SHA256 fingerprint, which must match authorized_key", "SHA256:...", false},
+	"user_principals.oidc_subject":   {"subject of the user's oidc ID token", "1234567890987654321", false},
+	"user_principals.principals":     {"principals in the user's certificates", "[web, database]", true},
+	"user_principals.principal_patterns": {"shell-style patterns of further principals the user may request",
+		"[\"web-*.example.com\"]", false},
+	"user_principals.no_default_principals": {"leave out the global default_principals for this user", "true", false},
+	"user_principals.cert_type":             {"user, the default, or host to issue host certificates", "host", false},
+	"user_principals.ca":                    {"name in ca_names of the CA key signing this user's certificates, by default the first", "new", false},
+	"user_principals.agent_lifetime":        {"overrides agent_lifetime for this user", "10m", false},
+	"user_principals.agent_confirm":         {"overrides agent_confirm for this user", "true", false},
+	"user_principals.extensions": {"replaces the global extensions for this user; {} for none",
+		"{}", false},
+	"user_principals.enabled": {"false to stop issuing certificates to this user, keeping their record",
+		"false", false},
+	"user_principals.expires": {"RFC3339 time after which no certificates are issued to this user",
+		"2030-12-31T23:59:59Z", false},
+	"user_principals.message": {"shown to this user in place of the banner, with the same placeholders",
+		"\"%u, see https://wiki.example.com/web-team/ssh\"", false},
+	"user_principals.totp_secret": {"base32 TOTP secret, to require a code as well as the key", "JBSWY3DPEHPK3PXP", false},
+
+	"host_principals.name":           {"login name the host connects with", "web1", true},
+	"host_principals.authorized_key": {"host public key", "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIHb/CpqApTwkHpDkgESFWa0oF/k38g5ZeO4dCFSh8tDh root@web1.example.com", true},
+	"host_principals.principals":     {"hostnames in the host's certificates", "[web1.example.com, web1]", true},
+
+	"tenants.name":          {"name of the tenant", "globex", true},
+	"tenants.listen":        {"address and port on which the tenant's users connect", "0.0.0.0:2223", true},
+	"tenants.settings_file": {"the tenant's settings file, relative to this file, with its own users and banner", "tenants/globex.yaml", true},
+	"tenants.ca_keys":       {"the tenant's CA private keys, given as -c would be; the first is used for signing", "[/etc/sshtokenca/globex_ca]", true},
+
+	"oidc.issuer":             {"provider issuer URL", "https://accounts.google.com", true},
+	"oidc.client_id":          {"OAuth client id", "XXXXXXXX", true},
+	"oidc.client_secret":      {"OAuth client secret", "XXXXXXXX", true},
+	"oidc.redirect_url":       {"redirect URL, by default urn:ietf:wg:oauth:2.0:oob", "http://localhost:8080/", false},
+	"oidc.scopes":             {"scopes to request, by default openid", "[openid, email]", false},
+	"oidc.groups_claim":       {"ID token claim listing the user's groups, for group_principals", "groups", false},
+	"oidc.device_flow":        {"log in with the device flow instead of pasting an auth code", "true", false},
+	"oidc.userinfo_claim":     {"userinfo claim which may match oidc_subject in place of the ID token subject", "employee_id", false},
+	"oidc.userinfo_grace":     {"how long a userinfo claim may be used if the endpoint fails, at most 15m; by default not at all", "5m", false},
+	"oidc.username_claim":     {"claim giving the username of users with no user_principals entry", "email", false},
+	"oidc.allowed_domains":    {"email domains which username_claim may have", "[example.com]", false},
+	"oidc.allowed_usernames":  {"usernames which username_claim may give", "[jane, sam]", false},
+	"oidc.default_principals": {"principals of users given by username_claim; %u is the username", "[\"%u\", web]", false},
+	"oidc.discovery_timeout":  {"timeout of each request to the provider, by default 10s", "10s", false},
+	"oidc.discovery_attempts": {"times provider discovery is tried, with backoff, by default 5", "5", false},
+	"oidc.refresh_tokens":     {"keep users' refresh tokens to log them in again with the key they offered", "true", false},
+	"oidc.refresh_token_dir":  {"directory holding the encrypted refresh tokens", "/var/lib/sshtokenca/refresh", false},
+	"oidc.refresh_token_key":  {"secret, at least 16 characters, from which the refresh token encryption key is derived", "${REFRESH_TOKEN_KEY}", false},
+}
+
+// Return an example settings file, with a description and placeholder
+// value for every setting
+func ExampleSettings() string {
+	var b strings.Builder
+	b.WriteString("# sshtokenca example settings file\n")
+	writeExample(&b, reflect.TypeOf(Settings{}), "", "")
+	return b.String()
+}
+
+// Write the settings for the fields of struct type t, whose yaml keys
+// are prefixed by prefix in exampleSettings, indented by indent
+func writeExample(b *strings.Builder, t reflect.Type, prefix string, indent string) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		key := strings.Split(f.Tag.Get("yaml"), ",")[0]
+		if key == "" {
+			continue
+		}
+		ex := exampleSettings[prefix+key]
+		comment := indent
+		if !ex.required {
+			comment = indent + "# "
+		}
+
+		// blank lines between settings, and before those at the top level
+		if indent == "" || i > 0 {
+			b.WriteString("\n")
+		}
+		fmt.Fprintf(b, "%s# %s\n", indent, ex.description)
+		ft := f.Type
+		if ft.Kind() == reflect.Ptr && ft.Elem().Kind() == reflect.Struct {
+			// a nested block, e.g. oidc
+			fmt.Fprintf(b, "%s%s:\n", comment, key)
+			var nested strings.Builder
+			writeExample(&nested, ft.Elem(), key+".", "    ")
+			writeLines(b, comment, nested.String(), false)
+		} else if ft.Kind() == reflect.Slice && ft.Elem().Kind() == reflect.Ptr {
+			// a list of blocks, e.g. user_principals
+			fmt.Fprintf(b, "%s%s:\n%s    -\n", comment, key, comment)
+			var nested strings.Builder
+			writeExample(&nested, ft.Elem().Elem(), key+".", "        ")
+			writeLines(b, comment, nested.String(), false)
+		} else {
+			value := strings.Replace(ex.value, "\n", "\n"+indent, -1)
+			if strings.HasPrefix(value, "\n") {
+				fmt.Fprintf(b, "%s%s:", comment, key)
+			} else {
+				fmt.Fprintf(b, "%s%s: ", comment, key)
+			}
+			writeLines(b, comment, value+"\n", true)
+		}
+	}
+}
+
+// Write text, commenting out its lines if comment is a comment. If
+// continued, the first line continues one already commented out.
+func writeLines(b *strings.Builder, comment string, text string, continued bool) {
+	if !strings.HasSuffix(strings.TrimRight(comment, " "), "#") {
+		b.WriteString(text)
+		return
+	}
+	lines := strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+	for i, line := range lines {
+		if i == 0 && continued {
+			// already commented
+		} else if line == "" {
+			line = "#"
+		} else {
+			line = "# " + line
+		}
+		b.WriteString(line + "\n")
+	}
+}
@@ -0,0 +1,47 @@
+package util
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Check every setting has an example, so that the example settings file
+// is kept up to date as settings are added
+func TestExampleSettings(t *testing.T) {
+	types := map[string]reflect.Type{
+		"":                 reflect.TypeOf(Settings{}),
+		"user_principals.": reflect.TypeOf(UserPrincipals{}),
+		"host_principals.": reflect.TypeOf(HostPrincipals{}),
+		"oidc.":            reflect.TypeOf(OpenIDC{}),
+		"tenants.":         reflect.TypeOf(Tenant{}),
+	}
+	for prefix, typ := range types {
+		for i := 0; i < typ.NumField(); i++ {
+			key := strings.Split(typ.Field(i).Tag.Get("yaml"), ",")[0]
+			if key == "" {
+				continue
+			}
+			if _, ok := exampleSettings[prefix+key]; !ok {
+				t.Errorf("no example for setting %s%s", prefix, key)
+			}
+		}
+	}
+
+	f, err := ioutil.TempFile("", "example*.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	_, err = f.WriteString(ExampleSettings())
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = SettingsLoad(f.Name())
+	if err != nil {
+		t.Errorf("example settings do not load: %v\n%s", err, ExampleSettings())
+	}
+}
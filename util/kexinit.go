@@ -0,0 +1,209 @@
+package util
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+)
+
+// SSH_MSG_KEXINIT, from RFC 4253
+const msgKexInit = 20
+
+// The most of a connection watched for its KEXINIT before giving up
+const maxKexInitWatch = 64 * 1024
+
+// Ciphers which authenticate their own packets, so use no MAC
+var aeadCiphers = map[string]bool{
+	"aes128-gcm@openssh.com":        true,
+	"aes256-gcm@openssh.com":        true,
+	"chacha20-poly1305@openssh.com": true,
+}
+
+// The algorithms negotiated by the first key exchange of an ssh connection
+type KexAlgorithms struct {
+	Kex                string
+	HostKey            string
+	CipherClientServer string
+	CipherServerClient string
+	MACClientServer    string
+	MACServerClient    string
+}
+
+// Return the cipher, or the ciphers client to server and server to
+// client if they differ
+func (a KexAlgorithms) Cipher() string {
+	return bothWays(a.CipherClientServer, a.CipherServerClient)
+}
+
+// Return the MAC, or the MACs client to server and server to client if
+// they differ. An AEAD cipher's MAC is "implicit".
+func (a KexAlgorithms) MAC() string {
+	return bothWays(a.MACClientServer, a.MACServerClient)
+}
+
+func bothWays(clientServer, serverClient string) string {
+	if clientServer == serverClient {
+		return clientServer
+	}
+	return clientServer + "/" + serverClient
+}
+
+// The server side of an ssh connection, which watches the KEXINIT
+// message each side sends as it passes, before anything is encrypted, to
+// learn the algorithms negotiated, which x/crypto/ssh does not report.
+// Only the first key exchange is seen.
+type KexConn struct {
+	net.Conn
+	mu      sync.Mutex
+	read    kexInitWatcher // from the client
+	written kexInitWatcher // from the server
+}
+
+// Watch the first key exchange of the server side of an ssh connection
+func NewKexConn(conn net.Conn) *KexConn {
+	return &KexConn{Conn: conn}
+}
+
+func (c *KexConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.mu.Lock()
+	c.read.watch(b[:n])
+	c.mu.Unlock()
+	return n, err
+}
+
+func (c *KexConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	c.written.watch(b)
+	c.mu.Unlock()
+	return c.Conn.Write(b)
+}
+
+// Return the algorithms negotiated by the first key exchange, if both
+// sides' KEXINIT messages were seen and they have algorithms in common
+func (c *KexConn) Algorithms() (KexAlgorithms, bool) {
+	c.mu.Lock()
+	client, server := c.read.lists, c.written.lists
+	c.mu.Unlock()
+	if client == nil || server == nil {
+		return KexAlgorithms{}, false
+	}
+	a := KexAlgorithms{
+		Kex:                agreed(client[0], server[0]),
+		HostKey:            agreed(client[1], server[1]),
+		CipherClientServer: agreed(client[2], server[2]),
+		CipherServerClient: agreed(client[3], server[3]),
+		MACClientServer:    agreed(client[4], server[4]),
+		MACServerClient:    agreed(client[5], server[5]),
+	}
+	if aeadCiphers[a.CipherClientServer] {
+		a.MACClientServer = "implicit"
+	}
+	if aeadCiphers[a.CipherServerClient] {
+		a.MACServerClient = "implicit"
+	}
+	if a.Kex == "" || a.HostKey == "" || a.CipherClientServer == "" || a.CipherServerClient == "" ||
+		a.MACClientServer == "" || a.MACServerClient == "" {
+		return KexAlgorithms{}, false
+	}
+	return a, true
+}
+
+// The first of the client's algorithms which the server also offers, as
+// RFC 4253 negotiates them, or "" if there is none
+func agreed(client, server []string) string {
+	for _, c := range client {
+		for _, s := range server {
+			if c == s {
+				return c
+			}
+		}
+	}
+	return ""
+}
+
+// Collects one direction of a connection until its KEXINIT has been seen
+type kexInitWatcher struct {
+	buf   []byte
+	done  bool
+	lists [][]string // the KEXINIT's algorithm name-lists, once seen
+}
+
+func (w *kexInitWatcher) watch(b []byte) {
+	if w.done {
+		return
+	}
+	w.buf = append(w.buf, b...)
+	payload, err := kexInitPayload(w.buf)
+	if err == nil && payload == nil && len(w.buf) < maxKexInitWatch {
+		// wait for more
+		return
+	}
+	if err == nil && payload != nil {
+		w.lists, _ = kexInitLists(payload)
+	}
+	w.done = true
+	w.buf = nil
+}
+
+// Return the payload of the KEXINIT packet which follows the version
+// line in buf, or nil if buf does not yet hold all of it
+func kexInitPayload(buf []byte) ([]byte, error) {
+	// skip any lines before the version line, as a server may send
+	for {
+		i := bytes.IndexByte(buf, '\n')
+		if i < 0 {
+			return nil, nil
+		}
+		line := buf[:i]
+		buf = buf[i+1:]
+		if bytes.HasPrefix(line, []byte("SSH-")) {
+			break
+		}
+	}
+	// the first binary packet, unencrypted and without a MAC
+	if len(buf) < 5 {
+		return nil, nil
+	}
+	length := binary.BigEndian.Uint32(buf)
+	if length < 5 || length > maxKexInitWatch {
+		return nil, errors.New("bad packet length")
+	}
+	if uint32(len(buf)-4) < length {
+		return nil, nil
+	}
+	padding := uint32(buf[4])
+	if padding+1 > length {
+		return nil, errors.New("bad padding length")
+	}
+	payload := buf[5 : 4+length-padding]
+	if len(payload) == 0 || payload[0] != msgKexInit {
+		return nil, errors.New("first packet is not KEXINIT")
+	}
+	return payload, nil
+}
+
+// Return the algorithm name-lists of a KEXINIT payload: kex, host key,
+// then ciphers and MACs client to server and server to client
+func kexInitLists(payload []byte) ([][]string, error) {
+	if len(payload) < 17 {
+		return nil, errors.New("short KEXINIT")
+	}
+	buf := payload[17:] // message number and cookie
+	var lists [][]string
+	for i := 0; i < 6; i++ {
+		if len(buf) < 4 {
+			return nil, errors.New("short KEXINIT")
+		}
+		n := binary.BigEndian.Uint32(buf)
+		if uint32(len(buf)-4) < n {
+			return nil, errors.New("short KEXINIT")
+		}
+		lists = append(lists, strings.Split(string(buf[4:4+n]), ","))
+		buf = buf[4+n:]
+	}
+	return lists, nil
+}
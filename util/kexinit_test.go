@@ -0,0 +1,110 @@
+package util
+
+import (
+	"golang.org/x/crypto/ssh"
+	"net"
+	"testing"
+)
+
+// Make an ssh connection over loopback, with the client offering the given
+// ciphers and MACs, returning the server side's KexConn once the
+// handshake is done
+func kexConnect(t *testing.T, ciphers, macs []string) *KexConn {
+	hostKey := testKeyMatrix(t)["ed25519"]
+	serverConfig := &ssh.ServerConfig{NoClientAuth: true}
+	serverConfig.AddHostKey(hostKey)
+	clientConfig := &ssh.ClientConfig{
+		User:            "test",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Config: ssh.Config{
+			KeyExchanges: []string{"curve25519-sha256@libssh.org", "ecdh-sha2-nistp256"},
+			Ciphers:      ciphers,
+			MACs:         macs,
+		},
+	}
+
+	// both sides send their version at once, so a net.Pipe would deadlock
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	kcs := make(chan *KexConn, 1)
+	done := make(chan error, 1)
+	go func() {
+		server, err := listener.Accept()
+		if err != nil {
+			done <- err
+			return
+		}
+		kc := NewKexConn(server)
+		kcs <- kc
+		conn, _, _, err := ssh.NewServerConn(kc, serverConfig)
+		if err == nil {
+			conn.Close()
+		}
+		done <- err
+	}()
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, _, _, err := ssh.NewClientConn(client, listener.Addr().String(), clientConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if err = <-done; err != nil {
+		t.Fatal(err)
+	}
+	return <-kcs
+}
+
+func TestKexAlgorithms(t *testing.T) {
+	kc := kexConnect(t, []string{"aes128-ctr", "aes256-ctr"}, []string{"hmac-sha2-256"})
+	algs, ok := kc.Algorithms()
+	if !ok {
+		t.Fatal("algorithms not seen")
+	}
+	want := KexAlgorithms{
+		Kex:                "curve25519-sha256@libssh.org",
+		HostKey:            "ssh-ed25519",
+		CipherClientServer: "aes128-ctr",
+		CipherServerClient: "aes128-ctr",
+		MACClientServer:    "hmac-sha2-256",
+		MACServerClient:    "hmac-sha2-256",
+	}
+	if algs != want {
+		t.Errorf("unexpected algorithms %+v, want %+v", algs, want)
+	}
+	if algs.Cipher() != "aes128-ctr" || algs.MAC() != "hmac-sha2-256" {
+		t.Errorf("unexpected cipher %s and MAC %s", algs.Cipher(), algs.MAC())
+	}
+
+	kc = kexConnect(t, []string{"chacha20-poly1305@openssh.com"}, nil)
+	algs, ok = kc.Algorithms()
+	if !ok {
+		t.Fatal("algorithms not seen")
+	}
+	if algs.Cipher() != "chacha20-poly1305@openssh.com" || algs.MAC() != "implicit" {
+		t.Errorf("unexpected cipher %s and MAC %s", algs.Cipher(), algs.MAC())
+	}
+}
+
+func TestKexAlgorithmsNotSSH(t *testing.T) {
+	client, server := net.Pipe()
+	kc := NewKexConn(server)
+	go func() {
+		client.Write([]byte("SSH-2.0-test\r\n\x00\x00\x00\x0c\x04\x05hello\x00\x00\x00\x00"))
+		client.Close()
+	}()
+	buf := make([]byte, 100)
+	for {
+		if _, err := kc.Read(buf); err != nil {
+			break
+		}
+	}
+	if _, ok := kc.Algorithms(); ok {
+		t.Errorf("algorithms found in a connection without KEXINIT")
+	}
+}
@@ -2,11 +2,75 @@ package util
 
 import (
 	"bytes"
+	"crypto/rsa"
+	"encoding/pem"
 	"fmt"
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
 	"io/ioutil"
+	"net"
+	"strings"
 )
 
+// the magic at the start of an OpenSSH format private key
+const opensshKeyMagic = "openssh-key-v1\x00"
+
+// Return the public key type of an OpenSSH format private key, which can
+// be read without decrypting the key, or "" if it is in another format
+func privateKeyType(pemBytes []byte) string {
+	block, _ := pem.Decode(pemBytes)
+	if block == nil || block.Type != "OPENSSH PRIVATE KEY" || !bytes.HasPrefix(block.Bytes, []byte(opensshKeyMagic)) {
+		return ""
+	}
+	var header struct {
+		CipherName string
+		KdfName    string
+		KdfOpts    string
+		NumKeys    uint32
+		PubKey     []byte
+		Rest       []byte `ssh:"rest"`
+	}
+	err := ssh.Unmarshal(block.Bytes[len(opensshKeyMagic):], &header)
+	if err != nil {
+		return ""
+	}
+	pubKey, err := ssh.ParsePublicKey(header.PubKey)
+	if err != nil {
+		return ""
+	}
+	return pubKey.Type()
+}
+
+// Check a private key is of a type which can sign without other
+// hardware. Security key (sk-*) private key files only hold a handle for
+// a key on a FIDO token, so cannot be used as a host or CA key.
+func checkPrivateKeyType(pemBytes []byte) error {
+	keyType := privateKeyType(pemBytes)
+	if strings.HasPrefix(keyType, "sk-") {
+		return fmt.Errorf("%s keys are held on a security key and cannot be used as host or CA keys", keyType)
+	}
+	return nil
+}
+
+// Check a server or CA key is strong enough: not a DSA key, which OpenSSH
+// has deprecated, nor an RSA key of fewer than minRSABits bits
+func CheckKeyStrength(pub ssh.PublicKey, minRSABits int) error {
+	switch pub.Type() {
+	case ssh.KeyAlgoDSA:
+		return fmt.Errorf("%s keys are deprecated", pub.Type())
+	case ssh.KeyAlgoRSA:
+		cpub, ok := pub.(ssh.CryptoPublicKey)
+		if !ok {
+			return nil
+		}
+		rsaPub, ok := cpub.CryptoPublicKey().(*rsa.PublicKey)
+		if ok && rsaPub.N.BitLen() < minRSABits {
+			return fmt.Errorf("RSA key of %d bits is below min_rsa_bits of %d", rsaPub.N.BitLen(), minRSABits)
+		}
+	}
+	return nil
+}
+
 // load a private key from file
 func LoadPrivateKey(filename string) (ssh.Signer, error) {
 
@@ -14,6 +78,10 @@ func LoadPrivateKey(filename string) (ssh.Signer, error) {
 	if err != nil {
 		return nil, err
 	}
+	err = checkPrivateKeyType(fkey)
+	if err != nil {
+		return nil, err
+	}
 	sig, err := ssh.ParsePrivateKey(fkey)
 	if err != nil {
 		return nil, err
@@ -28,6 +96,10 @@ func LoadPrivateKeyWithPassword(filename string, passphrase []byte) (ssh.Signer,
 	if err != nil {
 		return nil, err
 	}
+	err = checkPrivateKeyType(fkey)
+	if err != nil {
+		return nil, err
+	}
 	sig, err := ssh.ParsePrivateKeyWithPassphrase(fkey, passphrase)
 	if err != nil {
 		return nil, err
@@ -49,24 +121,61 @@ func LoadPrivateKeyRaw(filename string) (interface{}, error) {
 	return sig, nil
 }
 
-// load authorized_keys from []byte
+// Report whether s refers to a key held in the ssh-agent, given as
+// "agent:SHA256:..." or just its SHA256 fingerprint, returning the
+// fingerprint
+func AgentKeyRef(s string) (string, bool) {
+	fingerprint := strings.TrimPrefix(s, "agent:")
+	if !strings.HasPrefix(fingerprint, "SHA256:") {
+		return "", false
+	}
+	return fingerprint, true
+}
+
+// find the key with the given SHA256 fingerprint in the ssh-agent
+// listening on socket. The returned signer uses the agent connection,
+// which is held open for as long as the signer is in use.
+func LoadAgentSigner(socket string, fingerprint string) (ssh.Signer, error) {
+
+	if socket == "" {
+		return nil, fmt.Errorf("no ssh-agent socket (is SSH_AUTH_SOCK set?)")
+	}
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return nil, err
+	}
+	signers, err := agent.NewClient(conn).Signers()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	for _, sig := range signers {
+		if ssh.FingerprintSHA256(sig.PublicKey()) == fingerprint {
+			return sig, nil
+		}
+	}
+	conn.Close()
+	return nil, fmt.Errorf("no key with fingerprint %s in ssh-agent", fingerprint)
+}
+
+// load authorized_keys from []byte. Blank lines and lines starting with
+// "#" are skipped. Parsing stops at the first line which is not a valid
+// key, and the error gives its line number and text.
 func LoadAuthorizedKeysBytes(authorizedKeysBytes []byte) ([]ssh.PublicKey, error) {
 
 	// record the found authorized keys
 	var akeys []ssh.PublicKey
 
-	// from https://godoc.org/golang.org/x/crypto/ssh#ex-NewServerConn
-	for len(authorizedKeysBytes) > 0 {
-		pubKey, _, _, rest, err := ssh.ParseAuthorizedKey(authorizedKeysBytes)
+	for i, line := range bytes.Split(authorizedKeysBytes, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		pubKey, _, _, _, err := ssh.ParseAuthorizedKey(line)
 		if err != nil {
-			i := bytes.IndexAny(authorizedKeysBytes, "\n")
-			if i > 1 {
-				authorizedKeysBytes = authorizedKeysBytes[0 : i-1]
-			}
-			return akeys, fmt.Errorf("Error parsing public key \"%s\": %s", authorizedKeysBytes, err)
+			return akeys, fmt.Errorf("Error parsing public key on line %d %q: %s", i+1, line, err)
 		}
 		akeys = append(akeys, pubKey)
-		authorizedKeysBytes = rest
 	}
 	return akeys, nil
 }
@@ -1,11 +1,22 @@
 package util
 
 import (
+	"crypto/dsa"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/pem"
 	"fmt"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
 	"io/ioutil"
+	"net"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"runtime"
+	"strings"
 	"testing"
 )
 
@@ -96,6 +107,75 @@ func TestLoadECDSAKeys(t *testing.T) {
 
 }
 
+// test ssh ed25519 private key with password, which is always in the
+// OpenSSH format
+func TestLoadED25519Keys(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "ed25519")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tname := filepath.Join(dir, "id_ed25519")
+
+	out, err := exec.Command(
+		"ssh-keygen",
+		"-ted25519",
+		fmt.Sprintf("-N%s", password),
+		fmt.Sprintf("-f%s", tname),
+	).Output()
+	if err != nil {
+		t.Fatalf("ssh-keygen failed %s", err)
+	} else {
+		fmt.Printf("out %s", out)
+	}
+
+	_, err = LoadPrivateKey(tname)
+	if _, ok := err.(*ssh.PassphraseMissingError); !ok {
+		t.Errorf("expected passphrase missing error, got %v", err)
+	}
+	sig, err := LoadPrivateKeyWithPassword(tname, password)
+	if err != nil {
+		t.Fatalf("could not read private key with password: %s", err)
+	}
+	if sig.PublicKey().Type() != ssh.KeyAlgoED25519 {
+		t.Errorf("unexpected key type %s", sig.PublicKey().Type())
+	}
+	_, err = LoadPrivateKeyWithPassword(tname, []byte("wrong"))
+	if err == nil {
+		t.Errorf("private key read with wrong password")
+	}
+}
+
+// test a security key private key file is refused clearly
+func TestLoadSKKey(t *testing.T) {
+
+	pubKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(skEd25519Key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// only the unencrypted header is read, so the private part may be
+	// left empty
+	blob := []byte(opensshKeyMagic)
+	blob = append(blob, ssh.Marshal(struct {
+		CipherName, KdfName, KdfOpts string
+		NumKeys                      uint32
+		PubKey, PrivKeyBlock         []byte
+	}{"none", "none", "", 1, pubKey.Marshal(), nil})...)
+	tmpfile, err := writeToFile(string(pem.EncodeToMemory(&pem.Block{Type: "OPENSSH PRIVATE KEY", Bytes: blob})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpfile.Close()
+	defer os.Remove(tmpfile.Name())
+
+	_, err = LoadPrivateKey(tmpfile.Name())
+	t.Logf("Error (expected): %v", err)
+	if err == nil || !strings.Contains(err.Error(), "security key") {
+		t.Errorf("expected security key error, got %v", err)
+	}
+}
+
 func writeToFile(content string) (*os.File, error) {
 
 	tmpfile, err := ioutil.TempFile("", "authorized_keys")
@@ -142,3 +222,184 @@ ecdsa-sha2-nistp384 AAAAE2VjZHNhLXNoYTItbmlzdHAzODQAAAAIbmlzdHAzODQAAABhBIfis9M2
 		t.Error("number of authorized keys should be two")
 	}
 }
+
+// test finding a signer by fingerprint in an ssh-agent
+func TestLoadAgentSigner(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "agent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "agent.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	privKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyring := agent.NewKeyring()
+	err = keyring.Add(agent.AddedKey{PrivateKey: privKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go agent.ServeAgent(keyring, c)
+		}
+	}()
+
+	pubKey, err := ssh.NewPublicKey(&privKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig, err := LoadAgentSigner(socket, ssh.FingerprintSHA256(pubKey))
+	if err != nil {
+		t.Fatalf("could not find key in agent: %s", err)
+	}
+	_, err = sig.Sign(rand.Reader, []byte("test"))
+	if err != nil {
+		t.Errorf("could not sign with agent key: %s", err)
+	}
+
+	_, err = LoadAgentSigner(socket, "SHA256:nonexistent")
+	if err == nil {
+		t.Errorf("unknown fingerprint found in agent")
+	}
+}
+
+var skEd25519Key = `sk-ssh-ed25519@openssh.com AAAAGnNrLXNzaC1lZDI1NTE5QG9wZW5zc2guY29tAAAAIBqBsbcJyyW63tnXYCNDEMiCVUkNOhx1zLQ/WfIcKwIjAAAABHNzaDo= test3@test.com`
+var skECDSAKey = `sk-ecdsa-sha2-nistp256@openssh.com AAAAInNrLWVjZHNhLXNoYTItbmlzdHAyNTZAb3BlbnNzaC5jb20AAAAIbmlzdHAyNTYAAABBBHcxavKZXmbqGRJIaWDcJ0jFGg8/VWlEDxdhtC5bQiFfwNw8eCAa5o8iEqs/MjLXU9jri4R0ryk+9MLjiNHbS+cAAAAEc3NoOg== test4@test.com`
+
+// test security key authorized keys and their fingerprints
+func TestAuthorizedKeysSK(t *testing.T) {
+	akeyfile := skEd25519Key + "\n" + skECDSAKey
+	authorized_keys, err := LoadAuthorizedKeysBytes([]byte(akeyfile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(authorized_keys) != 2 {
+		t.Fatal("number of authorized keys should be two")
+	}
+	expected := []struct {
+		keyType     string
+		fingerprint string
+	}{
+		{ssh.KeyAlgoSKED25519, "SHA256:FkB8EsOtLkXgDieVdG2ACMy+vmqeT05s94osBr+qgUU"},
+		{ssh.KeyAlgoSKECDSA256, "SHA256:2101Cj/MberzCfXK+OdXUWqElzXG9WSsalDaiwwVe1A"},
+	}
+	for i, e := range expected {
+		if authorized_keys[i].Type() != e.keyType {
+			t.Errorf("unexpected key type %s", authorized_keys[i].Type())
+		}
+		if ssh.FingerprintSHA256(authorized_keys[i]) != e.fingerprint {
+			t.Errorf("unexpected fingerprint %s", ssh.FingerprintSHA256(authorized_keys[i]))
+		}
+	}
+}
+
+// test blank lines, comments and trailing whitespace are skipped
+func TestAuthorizedKeysComments(t *testing.T) {
+	akeyfile := "# users\n\n" + skEd25519Key + "  \r\n   \n\t# another\n" + skECDSAKey + "\n"
+	authorized_keys, err := LoadAuthorizedKeysBytes([]byte(akeyfile))
+	if err != nil {
+		t.Error(err)
+	}
+	if len(authorized_keys) != 2 {
+		t.Error("number of authorized keys should be two")
+	}
+}
+
+// test the error for an invalid line gives its number and text
+func TestAuthorizedKeysInvalid(t *testing.T) {
+	akeyfile := skEd25519Key + "\n\nssh-rsa notakey test@test.com\n" + skECDSAKey
+	authorized_keys, err := LoadAuthorizedKeysBytes([]byte(akeyfile))
+	t.Logf("Error (expected): %v", err)
+	if err == nil {
+		t.Fatal("invalid authorized key accepted")
+	}
+	if !strings.Contains(err.Error(), `line 3 "ssh-rsa notakey test@test.com"`) {
+		t.Errorf("error does not give the invalid line: %s", err)
+	}
+	if len(authorized_keys) != 1 {
+		t.Errorf("expected the key before the invalid line, got %d keys", len(authorized_keys))
+	}
+
+	_, err = LoadAuthorizedKeysBytes([]byte("x"))
+	if err == nil || !strings.Contains(err.Error(), `line 1 "x"`) {
+		t.Errorf("unexpected error for a single short line: %v", err)
+	}
+}
+
+func TestCheckKeyStrength(t *testing.T) {
+	for _, c := range []struct {
+		bits int
+		ok   bool
+	}{{1024, false}, {2048, true}} {
+		rsaKey, err := rsa.GenerateKey(rand.Reader, c.bits)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pub, err := ssh.NewPublicKey(&rsaKey.PublicKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = CheckKeyStrength(pub, defaultMinRSABits)
+		if (err == nil) != c.ok {
+			t.Errorf("RSA %d bits: unexpected result %v", c.bits, err)
+		}
+	}
+
+	var dsaKey dsa.PrivateKey
+	err := dsa.GenerateParameters(&dsaKey.Parameters, rand.Reader, dsa.L1024N160)
+	if err == nil {
+		err = dsa.GenerateKey(&dsaKey, rand.Reader)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := ssh.NewPublicKey(&dsaKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = CheckKeyStrength(pub, defaultMinRSABits)
+	t.Logf("Error (expected): %v", err)
+	if err == nil {
+		t.Errorf("DSA key passed")
+	}
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err = ssh.NewPublicKey(&ecKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = CheckKeyStrength(pub, defaultMinRSABits); err != nil {
+		t.Errorf("ECDSA key refused: %v", err)
+	}
+}
+
+func TestAgentKeyRef(t *testing.T) {
+	for spec, want := range map[string]string{
+		"agent:SHA256:Ar7p/R9HO": "SHA256:Ar7p/R9HO",
+		"SHA256:Ar7p/R9HO":       "SHA256:Ar7p/R9HO",
+		"agent:ca":               "",
+		"/etc/sshtokenca/ca":     "",
+		"pkcs11:object=ca":       "",
+	} {
+		got, ok := AgentKeyRef(spec)
+		if ok != (want != "") || got != want {
+			t.Errorf("%s: got %q, %t, want %q", spec, got, ok, want)
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package util
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"golang.org/x/crypto/ssh"
+	yaml "gopkg.in/yaml.v3"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// OpenSSH KRL format constants, from PROTOCOL.krl
+const (
+	krlMagic                 = 0x5353484b524c0a00
+	krlFormatVersion         = 1
+	krlSectionCertificates   = 1
+	krlSectionCertSerialList = 0x20
+	krlSectionCertKeyID      = 0x23
+)
+
+// The certificates which have been revoked, by serial or key id, as kept
+// in the revoked_file
+type Revocations struct {
+	Serials []uint64 `yaml:"serials"`
+	KeyIDs  []string `yaml:"key_ids"`
+}
+
+// Load the revocations from a revoked_file. A file which does not yet
+// exist holds no revocations.
+func LoadRevocations(path string) (*Revocations, error) {
+	r := &Revocations{}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return r, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = yaml.Unmarshal(data, r)
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Save the revocations to a revoked_file, replacing it in one step so
+// that it is never seen half written
+func (r *Revocations) Save(path string) error {
+	data, err := yaml.Marshal(r)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data, 0644)
+}
+
+// Revoke the certificate with the given serial, reporting whether it
+// was not already revoked
+func (r *Revocations) RevokeSerial(serial uint64) bool {
+	for _, s := range r.Serials {
+		if s == serial {
+			return false
+		}
+	}
+	r.Serials = append(r.Serials, serial)
+	sort.Slice(r.Serials, func(i, j int) bool { return r.Serials[i] < r.Serials[j] })
+	return true
+}
+
+// Revoke the certificates with the given key id, reporting whether it
+// was not already revoked
+func (r *Revocations) RevokeKeyID(keyID string) bool {
+	for _, k := range r.KeyIDs {
+		if k == keyID {
+			return false
+		}
+	}
+	r.KeyIDs = append(r.KeyIDs, keyID)
+	sort.Strings(r.KeyIDs)
+	return true
+}
+
+// Report whether a certificate has been revoked
+func (r *Revocations) IsRevoked(cert *ssh.Certificate) bool {
+	for _, s := range r.Serials {
+		if s == cert.Serial {
+			return true
+		}
+	}
+	for _, k := range r.KeyIDs {
+		if k == cert.KeyId {
+			return true
+		}
+	}
+	return false
+}
+
+// Return the revocations as an OpenSSH KRL, for sshd's RevokedKeys. The
+// revocations apply to certificates from each of caKeys, with a section
+// for each, since sshd does not match a section without a CA key, and
+// the KRL version is the time it was generated.
+func (r *Revocations) KRL(caKeys []ssh.PublicKey, now time.Time) ([]byte, error) {
+	if len(caKeys) == 0 {
+		return nil, errors.New("no CA keys to revoke the certificates of")
+	}
+	var krl bytes.Buffer
+	binary.Write(&krl, binary.BigEndian, uint64(krlMagic))
+	binary.Write(&krl, binary.BigEndian, uint32(krlFormatVersion))
+	binary.Write(&krl, binary.BigEndian, uint64(now.Unix())) // krl version
+	binary.Write(&krl, binary.BigEndian, uint64(now.Unix())) // generated date
+	binary.Write(&krl, binary.BigEndian, uint64(0))          // flags
+	krlString(&krl, nil)                                     // reserved
+	krlString(&krl, []byte("sshtokenca"))                    // comment
+
+	seen := map[string]bool{}
+	for _, caKey := range caKeys {
+		ca := caKey.Marshal()
+		if seen[string(ca)] {
+			continue
+		}
+		seen[string(ca)] = true
+		krl.WriteByte(krlSectionCertificates)
+		krlString(&krl, r.krlCertSection(ca))
+	}
+	return krl.Bytes(), nil
+}
+
+// Return the body of a KRL certificates section revoking the serials and
+// key ids of certificates signed by the marshalled CA key ca
+func (r *Revocations) krlCertSection(ca []byte) []byte {
+	var certs bytes.Buffer
+	krlString(&certs, ca)
+	krlString(&certs, nil) // reserved
+	if len(r.Serials) > 0 {
+		var serials bytes.Buffer
+		for _, s := range r.Serials {
+			binary.Write(&serials, binary.BigEndian, s)
+		}
+		certs.WriteByte(krlSectionCertSerialList)
+		krlString(&certs, serials.Bytes())
+	}
+	if len(r.KeyIDs) > 0 {
+		var keyIDs bytes.Buffer
+		for _, k := range r.KeyIDs {
+			krlString(&keyIDs, []byte(k))
+		}
+		certs.WriteByte(krlSectionCertKeyID)
+		krlString(&certs, keyIDs.Bytes())
+	}
+	return certs.Bytes()
+}
+
+// Write the KRL for caKeys to a krl_file, replacing it in one step so
+// that sshd never reads it half written
+func (r *Revocations) WriteKRL(path string, caKeys []ssh.PublicKey, now time.Time) error {
+	krl, err := r.KRL(caKeys, now)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, krl, 0644)
+}
+
+// Write an SSH wire format string
+func krlString(b *bytes.Buffer, s []byte) {
+	binary.Write(b, binary.BigEndian, uint32(len(s)))
+	b.Write(s)
+}
+
+// Write a file by way of a temporary file in the same directory, renamed
+// over it
+func writeFileAtomic(path string, data []byte, mode os.FileMode) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Chmod(mode)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
@@ -0,0 +1,183 @@
+package util
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/binary"
+	"golang.org/x/crypto/ssh"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRevocations(t *testing.T) {
+	dir, err := ioutil.TempDir("", "krl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "revoked.yaml")
+
+	r, err := LoadRevocations(path)
+	if err != nil || len(r.Serials) != 0 || len(r.KeyIDs) != 0 {
+		t.Fatalf("unexpected revocations from missing file %+v: %v", r, err)
+	}
+	if !r.RevokeSerial(20) || !r.RevokeSerial(10) || r.RevokeSerial(20) {
+		t.Errorf("unexpected result revoking serials")
+	}
+	if !r.RevokeKeyID("acmeinc_jane") || r.RevokeKeyID("acmeinc_jane") {
+		t.Errorf("unexpected result revoking key id")
+	}
+	if !r.IsRevoked(&ssh.Certificate{Serial: 10}) || !r.IsRevoked(&ssh.Certificate{KeyId: "acmeinc_jane"}) {
+		t.Errorf("revoked certificate not reported")
+	}
+	if r.IsRevoked(&ssh.Certificate{Serial: 30, KeyId: "acmeinc_john"}) {
+		t.Errorf("certificate reported revoked")
+	}
+
+	err = r.Save(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r2, err := LoadRevocations(path)
+	if err != nil || !reflect.DeepEqual(r, r2) {
+		t.Errorf("unexpected revocations loaded %+v: %v", r2, err)
+	}
+	if !reflect.DeepEqual(r2.Serials, []uint64{10, 20}) {
+		t.Errorf("serials not sorted: %v", r2.Serials)
+	}
+
+	ca1, ca2, other := krlTestCA(t), krlTestCA(t), krlTestCA(t)
+	_, err = r.KRL(nil, time.Now())
+	t.Logf("Error (expected): %v", err)
+	if err == nil {
+		t.Errorf("KRL written for no CA keys")
+	}
+	krl, err := r.KRL([]ssh.PublicKey{ca1.PublicKey(), ca2.PublicKey(), ca1.PublicKey()}, time.Unix(1600000000, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var header struct {
+		Magic     uint64
+		Format    uint32
+		Version   uint64
+		Generated uint64
+		Flags     uint64
+	}
+	rd := bytes.NewReader(krl)
+	err = binary.Read(rd, binary.BigEndian, &header)
+	if err != nil || header.Magic != krlMagic || header.Format != krlFormatVersion || header.Version != 1600000000 {
+		t.Errorf("unexpected KRL header %+v: %v", header, err)
+	}
+	krlReadString(t, rd) // reserved
+	krlReadString(t, rd) // comment
+
+	// a certificates section for each CA key, once, with the serials and
+	// key ids
+	serials := []byte{0, 0, 0, 0, 0, 0, 0, 10, 0, 0, 0, 0, 0, 0, 0, 20}
+	var keyIDs bytes.Buffer
+	krlString(&keyIDs, []byte("acmeinc_jane"))
+	for _, ca := range []ssh.Signer{ca1, ca2} {
+		section, err := rd.ReadByte()
+		if err != nil || section != krlSectionCertificates {
+			t.Fatalf("unexpected KRL section %d: %v", section, err)
+		}
+		body := bytes.NewReader(krlReadString(t, rd))
+		if !bytes.Equal(krlReadString(t, body), ca.PublicKey().Marshal()) {
+			t.Errorf("KRL section for the wrong CA key")
+		}
+		krlReadString(t, body) // reserved
+		for _, want := range []struct {
+			kind byte
+			data []byte
+		}{{krlSectionCertSerialList, serials}, {krlSectionCertKeyID, keyIDs.Bytes()}} {
+			kind, err := body.ReadByte()
+			if err != nil || kind != want.kind {
+				t.Fatalf("unexpected KRL subsection %d, want %d: %v", kind, want.kind, err)
+			}
+			if data := krlReadString(t, body); !bytes.Equal(data, want.data) {
+				t.Errorf("unexpected KRL subsection %d data %v", kind, data)
+			}
+		}
+		if body.Len() != 0 {
+			t.Errorf("trailing data in KRL section")
+		}
+	}
+	if rd.Len() != 0 {
+		t.Errorf("unexpected KRL sections after those for the CA keys")
+	}
+
+	// and as OpenSSH reads it
+	krlPath := filepath.Join(dir, "revoked.krl")
+	err = r.WriteKRL(krlPath, []ssh.PublicKey{ca1.PublicKey(), ca2.PublicKey()}, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		ca      ssh.Signer
+		serial  uint64
+		keyID   string
+		revoked bool
+	}{
+		{ca1, 10, "acmeinc_john", true},
+		{ca2, 20, "acmeinc_john", true},
+		{ca2, 30, "acmeinc_jane", true},
+		{ca1, 30, "acmeinc_john", false},
+		{other, 10, "acmeinc_jane", false},
+	} {
+		certPath := filepath.Join(dir, "cert.pub")
+		err = ioutil.WriteFile(certPath, ssh.MarshalAuthorizedKey(krlTestCert(t, c.ca, c.serial, c.keyID)), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err := exec.Command("ssh-keygen", "-Q", "-f", krlPath, certPath).CombinedOutput()
+		revoked := err != nil && bytes.Contains(out, []byte("REVOKED"))
+		if err != nil && !revoked {
+			t.Fatalf("ssh-keygen -Q failed: %v: %s", err, out)
+		}
+		if revoked != c.revoked {
+			t.Errorf("certificate serial %d key id %s revoked %v, want %v: %s", c.serial, c.keyID, revoked, c.revoked, out)
+		}
+	}
+}
+
+// Make a CA key for KRL tests
+func krlTestCA(t *testing.T) ssh.Signer {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+// Make a certificate signed by ca with the given serial and key id
+func krlTestCert(t *testing.T, ca ssh.Signer, serial uint64, keyID string) *ssh.Certificate {
+	cert := signTestCert(t, ca)
+	cert.Serial = serial
+	cert.KeyId = keyID
+	if err := cert.SignCert(rand.Reader, ca); err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+// Read an SSH wire format string
+func krlReadString(t *testing.T, rd *bytes.Reader) []byte {
+	var n uint32
+	if err := binary.Read(rd, binary.BigEndian, &n); err != nil || int(n) > rd.Len() {
+		t.Fatalf("bad KRL string: %v", err)
+	}
+	s := make([]byte, n)
+	rd.Read(s)
+	return s
+}
@@ -2,51 +2,230 @@ package util
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
 	"fmt"
 	oidc "github.com/coreos/go-oidc"
 	"golang.org/x/oauth2"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
 	"regexp"
 	"strings"
+	"sync"
+	"time"
 )
 
+// Defaults for provider discovery, which is retried so that a brief
+// outage of the provider does not stop the server starting
+const (
+	defaultDiscoveryTimeout  = 10 * time.Second
+	defaultDiscoveryAttempts = 5
+	maxDiscoveryBackoff      = 30 * time.Second
+)
+
+// The redirect URL for the out-of-band flow, where the provider shows the
+// auth code for the user to paste
+const oobRedirectURL = "urn:ietf:wg:oauth:2.0:oob"
+
+// The wait before the first retry of discovery, doubling for each retry
+var discoveryBackoff = time.Second
+
+// The longest userinfo_grace, so that a claim the provider has since
+// changed or removed is not relied on for long
+const maxUserInfoGrace = 15 * time.Minute
+
+// Called before each retry of provider discovery, so that the attempts
+// can be logged
+var OIDCDiscoveryRetry = func(issuer string, attempt int, err error, wait time.Duration) {}
+
 type OpenIDC struct {
 	Issuer       string   `yaml:"issuer"`
 	ClientID     string   `yaml:"client_id"`
 	ClientSecret string   `yaml:"client_secret"`
 	RedirectURL  string   `yaml:"redirect_url"`
 	Scopes       []string `yaml:"scopes"`
+	GroupsClaim  string   `yaml:"groups_claim"`
+
+	// the timeout of each request to the provider, and how many times
+	// discovery is tried at startup or reload
+	DiscoveryTimeout  time.Duration `yaml:"discovery_timeout"`
+	DiscoveryAttempts int           `yaml:"discovery_attempts"`
+
+	// use the device flow (RFC 8628) rather than pasting an auth code
+	DeviceFlow bool `yaml:"device_flow"`
+
+	// a claim from the userinfo endpoint which may match oidc_subject
+	// in place of the ID token's subject, and how long the claim last
+	// fetched may be used if the endpoint fails
+	UserInfoClaim string        `yaml:"userinfo_claim"`
+	UserInfoGrace time.Duration `yaml:"userinfo_grace"`
+
+	// a claim giving the username of users who have no user_principals
+	// entry, the email domains and usernames it may have, and those users'
+	// principals
+	UsernameClaim     string   `yaml:"username_claim"`
+	AllowedDomains    []string `yaml:"allowed_domains,flow"`
+	AllowedUsernames  []string `yaml:"allowed_usernames,flow"`
+	DefaultPrincipals []string `yaml:"default_principals,flow"`
+
+	// keep users' refresh tokens, encrypted in RefreshTokenDir, to log
+	// them in again without the full flow
+	RefreshTokens   bool   `yaml:"refresh_tokens"`
+	RefreshTokenDir string `yaml:"refresh_token_dir"`
+	RefreshTokenKey string `yaml:"refresh_token_key"`
 
 	oauth2           *oauth2.Config
 	provider         *oidc.Provider
 	verifier         *oidc.IDTokenVerifier
 	validRedirectURI *regexp.Regexp
+	deviceAuthURL    string
+	refresh          *refreshStore
+	random           io.Reader // from Settings.random_source
+
+	// userinfo claims by ID token subject
+	userInfoMu    sync.Mutex
+	userInfoCache map[string]cachedClaim
+}
+
+// A userinfo claim value and when it was fetched
+type cachedClaim struct {
+	value   string
+	fetched time.Time
+}
+
+// The per-session values of an authorization code flow, which must be
+// kept from AuthCodeURL until the code is exchanged by CodeToIDToken
+type AuthRequest struct {
+	// PKCE (RFC 7636) code verifier
+	CodeVerifier string
+	// returned with the code to a redirect URL, binding it to this request
+	State string
+	// must appear in the ID token, so that a token cannot be replayed
+	Nonce string
+}
+
+// Check the configuration before contacting the provider, reporting all
+// of the problems found together
+func (app *OpenIDC) check() error {
+	var problems []string
+	if app.Issuer == "" {
+		problems = append(problems, "issuer is missing")
+	} else if u, err := url.Parse(app.Issuer); err != nil || u.Host == "" ||
+		(u.Scheme != "https" && !(u.Scheme == "http" && isLoopback(u.Hostname()))) {
+		problems = append(problems, fmt.Sprintf("issuer %q is not an https URL", app.Issuer))
+	}
+	if app.ClientID == "" {
+		problems = append(problems, "client_id is missing")
+	}
+	if app.RedirectURL != "" && app.RedirectURL != oobRedirectURL {
+		u, err := url.Parse(app.RedirectURL)
+		if err != nil || !u.IsAbs() || u.Host == "" {
+			problems = append(problems, fmt.Sprintf("redirect_url %q is not a URL or %s", app.RedirectURL, oobRedirectURL))
+		} else if app.ClientSecret == "" && !(u.Scheme == "http" && isLoopback(u.Hostname())) {
+			// only a native app, redirecting to the out-of-band page
+			// or the user's own machine, may be a public client
+			problems = append(problems, fmt.Sprintf("client_secret is required with redirect_url %s", app.RedirectURL))
+		}
+	}
+	if app.RefreshTokens {
+		if app.RefreshTokenDir == "" {
+			problems = append(problems, "refresh_tokens requires refresh_token_dir")
+		}
+		if len(app.RefreshTokenKey) < minRefreshTokenKey {
+			problems = append(problems, fmt.Sprintf("refresh_tokens requires a refresh_token_key of at least %d characters", minRefreshTokenKey))
+		}
+	}
+	if app.UserInfoGrace < 0 || app.UserInfoGrace > maxUserInfoGrace {
+		problems = append(problems, fmt.Sprintf("userinfo_grace must be between 0 and %s", maxUserInfoGrace))
+	}
+	if app.DiscoveryTimeout < 0 {
+		problems = append(problems, "discovery_timeout must not be negative")
+	}
+	if app.DiscoveryAttempts < 0 {
+		problems = append(problems, "discovery_attempts must not be negative")
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("oidc: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// Report whether host is the local machine
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
 }
 
 // Initialise - makes an outbound connection to fetch the provider
-// configuration from the Issuer/.well-known/configuration URL
+// configuration from the Issuer/.well-known/configuration URL, retrying
+// with backoff up to DiscoveryAttempts times
 //
 // Note that the ctx is only used for the duration of this call,
 // it is not stored anywhere
 func (app *OpenIDC) Init(ctx context.Context) error {
-	var err error
-
-	if app.Issuer == "" {
-		return fmt.Errorf("issuer is missing")
-	}
-	if app.ClientID == "" {
-		return fmt.Errorf("client_id is missing")
+	err := app.check()
+	if err != nil {
+		return err
 	}
 	if app.RedirectURL == "" {
-		app.RedirectURL = "urn:ietf:wg:oauth:2.0:oob"
+		app.RedirectURL = oobRedirectURL
 	}
 	if len(app.Scopes) == 0 {
 		app.Scopes = []string{oidc.ScopeOpenID}
 	}
+	if app.DiscoveryTimeout == 0 {
+		app.DiscoveryTimeout = defaultDiscoveryTimeout
+	}
+	if app.DiscoveryAttempts == 0 {
+		app.DiscoveryAttempts = defaultDiscoveryAttempts
+	}
+	if app.RefreshTokens {
+		app.refresh, err = newRefreshStore(app.RefreshTokenDir, app.RefreshTokenKey)
+		if err != nil {
+			return err
+		}
+	}
 
 	app.validRedirectURI = regexp.MustCompile(`\Ahttp://(localhost|127[.]0[.]0[.]1):\d+/\S*\z`)
-	app.provider, err = oidc.NewProvider(ctx, app.Issuer)
-	if err != nil {
-		return err
+
+	// the client's timeout bounds each request, including later ones
+	// for the provider's keys, without cancelling ctx, which the
+	// provider keeps
+	ctx = oidc.ClientContext(ctx, &http.Client{Timeout: app.DiscoveryTimeout})
+	wait := discoveryBackoff
+	for attempt := 1; ; attempt++ {
+		app.provider, err = oidc.NewProvider(ctx, app.Issuer)
+		if err == nil {
+			break
+		}
+		if attempt >= app.DiscoveryAttempts {
+			return fmt.Errorf("oidc provider discovery for %s failed after %d attempts: %s", app.Issuer, attempt, err)
+		}
+		OIDCDiscoveryRetry(app.Issuer, attempt, err, wait)
+		time.Sleep(wait)
+		wait *= 2
+		if wait > maxDiscoveryBackoff {
+			wait = maxDiscoveryBackoff
+		}
+	}
+	if app.DeviceFlow {
+		var endpoints struct {
+			DeviceAuthURL string `json:"device_authorization_endpoint"`
+		}
+		err = app.provider.Claims(&endpoints)
+		if err != nil {
+			return err
+		}
+		if endpoints.DeviceAuthURL == "" {
+			return fmt.Errorf("device_flow set but %s has no device_authorization_endpoint", app.Issuer)
+		}
+		app.deviceAuthURL = endpoints.DeviceAuthURL
 	}
 	app.verifier = app.provider.Verifier(&oidc.Config{ClientID: app.ClientID})
 	// https://godoc.org/golang.org/x/oauth2#Config
@@ -61,37 +240,318 @@ func (app *OpenIDC) Init(ctx context.Context) error {
 	return nil
 }
 
-func (app *OpenIDC) CodeToIDToken(ctx context.Context, code string) (*oidc.IDToken, error) {
-	// Special case: allow user to enter <code><space><URI> so that they can
-	// select their own localhost port
-	opt := make([]oauth2.AuthCodeOption, 0)
-	pieces := strings.Split(code, " ")
-	if len(pieces) == 2 && app.validRedirectURI.MatchString(pieces[1]) {
+// Start a new authorization code flow
+func (app *OpenIDC) NewAuthRequest() (*AuthRequest, error) {
+	verifier, err := app.randomString()
+	if err != nil {
+		return nil, err
+	}
+	state, err := app.randomString()
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := app.randomString()
+	if err != nil {
+		return nil, err
+	}
+	return &AuthRequest{CodeVerifier: verifier, State: state, Nonce: nonce}, nil
+}
+
+// Return the source of randomness
+func (app *OpenIDC) randomReader() io.Reader {
+	if app.random == nil {
+		return rand.Reader
+	}
+	return app.random
+}
+
+// Return 32 random bytes, base64url encoded
+func (app *OpenIDC) randomString() (string, error) {
+	b := make([]byte, 32)
+	_, err := io.ReadFull(app.randomReader(), b)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// Extract the auth code from the user's answer to the prompt. This is
+// either the bare code, as shown by the provider for the out-of-band
+// redirect, or the localhost URL the user's browser was redirected to
+// (optionally preceded by the code), so that they can select their own
+// localhost port. The state in a redirect URL must match req.
+//
+// With the out-of-band redirect the provider does not return the state;
+// the code is instead bound to this request by the PKCE code verifier.
+func (app *OpenIDC) parseAnswer(req *AuthRequest, answer string) (string, []oauth2.AuthCodeOption, error) {
+	var code, redirect string
+	pieces := strings.Fields(answer)
+	switch {
+	case len(pieces) == 1 && strings.Contains(pieces[0], "://"):
+		redirect = pieces[0]
+	case len(pieces) == 1:
 		code = pieces[0]
-		opt = append(opt, oauth2.SetAuthURLParam("redirect_uri", pieces[1]))
+	case len(pieces) == 2:
+		code, redirect = pieces[0], pieces[1]
+	default:
+		return "", nil, fmt.Errorf("expected an auth code or redirect URL")
 	}
 
+	var opt []oauth2.AuthCodeOption
+	if redirect != "" {
+		if !app.validRedirectURI.MatchString(redirect) {
+			return "", nil, fmt.Errorf("redirect URL must be http://localhost:<port>/...")
+		}
+		u, err := url.Parse(redirect)
+		if err != nil {
+			return "", nil, err
+		}
+		q := u.Query()
+		if c := q.Get("code"); c != "" {
+			if code != "" && code != c {
+				return "", nil, fmt.Errorf("auth code does not match redirect URL")
+			}
+			code = c
+		}
+		state := q.Get("state")
+		if state == "" {
+			return "", nil, fmt.Errorf("redirect URL has no state, paste the whole URL")
+		} else if state != req.State {
+			return "", nil, fmt.Errorf("state mismatch, the auth code is not from this session")
+		}
+		u.RawQuery = ""
+		u.Fragment = ""
+		opt = append(opt, oauth2.SetAuthURLParam("redirect_uri", u.String()))
+	}
+	if code == "" {
+		return "", nil, fmt.Errorf("no auth code given")
+	}
+	return code, opt, nil
+}
+
+// Exchange the auth code in the user's answer for tokens, returning the
+// verified ID token and the OAuth2 token, which can be used to query the
+// userinfo endpoint
+func (app *OpenIDC) CodeToIDToken(ctx context.Context, req *AuthRequest, answer string) (*oidc.IDToken, *oauth2.Token, error) {
+	code, opt, err := app.parseAnswer(req, answer)
+	if err != nil {
+		return nil, nil, err
+	}
+	opt = append(opt, oauth2.SetAuthURLParam("code_verifier", req.CodeVerifier))
+
 	// Call out to exchange code for token
 	oauth2Token, err := app.oauth2.Exchange(ctx, code, opt...)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	// Extract the ID Token from OAuth2 token.
 	rawIDToken, ok := oauth2Token.Extra("id_token").(string)
 	if !ok {
-		return nil, err
+		return nil, nil, fmt.Errorf("token response has no id_token")
 	}
 
 	// Parse and verify ID Token payload.
 	idToken, err := app.verifier.Verify(ctx, rawIDToken)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// The verifier leaves nonce validation to the caller
+	err = checkNonce(req, idToken)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return idToken, oauth2Token, nil
+}
+
+// Report whether the user authenticated by idToken has the given
+// oidc_subject: either the ID token's subject or, if UserInfoClaim is
+// set, that claim from the userinfo endpoint. If the endpoint fails the
+// subject does not match, unless UserInfoGrace is set and the claim was
+// last fetched for the subject within it, when that is used and the error
+// returned for logging alongside the result.
+func (app *OpenIDC) MatchSubject(ctx context.Context, token *oauth2.Token, idToken *oidc.IDToken, subject string) (bool, error) {
+	if idToken.Subject == subject {
+		return true, nil
+	}
+	if app.UserInfoClaim == "" {
+		return false, nil
+	}
+	value, err := app.userInfoClaim(ctx, token, idToken.Subject)
+	if err != nil {
+		app.userInfoMu.Lock()
+		cached, ok := app.userInfoCache[idToken.Subject]
+		app.userInfoMu.Unlock()
+		if !ok || time.Since(cached.fetched) > app.UserInfoGrace {
+			return false, err
+		}
+		value = cached.value
+	}
+	return value != "" && value == subject, err
+}
+
+// Fetch UserInfoClaim from the userinfo endpoint, checking the response
+// is for subject as the OIDC spec requires, and remember it if it may be
+// used when the endpoint fails
+func (app *OpenIDC) userInfoClaim(ctx context.Context, token *oauth2.Token, subject string) (string, error) {
+	info, err := app.provider.UserInfo(ctx, oauth2.StaticTokenSource(token))
+	if err != nil {
+		return "", fmt.Errorf("userinfo request failed: %s", err)
+	}
+	if info.Subject != subject {
+		return "", fmt.Errorf("userinfo subject %s does not match ID token subject %s", info.Subject, subject)
+	}
+	claims := map[string]interface{}{}
+	err = info.Claims(&claims)
+	if err != nil {
+		return "", err
+	}
+	var value string
+	switch v := claims[app.UserInfoClaim].(type) {
+	case nil:
+	case string:
+		value = v
+	case float64:
+		value = fmt.Sprintf("%.0f", v)
+	default:
+		return "", fmt.Errorf("unexpected type of userinfo %s claim", app.UserInfoClaim)
+	}
+
+	if app.UserInfoGrace == 0 {
+		return value, nil
+	}
+	app.userInfoMu.Lock()
+	if app.userInfoCache == nil {
+		app.userInfoCache = map[string]cachedClaim{}
+	}
+	app.userInfoCache[subject] = cachedClaim{value: value, fetched: time.Now()}
+	app.userInfoMu.Unlock()
+	return value, nil
+}
+
+// Check the ID token carries the nonce sent in the auth request
+func checkNonce(req *AuthRequest, idToken *oidc.IDToken) error {
+	if idToken.Nonce == "" {
+		return fmt.Errorf("id token has no nonce")
+	} else if idToken.Nonce != req.Nonce {
+		return fmt.Errorf("id token nonce mismatch, the token is not from this session")
+	}
+	return nil
+}
+
+// Return the groups listed in the ID token's GroupsClaim, which may be a
+// list of strings or a single string. A missing claim gives no groups.
+func (app *OpenIDC) Groups(idToken *oidc.IDToken) ([]string, error) {
+	claims := map[string]interface{}{}
+	err := idToken.Claims(&claims)
 	if err != nil {
 		return nil, err
 	}
+	switch v := claims[app.GroupsClaim].(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return []string{v}, nil
+	case []interface{}:
+		groups := make([]string, 0, len(v))
+		for _, g := range v {
+			name, ok := g.(string)
+			if !ok {
+				return nil, fmt.Errorf("unexpected value in %s claim: %v", app.GroupsClaim, g)
+			}
+			groups = append(groups, name)
+		}
+		return groups, nil
+	}
+	return nil, fmt.Errorf("unexpected type of %s claim", app.GroupsClaim)
+}
+
+// Usernames which may be taken from the username claim
+var validUsername = regexp.MustCompile(`\A[A-Za-z0-9_][A-Za-z0-9_.-]*\z`)
+
+// Return the username given by the UsernameClaim of the ID token
+func (app *OpenIDC) ClaimedUsername(idToken *oidc.IDToken) (string, error) {
+	claims := map[string]interface{}{}
+	err := idToken.Claims(&claims)
+	if err != nil {
+		return "", err
+	}
+	return app.claimedUsername(claims)
+}
 
-	return idToken, nil
+// Return the username given by the UsernameClaim of claims. For an email
+// address, this is the part before the @, and the domain must be one of
+// AllowedDomains and, for the email claim, verified. The username must be
+// one of AllowedUsernames, if any are given.
+func (app *OpenIDC) claimedUsername(claims map[string]interface{}) (string, error) {
+	value, _ := claims[app.UsernameClaim].(string)
+	if value == "" {
+		return "", fmt.Errorf("ID token has no %s claim", app.UsernameClaim)
+	}
+	name := value
+	if i := strings.LastIndex(value, "@"); i >= 0 {
+		domain := value[i+1:]
+		name = value[:i]
+		allowed := false
+		for _, d := range app.AllowedDomains {
+			if strings.EqualFold(d, domain) {
+				allowed = true
+			}
+		}
+		if !allowed {
+			return "", fmt.Errorf("%s %s is not in an allowed domain", app.UsernameClaim, value)
+		}
+		if verified, _ := claims["email_verified"].(bool); !verified && app.UsernameClaim == "email" {
+			return "", fmt.Errorf("email %s is not verified", value)
+		}
+	} else if len(app.AllowedDomains) > 0 {
+		return "", fmt.Errorf("%s %s has no domain", app.UsernameClaim, value)
+	}
+	if !validUsername.MatchString(name) {
+		return "", fmt.Errorf("%s %s does not give a valid username", app.UsernameClaim, value)
+	}
+	if len(app.AllowedUsernames) > 0 {
+		allowed := false
+		for _, u := range app.AllowedUsernames {
+			if u == name {
+				allowed = true
+			}
+		}
+		if !allowed {
+			return "", fmt.Errorf("%s %s is not an allowed username", app.UsernameClaim, value)
+		}
+	}
+	return name, nil
+}
+
+// Provider configuration as discovered by Init
+type ProviderInfo struct {
+	Issuer          string   `json:"issuer"`
+	AuthURL         string   `json:"authorization_endpoint"`
+	TokenURL        string   `json:"token_endpoint"`
+	JWKSURL         string   `json:"jwks_uri"`
+	UserInfoURL     string   `json:"userinfo_endpoint"`
+	ScopesSupported []string `json:"scopes_supported"`
+}
+
+// Return the provider configuration discovered by Init
+func (app *OpenIDC) ProviderInfo() (*ProviderInfo, error) {
+	info := &ProviderInfo{}
+	err := app.provider.Claims(info)
+	if err != nil {
+		return nil, err
+	}
+	return info, nil
 }
 
-func (app *OpenIDC) AuthCodeURL(state string) string {
-	return app.oauth2.AuthCodeURL(state)
+// Return the URL at which the user obtains an auth code for req
+func (app *OpenIDC) AuthCodeURL(req *AuthRequest) string {
+	challenge := sha256.Sum256([]byte(req.CodeVerifier))
+	return app.oauth2.AuthCodeURL(req.State,
+		oauth2.SetAuthURLParam("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:])),
+		oauth2.SetAuthURLParam("code_challenge_method", "S256"),
+		oidc.Nonce(req.Nonce),
+	)
 }
@@ -0,0 +1,326 @@
+package util
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	oidc "github.com/coreos/go-oidc"
+	"golang.org/x/oauth2"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testOpenIDC() *OpenIDC {
+	return &OpenIDC{
+		validRedirectURI: regexp.MustCompile(`\Ahttp://(localhost|127[.]0[.]0[.]1):\d+/\S*\z`),
+		oauth2: &oauth2.Config{
+			ClientID: "XXXXXXXX",
+			Endpoint: oauth2.Endpoint{
+				AuthURL:  "https://idp.example.com/auth",
+				TokenURL: "https://idp.example.com/token",
+			},
+		},
+	}
+}
+
+func TestAuthCodeURLPKCE(t *testing.T) {
+	app := testOpenIDC()
+	req, err := app.NewAuthRequest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(req.CodeVerifier) < 43 {
+		t.Errorf("code verifier too short: %q", req.CodeVerifier)
+	}
+	u, err := url.Parse(app.AuthCodeURL(req))
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := u.Query()
+	challenge := sha256.Sum256([]byte(req.CodeVerifier))
+	if q.Get("code_challenge") != base64.RawURLEncoding.EncodeToString(challenge[:]) {
+		t.Errorf("wrong code_challenge %q", q.Get("code_challenge"))
+	}
+	if q.Get("code_challenge_method") != "S256" {
+		t.Errorf("wrong code_challenge_method %q", q.Get("code_challenge_method"))
+	}
+
+	req2, err := app.NewAuthRequest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req2.CodeVerifier == req.CodeVerifier {
+		t.Errorf("code verifier reused")
+	}
+}
+
+func TestParseAnswerState(t *testing.T) {
+	app := testOpenIDC()
+	req, err := app.NewAuthRequest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(app.AuthCodeURL(req))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Query().Get("state") != req.State {
+		t.Errorf("auth code URL has wrong state")
+	}
+
+	code, opt, err := app.parseAnswer(req, "4/abcdef")
+	if err != nil || code != "4/abcdef" || len(opt) != 0 {
+		t.Errorf("bare code not accepted: %v", err)
+	}
+	code, opt, err = app.parseAnswer(req, "http://localhost:8080/cb?code=xyz&state="+req.State)
+	if err != nil || code != "xyz" || len(opt) != 1 {
+		t.Errorf("redirect URL not accepted: %v", err)
+	}
+	code, _, err = app.parseAnswer(req, "xyz http://127.0.0.1:8080/?state="+req.State)
+	if err != nil || code != "xyz" {
+		t.Errorf("code and redirect URL not accepted: %v", err)
+	}
+
+	for _, answer := range []string{
+		"http://localhost:8080/cb?code=xyz&state=wrong",
+		"http://localhost:8080/cb?code=xyz",
+		"xyz http://localhost:8080/",
+		"http://evil.example.com:8080/cb?code=xyz&state=" + req.State,
+		"",
+	} {
+		_, _, err = app.parseAnswer(req, answer)
+		t.Logf("Error (expected): %v", err)
+		if err == nil {
+			t.Errorf("answer %q accepted", answer)
+		}
+	}
+}
+
+func TestNonce(t *testing.T) {
+	app := testOpenIDC()
+	req, err := app.NewAuthRequest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(app.AuthCodeURL(req))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.Nonce == "" || u.Query().Get("nonce") != req.Nonce {
+		t.Errorf("auth code URL has wrong nonce")
+	}
+	err = checkNonce(req, &oidc.IDToken{Nonce: req.Nonce})
+	if err != nil {
+		t.Errorf("matching nonce rejected: %v", err)
+	}
+	for _, nonce := range []string{"", "replayed"} {
+		err = checkNonce(req, &oidc.IDToken{Nonce: nonce})
+		t.Logf("Error (expected): %v", err)
+		if err == nil {
+			t.Errorf("nonce %q accepted", nonce)
+		}
+	}
+}
+
+// A provider whose discovery fails until it has been asked failures times
+func flakyProvider(failures int) *httptest.Server {
+	var server *httptest.Server
+	requests := 0
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests <= failures {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintf(w, `{"issuer":%q,"authorization_endpoint":"%[1]s/auth","token_endpoint":"%[1]s/token","jwks_uri":"%[1]s/keys"}`, server.URL)
+	}))
+	return server
+}
+
+func TestDiscoveryRetry(t *testing.T) {
+	defer func(d time.Duration) { discoveryBackoff = d }(discoveryBackoff)
+	discoveryBackoff = time.Millisecond
+	retries := 0
+	defer func(f func(string, int, error, time.Duration)) { OIDCDiscoveryRetry = f }(OIDCDiscoveryRetry)
+	OIDCDiscoveryRetry = func(issuer string, attempt int, err error, wait time.Duration) {
+		retries++
+	}
+
+	server := flakyProvider(2)
+	defer server.Close()
+	app := &OpenIDC{Issuer: server.URL, ClientID: "XXXXXXXX"}
+	err := app.Init(context.Background())
+	if err != nil {
+		t.Fatalf("discovery failed: %v", err)
+	}
+	if retries != 2 {
+		t.Errorf("expected 2 retries, got %d", retries)
+	}
+
+	server = flakyProvider(3)
+	defer server.Close()
+	app = &OpenIDC{Issuer: server.URL, ClientID: "XXXXXXXX", DiscoveryAttempts: 3}
+	err = app.Init(context.Background())
+	t.Logf("Error (expected): %v", err)
+	if err == nil || !strings.Contains(err.Error(), "after 3 attempts") {
+		t.Errorf("discovery did not fail as expected")
+	}
+}
+
+func TestMatchSubject(t *testing.T) {
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/userinfo" {
+			if r.Header.Get("Authorization") != "Bearer access" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			fmt.Fprint(w, `{"sub":"abc","employee_id":"1234"}`)
+			return
+		}
+		fmt.Fprintf(w, `{"issuer":%q,"authorization_endpoint":"%[1]s/auth","token_endpoint":"%[1]s/token","jwks_uri":"%[1]s/keys","userinfo_endpoint":"%[1]s/userinfo"}`, server.URL)
+	}))
+	defer server.Close()
+	app := &OpenIDC{Issuer: server.URL, ClientID: "XXXXXXXX"}
+	err := app.Init(context.Background())
+	if err != nil {
+		t.Fatalf("discovery failed: %v", err)
+	}
+	ctx := context.Background()
+	token := &oauth2.Token{AccessToken: "access", TokenType: "Bearer"}
+	idToken := &oidc.IDToken{Subject: "abc"}
+
+	if ok, err := app.MatchSubject(ctx, token, idToken, "abc"); !ok || err != nil {
+		t.Errorf("ID token subject did not match: %v", err)
+	}
+	if ok, _ := app.MatchSubject(ctx, token, idToken, "1234"); ok {
+		t.Errorf("userinfo claim matched without userinfo_claim")
+	}
+	app.UserInfoClaim = "employee_id"
+	if ok, err := app.MatchSubject(ctx, token, idToken, "1234"); !ok || err != nil {
+		t.Errorf("userinfo claim did not match: %v", err)
+	}
+	if ok, _ := app.MatchSubject(ctx, token, idToken, "5678"); ok {
+		t.Errorf("wrong subject matched")
+	}
+	if ok, err := app.MatchSubject(ctx, token, &oidc.IDToken{Subject: "xyz"}, "1234"); ok || err == nil {
+		t.Errorf("userinfo for another subject matched")
+	}
+
+	// a failing endpoint fails closed
+	token.AccessToken = "expired"
+	ok, err := app.MatchSubject(ctx, token, idToken, "1234")
+	t.Logf("Error (expected): %v", err)
+	if ok || err == nil {
+		t.Errorf("userinfo claim matched though the endpoint failed")
+	}
+
+	// unless the claim was fetched within userinfo_grace
+	app.UserInfoGrace = time.Minute
+	token.AccessToken = "access"
+	if ok, err := app.MatchSubject(ctx, token, idToken, "1234"); !ok || err != nil {
+		t.Errorf("userinfo claim did not match: %v", err)
+	}
+	token.AccessToken = "expired"
+	ok, err = app.MatchSubject(ctx, token, idToken, "1234")
+	t.Logf("Error (expected): %v", err)
+	if !ok || err == nil {
+		t.Errorf("userinfo claim within userinfo_grace not used")
+	}
+	app.userInfoCache["abc"] = cachedClaim{value: "1234", fetched: time.Now().Add(-2 * time.Minute)}
+	if ok, _ := app.MatchSubject(ctx, token, idToken, "1234"); ok {
+		t.Errorf("userinfo claim older than userinfo_grace used")
+	}
+}
+
+func TestCodeToIDTokenMissing(t *testing.T) {
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" {
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprint(w, `{"access_token":"access","token_type":"Bearer","expires_in":3600}`)
+			return
+		}
+		fmt.Fprintf(w, `{"issuer":%q,"authorization_endpoint":"%[1]s/auth","token_endpoint":"%[1]s/token","jwks_uri":"%[1]s/keys"}`, server.URL)
+	}))
+	defer server.Close()
+	app := &OpenIDC{Issuer: server.URL, ClientID: "XXXXXXXX"}
+	err := app.Init(context.Background())
+	if err != nil {
+		t.Fatalf("discovery failed: %v", err)
+	}
+	req, err := app.NewAuthRequest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	idToken, token, err := app.CodeToIDToken(context.Background(), req, "code")
+	t.Logf("Error (expected): %v", err)
+	if err == nil || idToken != nil || token != nil {
+		t.Errorf("token response without id_token accepted")
+	}
+}
+
+func TestOpenIDCCheck(t *testing.T) {
+	for _, app := range []*OpenIDC{
+		{Issuer: "https://accounts.google.com", ClientID: "XXXXXXXX"},
+		{Issuer: "http://127.0.0.1:5556", ClientID: "XXXXXXXX", RedirectURL: "http://localhost:8080/"},
+		{Issuer: "https://idp.example.com", ClientID: "XXXXXXXX", ClientSecret: "XXXXXXXX", RedirectURL: "https://ca.example.com/callback"},
+	} {
+		if err := app.check(); err != nil {
+			t.Errorf("valid oidc settings %+v refused: %v", app, err)
+		}
+	}
+
+	app := &OpenIDC{Issuer: "http://idp.example.com", RedirectURL: "https://ca.example.com/callback", DiscoveryAttempts: -1}
+	err := app.check()
+	t.Logf("Error (expected): %v", err)
+	if err == nil {
+		t.Fatalf("invalid oidc settings passed")
+	}
+	for _, problem := range []string{"issuer", "client_id", "client_secret", "discovery_attempts"} {
+		if !strings.Contains(err.Error(), problem) {
+			t.Errorf("%s problem not reported", problem)
+		}
+	}
+	app = &OpenIDC{Issuer: "https://idp.example.com", ClientID: "XXXXXXXX", RedirectURL: "callback"}
+	if err = app.check(); err == nil {
+		t.Errorf("relative redirect_url passed")
+	}
+}
+
+func TestClaimedUsername(t *testing.T) {
+	app := &OpenIDC{UsernameClaim: "email", AllowedDomains: []string{"example.com"}}
+	name, err := app.claimedUsername(map[string]interface{}{"email": "jane.doe@Example.COM", "email_verified": true})
+	if err != nil || name != "jane.doe" {
+		t.Errorf("unexpected username %q: %v", name, err)
+	}
+	for _, claims := range []map[string]interface{}{
+		{},
+		{"email": "jane@example.org"},
+		{"email": "jane@example.com", "email_verified": false},
+		{"email": "jane@example.com"},
+		{"email": "jane"},
+		{"email": "-rf*@example.com"},
+	} {
+		_, err := app.claimedUsername(claims)
+		t.Logf("Error (expected): %v", err)
+		if err == nil {
+			t.Errorf("claims %v accepted", claims)
+		}
+	}
+
+	app = &OpenIDC{UsernameClaim: "preferred_username", AllowedUsernames: []string{"jdoe"}}
+	name, err = app.claimedUsername(map[string]interface{}{"preferred_username": "jdoe"})
+	if err != nil || name != "jdoe" {
+		t.Errorf("unexpected username %q: %v", name, err)
+	}
+	if _, err = app.claimedUsername(map[string]interface{}{"preferred_username": "mallory"}); err == nil {
+		t.Errorf("username not in allowed_usernames accepted")
+	}
+}
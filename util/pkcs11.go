@@ -0,0 +1,216 @@
+//go:build pkcs11
+// +build pkcs11
+
+package util
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"github.com/miekg/pkcs11"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"math/big"
+	"sync"
+)
+
+// DigestInfo prefixes for PKCS#1 v1.5 signatures, which the token expects
+// to be prepended to the digest when using CKM_RSA_PKCS
+var pkcs1Prefix = map[crypto.Hash][]byte{
+	crypto.SHA1:   {0x30, 0x21, 0x30, 0x09, 0x06, 0x05, 0x2b, 0x0e, 0x03, 0x02, 0x1a, 0x05, 0x00, 0x04, 0x14},
+	crypto.SHA256: {0x30, 0x31, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x01, 0x05, 0x00, 0x04, 0x20},
+	crypto.SHA512: {0x30, 0x51, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x03, 0x05, 0x00, 0x04, 0x40},
+}
+
+// Curves by the DER encoding of their OID in CKA_EC_PARAMS
+var pkcs11Curves = map[string]elliptic.Curve{
+	string([]byte{0x06, 0x08, 0x2a, 0x86, 0x48, 0xce, 0x3d, 0x03, 0x01, 0x07}): elliptic.P256(),
+	string([]byte{0x06, 0x05, 0x2b, 0x81, 0x04, 0x00, 0x22}):                   elliptic.P384(),
+	string([]byte{0x06, 0x05, 0x2b, 0x81, 0x04, 0x00, 0x23}):                   elliptic.P521(),
+}
+
+// A crypto.Signer whose private key is held in a PKCS#11 token
+type pkcs11Signer struct {
+	mu      sync.Mutex // a session may only be used by one thread
+	ctx     *pkcs11.Ctx
+	session pkcs11.SessionHandle
+	key     pkcs11.ObjectHandle
+	pub     crypto.PublicKey
+}
+
+// Log in to the PKCS#11 token given in the uri and return an ssh.Signer
+// for the private key labelled uri.Object. The token session is held
+// open for as long as the signer is in use.
+func LoadPKCS11Signer(uri *PKCS11URI) (ssh.Signer, error) {
+	ctx := pkcs11.New(uri.ModulePath)
+	if ctx == nil {
+		return nil, fmt.Errorf("could not load pkcs11 module %s", uri.ModulePath)
+	}
+	err := ctx.Initialize()
+	if err != nil {
+		return nil, err
+	}
+	slot, err := findPKCS11Slot(ctx, uri)
+	if err != nil {
+		return nil, err
+	}
+	session, err := ctx.OpenSession(slot, pkcs11.CKF_SERIAL_SESSION)
+	if err != nil {
+		return nil, err
+	}
+	err = ctx.Login(session, pkcs11.CKU_USER, uri.PIN)
+	if err != nil {
+		ctx.CloseSession(session)
+		return nil, fmt.Errorf("pkcs11 login failed: %s", err)
+	}
+
+	s := &pkcs11Signer{ctx: ctx, session: session}
+	s.key, err = s.findObject(pkcs11.CKO_PRIVATE_KEY, uri.Object)
+	if err == nil {
+		s.pub, err = s.publicKey(uri.Object)
+	}
+	if err != nil {
+		ctx.CloseSession(session)
+		return nil, err
+	}
+	return ssh.NewSignerFromSigner(s)
+}
+
+// find the slot named by the uri, or the first with a token present
+func findPKCS11Slot(ctx *pkcs11.Ctx, uri *PKCS11URI) (uint, error) {
+	slots, err := ctx.GetSlotList(true)
+	if err != nil {
+		return 0, err
+	}
+	for _, slot := range slots {
+		if uri.SlotID != nil && *uri.SlotID != slot {
+			continue
+		}
+		if uri.Token != "" {
+			info, err := ctx.GetTokenInfo(slot)
+			if err != nil || info.Label != uri.Token {
+				continue
+			}
+		}
+		return slot, nil
+	}
+	return 0, errors.New("no matching pkcs11 slot with a token present")
+}
+
+func (s *pkcs11Signer) findObject(class uint, label string) (pkcs11.ObjectHandle, error) {
+	template := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, class),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, label),
+	}
+	err := s.ctx.FindObjectsInit(s.session, template)
+	if err != nil {
+		return 0, err
+	}
+	objs, _, err := s.ctx.FindObjects(s.session, 1)
+	s.ctx.FindObjectsFinal(s.session)
+	if err != nil {
+		return 0, err
+	}
+	if len(objs) == 0 {
+		return 0, fmt.Errorf("pkcs11 object %s not found", label)
+	}
+	return objs[0], nil
+}
+
+// read the public half of the key from the token
+func (s *pkcs11Signer) publicKey(label string) (crypto.PublicKey, error) {
+	obj, err := s.findObject(pkcs11.CKO_PUBLIC_KEY, label)
+	if err != nil {
+		return nil, err
+	}
+	attrs, err := s.ctx.GetAttributeValue(s.session, obj, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, nil),
+	})
+	if err != nil {
+		return nil, err
+	}
+	switch keyType := attrs[0].Value; {
+	case bytes.Equal(keyType, pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_RSA).Value):
+		attrs, err = s.ctx.GetAttributeValue(s.session, obj, []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_MODULUS, nil),
+			pkcs11.NewAttribute(pkcs11.CKA_PUBLIC_EXPONENT, nil),
+		})
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(attrs[0].Value),
+			E: int(new(big.Int).SetBytes(attrs[1].Value).Int64()),
+		}, nil
+	case bytes.Equal(keyType, pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_EC).Value):
+		attrs, err = s.ctx.GetAttributeValue(s.session, obj, []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, nil),
+			pkcs11.NewAttribute(pkcs11.CKA_EC_POINT, nil),
+		})
+		if err != nil {
+			return nil, err
+		}
+		curve, ok := pkcs11Curves[string(attrs[0].Value)]
+		if !ok {
+			return nil, errors.New("unsupported pkcs11 ec curve")
+		}
+		// the point is wrapped in a DER octet string
+		var point []byte
+		_, err = asn1.Unmarshal(attrs[1].Value, &point)
+		if err != nil {
+			return nil, err
+		}
+		x, y := elliptic.Unmarshal(curve, point)
+		if x == nil {
+			return nil, errors.New("invalid pkcs11 ec point")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, errors.New("unsupported pkcs11 key type")
+}
+
+func (s *pkcs11Signer) Public() crypto.PublicKey {
+	return s.pub
+}
+
+// Sign the digest on the token
+func (s *pkcs11Signer) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	var mechanism uint
+	data := digest
+	switch s.pub.(type) {
+	case *rsa.PublicKey:
+		prefix, ok := pkcs1Prefix[opts.HashFunc()]
+		if !ok {
+			return nil, fmt.Errorf("unsupported hash for pkcs11 rsa signature: %v", opts.HashFunc())
+		}
+		mechanism = pkcs11.CKM_RSA_PKCS
+		data = append(append([]byte{}, prefix...), digest...)
+	case *ecdsa.PublicKey:
+		mechanism = pkcs11.CKM_ECDSA
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := s.ctx.SignInit(s.session, []*pkcs11.Mechanism{pkcs11.NewMechanism(mechanism, nil)}, s.key)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := s.ctx.Sign(s.session, data)
+	if err != nil {
+		return nil, err
+	}
+	if mechanism == pkcs11.CKM_ECDSA {
+		// the token returns r||s, crypto.Signer returns ASN.1
+		half := len(sig) / 2
+		return asn1.Marshal(struct{ R, S *big.Int }{
+			new(big.Int).SetBytes(sig[:half]),
+			new(big.Int).SetBytes(sig[half:]),
+		})
+	}
+	return sig, nil
+}
@@ -0,0 +1,14 @@
+//go:build !pkcs11
+// +build !pkcs11
+
+package util
+
+import (
+	"errors"
+	"golang.org/x/crypto/ssh"
+)
+
+// PKCS#11 support needs cgo, so is only built with -tags pkcs11
+func LoadPKCS11Signer(uri *PKCS11URI) (ssh.Signer, error) {
+	return nil, errors.New("pkcs11 support not built in, rebuild with -tags pkcs11")
+}
@@ -0,0 +1,110 @@
+package util
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// The parts of a PKCS#11 URI (RFC 7512) used to locate a signing key, e.g.
+// pkcs11:slot-id=0;object=ca-key?module-path=/usr/lib/softhsm/libsofthsm2.so
+type PKCS11URI struct {
+	ModulePath string
+	SlotID     *uint
+	Token      string
+	Object     string
+	PIN        string
+}
+
+// Report whether s looks like a PKCS#11 URI rather than a file name
+func IsPKCS11URI(s string) bool {
+	return strings.HasPrefix(s, "pkcs11:")
+}
+
+// Parse a PKCS#11 URI. The module-path and object attributes are
+// required; the key is searched for in the given slot-id or token, or
+// else in the first slot with a token present. The PIN may be given as
+// pin-value, otherwise it is left empty for the caller to prompt for.
+func ParsePKCS11URI(s string) (*PKCS11URI, error) {
+	if !IsPKCS11URI(s) {
+		return nil, fmt.Errorf("not a pkcs11 uri: %s", s)
+	}
+	s = strings.TrimPrefix(s, "pkcs11:")
+	path, query := s, ""
+	if i := strings.IndexByte(s, '?'); i >= 0 {
+		path, query = s[:i], s[i+1:]
+	}
+
+	u := &PKCS11URI{}
+	attrs, err := splitPKCS11Attrs(path, ";")
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range attrs {
+		switch k {
+		case "slot-id":
+			id, err := strconv.ParseUint(v, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid pkcs11 slot-id %q", v)
+			}
+			slot := uint(id)
+			u.SlotID = &slot
+		case "token":
+			u.Token = v
+		case "object":
+			u.Object = v
+		case "type":
+			if v != "private" {
+				return nil, fmt.Errorf("pkcs11 object type must be private, not %q", v)
+			}
+		default:
+			return nil, fmt.Errorf("unsupported pkcs11 attribute %s", k)
+		}
+	}
+	attrs, err = splitPKCS11Attrs(query, "&")
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range attrs {
+		switch k {
+		case "module-path":
+			u.ModulePath = v
+		case "pin-value":
+			u.PIN = v
+		default:
+			return nil, fmt.Errorf("unsupported pkcs11 query attribute %s", k)
+		}
+	}
+
+	if u.ModulePath == "" {
+		return nil, fmt.Errorf("pkcs11 uri has no module-path")
+	}
+	if u.Object == "" {
+		return nil, fmt.Errorf("pkcs11 uri has no object (key label)")
+	}
+	return u, nil
+}
+
+// split percent-encoded name=value pairs separated by sep
+func splitPKCS11Attrs(s string, sep string) (map[string]string, error) {
+	attrs := map[string]string{}
+	if s == "" {
+		return attrs, nil
+	}
+	for _, pair := range strings.Split(s, sep) {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid pkcs11 attribute %q", pair)
+		}
+		v, err := url.PathUnescape(kv[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid pkcs11 attribute %q: %s", pair, err)
+		}
+		if _, ok := attrs[kv[0]]; ok {
+			return nil, fmt.Errorf("duplicate pkcs11 attribute %s", kv[0])
+		}
+		attrs[kv[0]] = v
+	}
+	return attrs, nil
+}
@@ -0,0 +1,37 @@
+package util
+
+import (
+	"testing"
+)
+
+func TestPKCS11URI(t *testing.T) {
+	uri, err := ParsePKCS11URI("pkcs11:slot-id=2;object=my%20ca?module-path=/usr/lib/softhsm/libsofthsm2.so&pin-value=1234")
+	if err != nil {
+		t.Fatalf("could not parse pkcs11 uri: %v", err)
+	}
+	if uri.SlotID == nil || *uri.SlotID != 2 {
+		t.Errorf("wrong slot-id")
+	}
+	if uri.Object != "my ca" {
+		t.Errorf("wrong object %q", uri.Object)
+	}
+	if uri.ModulePath != "/usr/lib/softhsm/libsofthsm2.so" || uri.PIN != "1234" {
+		t.Errorf("wrong query attributes %+v", uri)
+	}
+}
+
+func TestPKCS11URIInvalid(t *testing.T) {
+	for _, s := range []string{
+		"/path/to/ca",
+		"pkcs11:object=ca",
+		"pkcs11:slot-id=0?module-path=/lib/p11.so",
+		"pkcs11:slot-id=x;object=ca?module-path=/lib/p11.so",
+		"pkcs11:object=ca;colour=red?module-path=/lib/p11.so",
+	} {
+		_, err := ParsePKCS11URI(s)
+		t.Logf("Error (expected): %v", err)
+		if err == nil {
+			t.Errorf("invalid pkcs11 uri %s accepted", s)
+		}
+	}
+}
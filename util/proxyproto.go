@@ -0,0 +1,134 @@
+package util
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// PROXY protocol version 2 signature, see
+// https://www.haproxy.org/download/2.0/doc/proxy-protocol.txt
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// the longest version 1 header, including the CRLF
+const proxyV1MaxLength = 107
+
+// A connection whose remote address was given by a PROXY protocol header
+type proxyConn struct {
+	net.Conn
+	r          *bufio.Reader
+	remoteAddr net.Addr
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+// Read a PROXY protocol version 1 or 2 header from conn, returning a
+// connection which reports the client address from the header as its
+// remote address. Headers for health checks from the proxy itself (LOCAL
+// or UNKNOWN) leave the remote address unchanged. A missing or malformed
+// header is an error.
+func ReadProxyHeader(conn net.Conn) (net.Conn, error) {
+	r := bufio.NewReader(conn)
+	sig, err := r.Peek(len(proxyV2Signature))
+	if err != nil {
+		return nil, fmt.Errorf("reading proxy header: %s", err)
+	}
+	var addr net.Addr
+	if bytes.Equal(sig, proxyV2Signature) {
+		addr, err = readProxyV2(r)
+	} else if bytes.HasPrefix(sig, []byte("PROXY ")) {
+		addr, err = readProxyV1(r)
+	} else {
+		err = errors.New("no proxy header")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if addr == nil {
+		addr = conn.RemoteAddr()
+	}
+	return &proxyConn{Conn: conn, r: r, remoteAddr: addr}, nil
+}
+
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for len(line) < proxyV1MaxLength {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("reading proxy header: %s", err)
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("proxy header too long or not terminated by CRLF")
+	}
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("malformed proxy header %q", line)
+	}
+	ip := net.ParseIP(fields[2])
+	if ip == nil || (fields[1] == "TCP4") != (ip.To4() != nil) {
+		return nil, fmt.Errorf("invalid source address in proxy header %q", line)
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid source port in proxy header %q", line)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	hdr := make([]byte, len(proxyV2Signature)+4)
+	_, err := io.ReadFull(r, hdr)
+	if err != nil {
+		return nil, fmt.Errorf("reading proxy header: %s", err)
+	}
+	verCmd, family := hdr[12], hdr[13]
+	body := make([]byte, binary.BigEndian.Uint16(hdr[14:16]))
+	_, err = io.ReadFull(r, body)
+	if err != nil {
+		return nil, fmt.Errorf("reading proxy header: %s", err)
+	}
+	if verCmd>>4 != 2 {
+		return nil, fmt.Errorf("unsupported proxy header version %d", verCmd>>4)
+	}
+	switch verCmd & 0x0f {
+	case 0: // LOCAL
+		return nil, nil
+	case 1: // PROXY
+	default:
+		return nil, fmt.Errorf("unsupported proxy header command %d", verCmd&0x0f)
+	}
+	switch family {
+	case 0x11: // TCP over IPv4
+		if len(body) < 12 {
+			return nil, errors.New("short proxy header address block")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:10]))}, nil
+	case 0x21: // TCP over IPv6
+		if len(body) < 36 {
+			return nil, errors.New("short proxy header address block")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:34]))}, nil
+	}
+	// other families, such as unix sockets, carry no usable address
+	return nil, nil
+}
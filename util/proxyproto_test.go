@@ -0,0 +1,62 @@
+package util
+
+import (
+	"io/ioutil"
+	"net"
+	"testing"
+)
+
+// Write data to one end of a pipe and read the proxy header from the other
+func proxyPipe(t *testing.T, data []byte) (net.Conn, error) {
+	client, server := net.Pipe()
+	go func() {
+		client.Write(data)
+		client.Close()
+	}()
+	return ReadProxyHeader(server)
+}
+
+func TestProxyHeaderV1(t *testing.T) {
+	conn, err := proxyPipe(t, []byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 22\r\nSSH-2.0-test\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conn.RemoteAddr().String() != "192.0.2.1:56324" {
+		t.Errorf("unexpected remote address %s", conn.RemoteAddr())
+	}
+	rest, _ := ioutil.ReadAll(conn)
+	if string(rest) != "SSH-2.0-test\r\n" {
+		t.Errorf("unexpected data after header %q", rest)
+	}
+}
+
+func TestProxyHeaderV2(t *testing.T) {
+	hdr := append([]byte{}, proxyV2Signature...)
+	hdr = append(hdr, 0x21, 0x21, 0, 36)
+	ip := net.ParseIP("2001:db8::1")
+	hdr = append(hdr, ip...)
+	hdr = append(hdr, net.ParseIP("2001:db8::2")...)
+	hdr = append(hdr, 0xdc, 0x04, 0, 22)
+	conn, err := proxyPipe(t, append(hdr, []byte("SSH-2.0-test\r\n")...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conn.RemoteAddr().String() != "[2001:db8::1]:56324" {
+		t.Errorf("unexpected remote address %s", conn.RemoteAddr())
+	}
+}
+
+func TestProxyHeaderInvalid(t *testing.T) {
+	for _, data := range []string{
+		"SSH-2.0-test\r\n",
+		"PROXY TCP4 192.0.2.1 198.51.100.1 56324\r\n",
+		"PROXY TCP4 2001:db8::1 198.51.100.1 56324 22\r\n",
+		"PROXY TCP4 192.0.2.1 198.51.100.1 56324 22\n",
+	} {
+		_, err := proxyPipe(t, []byte(data))
+		t.Logf("Error (expected): %v", err)
+		if err == nil {
+			t.Errorf("invalid proxy header %q accepted", data)
+		}
+	}
+}
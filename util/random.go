@@ -0,0 +1,52 @@
+package util
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// Devices opened as random sources, kept open for the life of the process
+// so that reloading the settings does not reopen them
+var (
+	randomSourcesMu sync.Mutex
+	randomSources   = map[string]io.Reader{}
+)
+
+// Return the reader for a random_source setting. An empty value or
+// "system" selects crypto/rand; anything else must be the path of a
+// character device, such as one provided by a FIPS-validated generator.
+// Regular files are refused since their contents are predictable.
+func openRandomSource(source string) (io.Reader, error) {
+	if source == "" || source == "system" {
+		return rand.Reader, nil
+	}
+
+	randomSourcesMu.Lock()
+	defer randomSourcesMu.Unlock()
+	if r, ok := randomSources[source]; ok {
+		return r, nil
+	}
+
+	fi, err := os.Stat(source)
+	if err != nil {
+		return nil, err
+	}
+	if fi.Mode()&os.ModeCharDevice == 0 {
+		return nil, fmt.Errorf("random_source %s is not a character device", source)
+	}
+	f, err := os.Open(source)
+	if err != nil {
+		return nil, err
+	}
+	// check the device can actually be read
+	_, err = io.ReadFull(f, make([]byte, 16))
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("random_source %s could not be read: %s", source, err)
+	}
+	randomSources[source] = f
+	return f, nil
+}
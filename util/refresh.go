@@ -0,0 +1,154 @@
+package util
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	oidc "github.com/coreos/go-oidc"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/oauth2"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// The shortest refresh_token_key accepted
+const minRefreshTokenKey = 16
+
+// Refresh tokens kept on disk, each encrypted with AES-GCM under a key
+// derived from refresh_token_key. A token is stored for a user and one of
+// their ssh public keys, so that it is only used once the client has
+// proved it holds that key.
+type refreshStore struct {
+	dir  string
+	aead cipher.AEAD
+}
+
+func newRefreshStore(dir, secret string) (*refreshStore, error) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, fmt.Errorf("refresh_token_dir: %s", err)
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("refresh_token_dir %s is not a directory", dir)
+	}
+	key := sha256.Sum256([]byte(secret))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &refreshStore{dir: dir, aead: aead}, nil
+}
+
+// The file holding the token for a user and key, and the additional data
+// binding its contents to them
+func (rs *refreshStore) path(user string, key ssh.PublicKey) (string, []byte) {
+	binding := []byte(user + "\x00" + ssh.FingerprintSHA256(key))
+	sum := sha256.Sum256(binding)
+	return filepath.Join(rs.dir, hex.EncodeToString(sum[:])), binding
+}
+
+func (rs *refreshStore) save(user string, key ssh.PublicKey, token string, random io.Reader) error {
+	path, binding := rs.path(user, key)
+	nonce := make([]byte, rs.aead.NonceSize())
+	if _, err := io.ReadFull(random, nonce); err != nil {
+		return err
+	}
+	sealed := rs.aead.Seal(nonce, nonce, []byte(token), binding)
+	return writeFileAtomic(path, sealed, 0600)
+}
+
+func (rs *refreshStore) load(user string, key ssh.PublicKey) (string, error) {
+	path, binding := rs.path(user, key)
+	sealed, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < rs.aead.NonceSize() {
+		return "", fmt.Errorf("refresh token file %s is too short", path)
+	}
+	nonce, ciphertext := sealed[:rs.aead.NonceSize()], sealed[rs.aead.NonceSize():]
+	token, err := rs.aead.Open(nil, nonce, ciphertext, binding)
+	if err != nil {
+		return "", fmt.Errorf("refresh token file %s could not be decrypted", path)
+	}
+	return string(token), nil
+}
+
+func (rs *refreshStore) remove(user string, key ssh.PublicKey) {
+	path, _ := rs.path(user, key)
+	os.Remove(path)
+}
+
+// Report whether refresh tokens are kept, to log users in again without
+// the full oidc flow
+func (app *OpenIDC) RefreshEnabled() bool {
+	return app.refresh != nil
+}
+
+// Keep a refresh token, if there is one, for the user, to be used when
+// they next connect with key
+func (app *OpenIDC) SaveRefreshToken(user string, key ssh.PublicKey, refreshToken string) error {
+	if app.refresh == nil || refreshToken == "" {
+		return nil
+	}
+	return app.refresh.save(user, key, refreshToken, app.randomReader())
+}
+
+// Report whether a refresh token is kept for the user and key
+func (app *OpenIDC) HasRefreshToken(user string, key ssh.PublicKey) bool {
+	if app.refresh == nil {
+		return false
+	}
+	path, _ := app.refresh.path(user, key)
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// Obtain a new ID token for the user with the refresh token kept for them
+// and key. If the provider refuses it, as when it has expired or been
+// revoked, it is forgotten, and the user must log in with the full flow.
+func (app *OpenIDC) RefreshIDToken(ctx context.Context, user string, key ssh.PublicKey) (*oidc.IDToken, *oauth2.Token, error) {
+	if app.refresh == nil {
+		return nil, nil, fmt.Errorf("refresh tokens are not enabled")
+	}
+	refreshToken, err := app.refresh.load(user, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	expired := &oauth2.Token{RefreshToken: refreshToken, Expiry: time.Now().Add(-time.Minute)}
+	token, err := app.oauth2.TokenSource(ctx, expired).Token()
+	if err != nil {
+		if _, rejected := err.(*oauth2.RetrieveError); rejected {
+			app.refresh.remove(user, key)
+		}
+		return nil, nil, err
+	}
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		app.refresh.remove(user, key)
+		return nil, nil, fmt.Errorf("refresh token response has no id_token")
+	}
+	idToken, err := app.verifier.Verify(ctx, rawIDToken)
+	if err != nil {
+		app.refresh.remove(user, key)
+		return nil, nil, err
+	}
+	// the provider may have issued a new refresh token in place of the old
+	if token.RefreshToken != refreshToken {
+		err = app.refresh.save(user, key, token.RefreshToken, app.randomReader())
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return idToken, token, nil
+}
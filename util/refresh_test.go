@@ -0,0 +1,95 @@
+package util
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"golang.org/x/crypto/ssh"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func testPublicKey(t *testing.T) ssh.PublicKey {
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestRefreshStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "refresh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	key, other := testPublicKey(t), testPublicKey(t)
+
+	app := testOpenIDC()
+	app.refresh, err = newRefreshStore(dir, "0123456789abcdef")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if app.HasRefreshToken("jane", key) {
+		t.Errorf("refresh token found before one was kept")
+	}
+	err = app.SaveRefreshToken("jane", key, "refresh-jane")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !app.HasRefreshToken("jane", key) || app.HasRefreshToken("jane", other) || app.HasRefreshToken("john", key) {
+		t.Errorf("refresh token not kept for just jane and her key")
+	}
+	token, err := app.refresh.load("jane", key)
+	if err != nil || token != "refresh-jane" {
+		t.Errorf("unexpected refresh token %q: %v", token, err)
+	}
+
+	wrong, err := newRefreshStore(dir, "fedcba9876543210")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = wrong.load("jane", key)
+	t.Logf("Error (expected): %v", err)
+	if err == nil {
+		t.Errorf("refresh token decrypted with the wrong key")
+	}
+
+	// a refresh token the provider refuses is forgotten
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error":"invalid_grant"}`))
+	}))
+	defer server.Close()
+	app.oauth2.Endpoint.TokenURL = server.URL + "/token"
+	_, _, err = app.RefreshIDToken(context.Background(), "jane", key)
+	t.Logf("Error (expected): %v", err)
+	if err == nil {
+		t.Errorf("refused refresh token passed")
+	}
+	if app.HasRefreshToken("jane", key) {
+		t.Errorf("refused refresh token not forgotten")
+	}
+}
+
+func TestRefreshSettings(t *testing.T) {
+	app := &OpenIDC{Issuer: "https://accounts.google.com", ClientID: "XXXXXXXX", RefreshTokens: true, RefreshTokenKey: "short"}
+	err := app.check()
+	t.Logf("Error (expected): %v", err)
+	if err == nil {
+		t.Errorf("refresh_tokens without refresh_token_dir and a long key passed")
+	}
+	app.RefreshTokenDir = "/var/lib/sshtokenca/refresh"
+	app.RefreshTokenKey = "0123456789abcdef"
+	if err = app.check(); err != nil {
+		t.Errorf("unexpected error with refresh_tokens: %v", err)
+	}
+}
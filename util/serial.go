@@ -0,0 +1,20 @@
+package util
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// The serial number of the last certificate issued. This is seeded from
+// the startup time so that serials keep increasing across restarts.
+var lastSerial = uint64(time.Now().UnixNano())
+
+// Return a new certificate serial number
+func NextSerial() uint64 {
+	return atomic.AddUint64(&lastSerial, 1)
+}
+
+// Return the serial number of the last certificate issued
+func LastSerial() uint64 {
+	return atomic.LoadUint64(&lastSerial)
+}
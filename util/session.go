@@ -0,0 +1,112 @@
+package util
+
+import (
+	"errors"
+	"golang.org/x/crypto/ssh"
+	"strings"
+	"time"
+)
+
+// What a client asked for on a session channel up to starting a shell or
+// running a command. OpenSSH may first ask to forward its agent, for a
+// pty, to set environment variables and to change the window size, in
+// any order.
+type SessionStart struct {
+	Agent    bool              // whether the client asked to forward its agent
+	Pty      bool              // whether the client asked for a pty
+	Env      map[string]string // the environment variables set and accepted
+	Shell    bool              // true for a shell, false for a command
+	Command  string            // the command, if not a shell
+	Requests []string          // the types of all the requests, in order
+}
+
+var ErrSessionClosed = errors.New("session closed before a shell or command was started")
+var ErrSessionTimeout = errors.New("session timed out before a shell or command was started")
+
+// Reply to the requests on a session channel until the client starts a
+// shell or runs a command, returning what it asked for. Environment
+// variables are accepted if acceptEnv allows them, as sshd's AcceptEnv
+// does, and other requests such as for X11 forwarding or a subsystem are
+// refused. Gives up if reqs is closed or once limit passes.
+func AwaitSessionStart(reqs <-chan *ssh.Request, limit <-chan time.Time, acceptEnv func(name string) bool) (*SessionStart, error) {
+	start := &SessionStart{Env: map[string]string{}}
+	for {
+		var req *ssh.Request
+		select {
+		case req = <-reqs:
+		case <-limit:
+			return nil, ErrSessionTimeout
+		}
+		if req == nil {
+			return nil, ErrSessionClosed
+		}
+		start.Requests = append(start.Requests, req.Type)
+		ok := false
+		switch req.Type {
+		case "auth-agent-req@openssh.com":
+			start.Agent, ok = true, true
+		case "pty-req":
+			start.Pty, ok = true, true
+		case "window-change":
+			ok = true
+		case "env":
+			name, value, err := envRequest(req.Payload)
+			if err == nil && acceptEnv(name) {
+				start.Env[name] = value
+				ok = true
+			}
+		case "shell":
+			start.Shell, ok = true, true
+		case "exec":
+			command, err := ExecCommand(req.Payload)
+			if err != nil {
+				if req.WantReply {
+					req.Reply(false, nil)
+				}
+				return nil, err
+			}
+			start.Command, ok = command, true
+		}
+		if req.WantReply {
+			req.Reply(ok, nil)
+		}
+		if req.Type == "shell" || req.Type == "exec" {
+			return start, nil
+		}
+	}
+}
+
+// Reply to the requests on a session channel once its shell or command
+// has started, until the channel is closed: window size changes are
+// accepted, and anything else, such as a second shell, is refused.
+func ServeSessionRequests(reqs <-chan *ssh.Request) {
+	for req := range reqs {
+		if req.WantReply {
+			req.Reply(req.Type == "window-change", nil)
+		}
+	}
+}
+
+// Parse the command from an "exec" request payload
+// https://tools.ietf.org/html/rfc4254#section-6.5
+func ExecCommand(payload []byte) (string, error) {
+	var exec struct {
+		Command string
+	}
+	err := ssh.Unmarshal(payload, &exec)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(exec.Command), nil
+}
+
+// Parse an "env" request payload
+// https://tools.ietf.org/html/rfc4254#section-6.4
+func envRequest(payload []byte) (string, string, error) {
+	var env struct {
+		Name  string
+		Value string
+	}
+	err := ssh.Unmarshal(payload, &env)
+	return env.Name, env.Value, err
+}
@@ -0,0 +1,181 @@
+package util
+
+import (
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"net"
+	"testing"
+	"time"
+)
+
+// Connect a client over loopback to a server which accepts one session
+// channel and passes its requests to serve, returning the client. What
+// serve returns is sent on result once the session is over.
+func sessionConnect(t *testing.T, serve func(ssh.Channel, <-chan *ssh.Request) interface{}) (*ssh.Client, chan interface{}) {
+	serverConfig := &ssh.ServerConfig{NoClientAuth: true}
+	serverConfig.AddHostKey(testKeyMatrix(t)["ed25519"])
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := make(chan interface{}, 1)
+	go func() {
+		defer listener.Close()
+		conn, err := listener.Accept()
+		if err != nil {
+			result <- err
+			return
+		}
+		sshConn, chans, reqs, err := ssh.NewServerConn(conn, serverConfig)
+		if err != nil {
+			result <- err
+			return
+		}
+		defer sshConn.Close()
+		go ssh.DiscardRequests(reqs)
+		newChan := <-chans
+		ch, chReqs, err := newChan.Accept()
+		if err != nil {
+			result <- err
+			return
+		}
+		result <- serve(ch, chReqs)
+	}()
+
+	client, err := ssh.Dial("tcp", listener.Addr().String(), &ssh.ClientConfig{
+		User:            "test",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, result
+}
+
+// Await the session start, then close the channel as a server would
+// once the shell or command has finished
+func awaitAndClose(ch ssh.Channel, reqs <-chan *ssh.Request) interface{} {
+	start, err := AwaitSessionStart(reqs, time.After(10*time.Second), func(name string) bool {
+		return name == "SSHTOKENCA_PRINCIPALS"
+	})
+	if err != nil {
+		return err
+	}
+	served := make(chan struct{})
+	go func() {
+		ServeSessionRequests(reqs)
+		close(served)
+	}()
+	ch.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{0}))
+	ch.Close()
+	<-served
+	return start
+}
+
+func TestSessionShell(t *testing.T) {
+	client, result := sessionConnect(t, awaitAndClose)
+	defer client.Close()
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the requests OpenSSH makes for ssh -A -t with SetEnv
+	err = agent.RequestAgentForwarding(session)
+	if err != nil {
+		t.Errorf("agent forwarding refused: %v", err)
+	}
+	err = session.RequestPty("xterm", 24, 80, ssh.TerminalModes{})
+	if err != nil {
+		t.Errorf("pty refused: %v", err)
+	}
+	err = session.Setenv("SSHTOKENCA_PRINCIPALS", "web,db")
+	if err != nil {
+		t.Errorf("SSHTOKENCA_PRINCIPALS refused: %v", err)
+	}
+	if err = session.Setenv("LANG", "C"); err == nil {
+		t.Errorf("LANG accepted")
+	}
+	if err = session.RequestSubsystem("sftp"); err == nil {
+		t.Errorf("subsystem accepted")
+	}
+	err = session.WindowChange(40, 100)
+	if err != nil {
+		t.Errorf("window-change failed: %v", err)
+	}
+	err = session.Shell()
+	if err != nil {
+		t.Fatalf("shell refused: %v", err)
+	}
+	// after the shell has started
+	session.WindowChange(50, 120)
+	err = session.Wait()
+	if err != nil {
+		t.Errorf("session did not end cleanly: %v", err)
+	}
+
+	start, ok := (<-result).(*SessionStart)
+	if !ok {
+		t.Fatal("session did not start")
+	}
+	if !start.Agent || !start.Pty || !start.Shell || start.Command != "" {
+		t.Errorf("unexpected session start %+v", start)
+	}
+	if len(start.Env) != 1 || start.Env["SSHTOKENCA_PRINCIPALS"] != "web,db" {
+		t.Errorf("unexpected environment %v", start.Env)
+	}
+	want := []string{"auth-agent-req@openssh.com", "pty-req", "env", "env", "subsystem", "window-change", "shell"}
+	if len(start.Requests) != len(want) {
+		t.Fatalf("unexpected requests %v, want %v", start.Requests, want)
+	}
+	for i := range want {
+		if start.Requests[i] != want[i] {
+			t.Errorf("unexpected requests %v, want %v", start.Requests, want)
+			break
+		}
+	}
+}
+
+func TestSessionExec(t *testing.T) {
+	client, result := sessionConnect(t, awaitAndClose)
+	defer client.Close()
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = session.Run(" cert web1 web2 ")
+	if err != nil {
+		t.Errorf("exec did not end cleanly: %v", err)
+	}
+	start, ok := (<-result).(*SessionStart)
+	if !ok {
+		t.Fatal("session did not start")
+	}
+	if start.Shell || start.Agent || start.Pty || start.Command != "cert web1 web2" {
+		t.Errorf("unexpected session start %+v", start)
+	}
+}
+
+func TestSessionClosed(t *testing.T) {
+	client, result := sessionConnect(t, awaitAndClose)
+	defer client.Close()
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	session.RequestPty("xterm", 24, 80, ssh.TerminalModes{})
+	session.Close()
+	if err, _ := (<-result).(error); err != ErrSessionClosed {
+		t.Errorf("unexpected result %v for a session closed before starting", err)
+	}
+}
+
+func TestSessionStartTimeout(t *testing.T) {
+	reqs := make(chan *ssh.Request)
+	limit := make(chan time.Time, 1)
+	limit <- time.Now()
+	_, err := AwaitSessionStart(reqs, limit, func(string) bool { return true })
+	if err != ErrSessionTimeout {
+		t.Errorf("unexpected error %v for a session which timed out", err)
+	}
+}
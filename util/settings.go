@@ -1,22 +1,46 @@
 package util
 
 import (
+	"bytes"
 	"context"
+	"crypto/rand"
 	"errors"
 	"fmt"
 	"golang.org/x/crypto/ssh"
 	yaml "gopkg.in/yaml.v3"
+	"io"
+	"io/ioutil"
+	"net"
 	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
 	"time"
 )
 
+const defaultSessionTimeout = 2 * time.Minute
+const defaultOIDCTimeout = 30 * time.Second
+const defaultAgentTimeout = 10 * time.Second
+const defaultHostValidity = 30 * 24 * time.Hour
+const defaultCAExpiryWarning = 7 * 24 * time.Hour
+const defaultValidAfterSkew = 30 * time.Second
+const defaultMinRSABits = 2048
+const defaultMaintenanceMessage = "Certificates are not being issued while this service is under maintenance; please try again later"
+const maxValidAfterSkew = 10 * time.Minute
 const minvalidity = 1 * time.Minute
 const maxvalidity = 24 * time.Hour
 
+// Whether SettingsLoad fails if the settings refer to an unset environment
+// variable, rather than substituting an empty string
+var RequireEnv = false
+
+var envReference = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
 // Restrict the certificate extensions to those commonly supported as
 // defined at https://cvsweb.openbsd.org/src/usr.bin/ssh/PROTOCOL.certkeys?annotate=HEAD
-// Note that the extensions each (only) use an empty string for their
-// value
+// Note that these extensions each (only) use an empty string for their
+// value; those in valuedExtensions carry a value
 var permittedExtensions = map[string]string{
 	// "no-presence-required": "", // only U2F/Fido
 	"permit-agent-forwarding": "",
@@ -26,6 +50,24 @@ var permittedExtensions = map[string]string{
 	"permit-user-rc":          "",
 }
 
+// Extensions which carry a value, with the pattern it must match. GitHub
+// uses login@github.com to name the account certificates are for.
+var valuedExtensions = map[string]*regexp.Regexp{
+	"login@github.com": regexp.MustCompile(`\A[A-Za-z0-9](?:-?[A-Za-z0-9]){0,38}\z`),
+}
+
+// Client key types which may be named in accepted_key_types
+var supportedKeyTypes = []string{
+	ssh.KeyAlgoRSA,
+	ssh.KeyAlgoDSA,
+	ssh.KeyAlgoECDSA256,
+	ssh.KeyAlgoECDSA384,
+	ssh.KeyAlgoECDSA521,
+	ssh.KeyAlgoSKECDSA256,
+	ssh.KeyAlgoED25519,
+	ssh.KeyAlgoSKED25519,
+}
+
 type UserPrincipals struct {
 	Name          string   `yaml:"name"`
 	AuthorizedKey string   `yaml:"authorized_key"`
@@ -33,36 +75,158 @@ type UserPrincipals struct {
 	OIDCSubject   string   `yaml:"oidc_subject"`
 	Principals    []string `yaml:"principals,flow"`
 
+	// shell-style patterns of further principals the user may request
+	PrincipalPatterns []string `yaml:"principal_patterns,flow"`
+
+	// true to leave out the global default_principals
+	NoDefaultPrincipals bool `yaml:"no_default_principals"`
+
+	// "user", the default, or "host" for automation which presents a
+	// host key and is given host certificates
+	CertType string `yaml:"cert_type"`
+
+	// the name in ca_names of the CA key which signs the user's
+	// certificates, by default the first CA key
+	CA string `yaml:"ca"`
+
+	// overrides of the global agent settings
+	AgentLifetime time.Duration `yaml:"agent_lifetime"`
+	AgentConfirm  *bool         `yaml:"agent_confirm"`
+
+	// base32 secret of a TOTP code required in addition to the public key
+	TOTPSecret string `yaml:"totp_secret"`
+
+	// replaces the global extensions if given, even if empty
+	Extensions map[string]string `yaml:"extensions,flow"`
+
+	// false to stop issuing certificates to the user, who is still
+	// fully validated
+	Enabled *bool `yaml:"enabled"`
+
+	// RFC3339 time after which no certificates are issued to the user
+	Expires string `yaml:"expires"`
+
+	// shown to the user in place of the global banner, if given
+	Message string `yaml:"message"`
+
+	publicKeys []ssh.PublicKey
+	totpKey    []byte
+	expiry     time.Time
+}
+
+// A host whose host key may be certified, with the hostnames to be its
+// principals
+type HostPrincipals struct {
+	Name          string   `yaml:"name"`
+	AuthorizedKey string   `yaml:"authorized_key"`
+	Principals    []string `yaml:"principals,flow"`
+
 	publicKeys []ssh.PublicKey
 }
 
 type Settings struct {
-	Validity     time.Duration     `yaml:"validity"`
-	Organisation string            `yaml:"organisation"`
-	Banner       string            `yaml:"banner"`
-	Extensions   map[string]string `yaml:"extensions,flow"`
-	Users        []*UserPrincipals `yaml:"user_principals"`
-	OpenIDC      *OpenIDC          `yaml:"oidc"`
-	usersByName  map[string]*UserPrincipals
+	Validity           time.Duration       `yaml:"validity"`
+	ValidityRounding   time.Duration       `yaml:"validity_rounding"`
+	HostValidity       time.Duration       `yaml:"host_validity"`
+	ValidAfterSkew     *time.Duration      `yaml:"valid_after_skew"`
+	AgentLifetime      time.Duration       `yaml:"agent_lifetime"`
+	AgentConfirm       bool                `yaml:"agent_confirm"`
+	Organisation       string              `yaml:"organisation"`
+	Banner             string              `yaml:"banner"`
+	BannerFile         string              `yaml:"banner_file"`
+	SupportURL         string              `yaml:"support_url"`
+	CAHost             string              `yaml:"ca_host"`
+	MaintenanceMessage string              `yaml:"maintenance_message"`
+	AuditLog           string              `yaml:"audit_log"`
+	Database           string              `yaml:"database"`
+	RevokedFile        string              `yaml:"revoked_file"`
+	KRLFile            string              `yaml:"krl_file"`
+	RandomSource       string              `yaml:"random_source"`
+	SignatureAlgorithm string              `yaml:"signature_algorithm"`
+	SigningRate        float64             `yaml:"signing_rate"`
+	SigningBurst       int                 `yaml:"signing_burst"`
+	CALoadPolicy       string              `yaml:"ca_load_policy"`
+	CAExpiryWarning    time.Duration       `yaml:"ca_expiry_warning"`
+	CANames            map[string]string   `yaml:"ca_names"`
+	MinRSABits         int                 `yaml:"min_rsa_bits"`
+	MaxAttempts        int                 `yaml:"max_attempts"`
+	AttemptWindow      time.Duration       `yaml:"attempt_window"`
+	MaxConcurrent      int                 `yaml:"max_concurrent"`
+	SessionTimeout     time.Duration       `yaml:"session_timeout"`
+	OIDCTimeout        time.Duration       `yaml:"oidc_timeout"`
+	AgentTimeout       time.Duration       `yaml:"agent_timeout"`
+	ReuseRemaining     time.Duration       `yaml:"reuse_remaining"`
+	IssueCooldown      time.Duration       `yaml:"issue_cooldown"`
+	IdentifyUnknown    bool                `yaml:"identify_unknown"`
+	ListenAddress      string              `yaml:"listen_address"`
+	ListenPort         int                 `yaml:"listen_port"`
+	ProxyProtocol      bool                `yaml:"proxy_protocol"`
+	AllowedNetworks    []string            `yaml:"allowed_networks,flow"`
+	DeniedNetworks     []string            `yaml:"denied_networks,flow"`
+	ClientVersions     []string            `yaml:"allowed_client_versions"`
+	TrustedUserCAKeys  []string            `yaml:"trusted_user_ca_keys"`
+	Extensions         map[string]string   `yaml:"extensions,flow"`
+	ForbidSharedKeys   bool                `yaml:"forbid_shared_keys"`
+	AcceptedKeyTypes   []string            `yaml:"accepted_key_types,flow"`
+	AllowWildcard      bool                `yaml:"allow_wildcard_principal"`
+	DefaultPrincipals  []string            `yaml:"default_principals,flow"`
+	Users              []*UserPrincipals   `yaml:"user_principals"`
+	UsersFiles         []string            `yaml:"users_files"`
+	Hosts              []*HostPrincipals   `yaml:"host_principals"`
+	GroupPrincipals    map[string][]string `yaml:"group_principals"`
+	OpenIDC            *OpenIDC            `yaml:"oidc"`
+	Tenants            []*Tenant           `yaml:"tenants"`
+	usersByName        map[string]*UserPrincipals
+	hostsByName        map[string]*HostPrincipals
+	trustedCAKeys      []ssh.PublicKey
+	allowedNets        []*net.IPNet
+	deniedNets         []*net.IPNet
+	clientVersions     []*regexp.Regexp
+	random             io.Reader
+	fileBanner         string
 }
 
 // Load a settings yaml file into a Settings struct
 func SettingsLoad(yamlFilePath string) (Settings, error) {
+	data, err := ioutil.ReadFile(yamlFilePath)
+	if err != nil {
+		return Settings{}, err
+	}
+	return settingsParse(data, func(p string) ([]byte, error) {
+		return ioutil.ReadFile(relativePath(yamlFilePath, p))
+	})
+}
+
+// Parse settings yaml into a Settings struct. The banner_file,
+// users_files and tenants' settings_file are read with readFile.
+func settingsParse(data []byte, readFile func(p string) ([]byte, error)) (Settings, error) {
 	var s = Settings{}
 
-	file, err := os.Open(yamlFilePath)
+	data, err := expandEnv(data)
 	if err != nil {
 		return s, err
 	}
-	defer file.Close()
 
-	dec := yaml.NewDecoder(file)
+	dec := yaml.NewDecoder(bytes.NewReader(data))
 	dec.KnownFields(true)
 	err = dec.Decode(&s)
 	if err != nil {
 		return s, err
 	}
 
+	// merge in the users from users_files
+	for _, usersFile := range s.UsersFiles {
+		data, err := readFile(usersFile)
+		if err != nil {
+			return s, fmt.Errorf("users_files: %s", err)
+		}
+		users, err := usersFileParse(data)
+		if err != nil {
+			return s, fmt.Errorf("users_files: %s: %s", usersFile, err)
+		}
+		s.Users = append(s.Users, users...)
+	}
+
 	if len(s.Users) == 0 {
 		return s, errors.New("no valid users found in yaml file")
 	}
@@ -73,25 +237,177 @@ func SettingsLoad(yamlFilePath string) (Settings, error) {
 		return s, err
 	}
 
+	// read the banner file, relative to the settings file
+	if s.BannerFile != "" {
+		banner, err := readFile(s.BannerFile)
+		if err != nil {
+			return s, fmt.Errorf("banner_file: %s", err)
+		}
+		s.fileBanner = string(banner)
+	}
+
 	// build map of keys by name
 	err = s.buildNameMap()
 	if err != nil {
 		return s, err
 	}
 
+	// open the random source
+	s.random, err = openRandomSource(s.RandomSource)
+	if err != nil {
+		return s, err
+	}
+
 	// prepare OpenID
 	if s.OpenIDC != nil {
+		s.OpenIDC.random = s.random
 		err = s.OpenIDC.Init(context.Background())
 		if err != nil {
 			return s, err
 		}
 	}
 
+	err = s.loadTenants(readFile)
+	if err != nil {
+		return s, err
+	}
+
 	return s, nil
 }
 
+// Resolve a path given in the settings file relative to the directory
+// holding it
+func relativePath(yamlFilePath, p string) string {
+	if filepath.IsAbs(p) {
+		return p
+	}
+	return filepath.Join(filepath.Dir(yamlFilePath), p)
+}
+
+// Parse the user_principals from one of the users_files, which holds only
+// user_principals
+func usersFileParse(data []byte) ([]*UserPrincipals, error) {
+	var f struct {
+		Users []*UserPrincipals `yaml:"user_principals"`
+	}
+	data, err := expandEnv(data)
+	if err != nil {
+		return nil, err
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	err = dec.Decode(&f)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	return f.Users, nil
+}
+
+// Replace each ${NAME} in the values of the settings with the value of
+// the environment variable NAME. This is done to the parsed values, so
+// that a variable holding "#", ": " or a newline cannot cut short a
+// setting or add another, and the settings are then written out again to
+// be decoded. Comments and keys are left alone.
+func expandEnv(data []byte) ([]byte, error) {
+	var doc yaml.Node
+	err := yaml.Unmarshal(data, &doc)
+	if err != nil {
+		return nil, err
+	}
+	expanded := false
+	err = expandEnvNode(&doc, &expanded)
+	if err != nil || !expanded {
+		return data, err
+	}
+	return yaml.Marshal(&doc)
+}
+
+// Expand the environment variables in the scalar values under node,
+// setting expanded if there were any
+func expandEnvNode(node *yaml.Node, expanded *bool) error {
+	switch node.Kind {
+	case yaml.DocumentNode, yaml.SequenceNode:
+		for _, n := range node.Content {
+			if err := expandEnvNode(n, expanded); err != nil {
+				return err
+			}
+		}
+	case yaml.MappingNode:
+		// values only, at the odd indices
+		for i := 1; i < len(node.Content); i += 2 {
+			if err := expandEnvNode(node.Content[i], expanded); err != nil {
+				return err
+			}
+		}
+	case yaml.ScalarNode:
+		if !envReference.MatchString(node.Value) {
+			return nil
+		}
+		var err error
+		node.Value = envReference.ReplaceAllStringFunc(node.Value, func(ref string) string {
+			name := envReference.FindStringSubmatch(ref)[1]
+			value, ok := os.LookupEnv(name)
+			if !ok && RequireEnv && err == nil {
+				err = fmt.Errorf("environment variable %s is not set", name)
+			}
+			return value
+		})
+		if node.Style&(yaml.SingleQuotedStyle|yaml.DoubleQuotedStyle|yaml.LiteralStyle|yaml.FoldedStyle) == 0 {
+			// an unquoted value, such as a number, takes the type of
+			// what it expands to
+			node.Tag = ""
+		}
+		*expanded = true
+		return err
+	}
+	return nil
+}
+
+// Return the banner greeting users, from banner or banner_file
+func (s *Settings) BannerText() string {
+	if s.BannerFile != "" {
+		return s.fileBanner
+	}
+	return s.Banner
+}
+
+// Return the banner greeting a user: their own message, if they have one,
+// or else the global banner
+func (s *Settings) UserBanner(up *UserPrincipals) string {
+	if up.Message != "" {
+		return up.Message
+	}
+	return s.BannerText()
+}
+
+// Expand the placeholders in a banner: %u is the user's name, %s the
+// certificate serial, %e the certificate expiry time and %% a literal %.
+// The certificate placeholders are empty if cert is nil.
+func ExpandBanner(banner, name string, cert *ssh.Certificate) string {
+	var serial, expiry string
+	if cert != nil {
+		serial = fmt.Sprintf("%d", cert.Serial)
+		expiry = time.Unix(int64(cert.ValidBefore), 0).UTC().Format("2006-01-02T15:04MST")
+	}
+	return strings.NewReplacer("%%", "%", "%u", name, "%s", serial, "%e", expiry).Replace(banner)
+}
+
+// Report whether a banner refers to the certificate, so can only be shown
+// once the certificate is issued
+func BannerUsesCert(banner string) bool {
+	banner = strings.Replace(banner, "%%", "", -1)
+	return strings.Contains(banner, "%s") || strings.Contains(banner, "%e")
+}
+
+// The error from UserByName for an empty name, which no user can have,
+// so that a probe can be told from a mistyped name in the logs
+var ErrEmptyUsername = errors.New("empty username")
+
 // Extract a user's UserPrincipals struct
 func (s *Settings) UserByName(name string) (*UserPrincipals, error) {
+	if name == "" {
+		return nil, ErrEmptyUsername
+	}
 	var up = &UserPrincipals{}
 	up, ok := s.usersByName[name]
 	if !ok {
@@ -109,27 +425,209 @@ func (s *Settings) buildNameMap() error {
 		}
 		s.usersByName[u.Name] = u
 	}
+	s.hostsByName = map[string]*HostPrincipals{}
+	for _, h := range s.Hosts {
+		if _, ok := s.usersByName[h.Name]; ok {
+			return fmt.Errorf("host %s has the same name as a user", h.Name)
+		}
+		if _, ok := s.hostsByName[h.Name]; ok {
+			return fmt.Errorf("duplicate entry for host %s", h.Name)
+		}
+		s.hostsByName[h.Name] = h
+	}
 	return nil
 }
 
+// Extract a host's HostPrincipals struct
+func (s *Settings) HostByName(name string) (*HostPrincipals, error) {
+	h, ok := s.hostsByName[name]
+	if !ok {
+		return nil, fmt.Errorf("host %s not found", name)
+	}
+	return h, nil
+}
+
 // Validate the certificate extensions, validity period and user records
 func (s *Settings) validate() error {
 
+	if s.Banner != "" && s.BannerFile != "" {
+		return errors.New("banner and banner_file may not both be set")
+	}
+	if s.MaintenanceMessage == "" {
+		s.MaintenanceMessage = defaultMaintenanceMessage
+	}
+	if strings.Contains(s.CAHost, ":") {
+		if _, _, err := net.SplitHostPort(s.CAHost); err != nil {
+			return fmt.Errorf("ca_host: %s", err)
+		}
+	}
+
 	// check validity period
 	if s.Validity < minvalidity {
 		return fmt.Errorf("validity is below minimum validity")
 	} else if s.Validity > maxvalidity {
 		return fmt.Errorf("validity is above maximum validity")
 	}
+	if s.ValidityRounding < 0 {
+		return fmt.Errorf("validity_rounding must not be negative")
+	} else if s.ValidityRounding >= s.Validity {
+		return fmt.Errorf("validity_rounding must be less than validity")
+	}
+
+	// backdate certificates for clients whose clocks are fast, unless
+	// valid_after_skew is set to 0
+	if s.ValidAfterSkew == nil {
+		skew := defaultValidAfterSkew
+		s.ValidAfterSkew = &skew
+	} else if *s.ValidAfterSkew < 0 {
+		return errors.New("valid_after_skew must not be negative")
+	} else if *s.ValidAfterSkew > maxValidAfterSkew {
+		return fmt.Errorf("valid_after_skew must be at most %s", maxValidAfterSkew)
+	}
+
+	// check agent lifetime
+	err := s.validateAgentLifetime("agent_lifetime", s.AgentLifetime)
+	if err != nil {
+		return err
+	}
+
+	// check the signature algorithm is one we know; whether it suits
+	// the CA key is checked by NewCASigner
+	if s.SignatureAlgorithm != "" {
+		_, known := rsaSignatureAlgorithms[s.SignatureAlgorithm]
+		for _, kt := range supportedKeyTypes {
+			if kt == s.SignatureAlgorithm {
+				known = true
+			}
+		}
+		if !known {
+			return fmt.Errorf("unknown signature_algorithm %s", s.SignatureAlgorithm)
+		}
+	}
+
+	if s.CALoadPolicy != "" && s.CALoadPolicy != "all" && s.CALoadPolicy != "any" {
+		return fmt.Errorf("ca_load_policy must be all or any, not %s", s.CALoadPolicy)
+	}
+
+	if s.CAExpiryWarning < 0 {
+		return errors.New("ca_expiry_warning must not be negative")
+	} else if s.CAExpiryWarning == 0 {
+		s.CAExpiryWarning = defaultCAExpiryWarning
+	}
+
+	if s.MinRSABits < 0 {
+		return errors.New("min_rsa_bits must not be negative")
+	} else if s.MinRSABits == 0 {
+		s.MinRSABits = defaultMinRSABits
+	}
+
+	if s.SigningRate < 0 {
+		return errors.New("signing_rate must not be negative")
+	} else if s.SigningBurst < 0 {
+		return errors.New("signing_burst must not be negative")
+	}
+
+	if s.MaxAttempts < 0 {
+		return errors.New("max_attempts must not be negative")
+	} else if s.MaxAttempts > 0 && s.AttemptWindow <= 0 {
+		return errors.New("max_attempts requires a positive attempt_window")
+	}
+
+	if s.ListenAddress != "" && net.ParseIP(s.ListenAddress) == nil {
+		return fmt.Errorf("listen_address %s is not an ip address", s.ListenAddress)
+	}
+	if s.ListenPort < 0 || s.ListenPort > 65535 {
+		return fmt.Errorf("listen_port %d is not a port number", s.ListenPort)
+	}
+	if s.MaxConcurrent < 0 {
+		return errors.New("max_concurrent must not be negative")
+	}
+	if s.SessionTimeout < 0 {
+		return errors.New("session_timeout must not be negative")
+	} else if s.SessionTimeout == 0 {
+		s.SessionTimeout = defaultSessionTimeout
+	}
+	if s.OIDCTimeout < 0 {
+		return errors.New("oidc_timeout must not be negative")
+	} else if s.OIDCTimeout == 0 {
+		s.OIDCTimeout = defaultOIDCTimeout
+	}
+	if s.AgentTimeout < 0 {
+		return errors.New("agent_timeout must not be negative")
+	} else if s.AgentTimeout == 0 {
+		s.AgentTimeout = defaultAgentTimeout
+	}
+	if s.ReuseRemaining < 0 {
+		return errors.New("reuse_remaining must not be negative")
+	} else if s.ReuseRemaining >= s.Validity {
+		return errors.New("reuse_remaining must be less than validity")
+	}
+	if s.IssueCooldown < 0 {
+		return errors.New("issue_cooldown must not be negative")
+	}
+
+	// check trusted user CA keys
+	s.trustedCAKeys = nil
+	for _, line := range s.TrustedUserCAKeys {
+		keys, err := LoadAuthorizedKeysBytes([]byte(line))
+		if err != nil {
+			return fmt.Errorf("trusted_user_ca_keys: %s", err)
+		}
+		if len(keys) != 1 {
+			return fmt.Errorf("trusted_user_ca_keys: unexpected number of keys in entry (%d)", len(keys))
+		}
+		s.trustedCAKeys = append(s.trustedCAKeys, keys[0])
+	}
+
+	// check networks
+	s.allowedNets, err = parseNetworks("allowed_networks", s.AllowedNetworks)
+	if err != nil {
+		return err
+	}
+	s.deniedNets, err = parseNetworks("denied_networks", s.DeniedNetworks)
+	if err != nil {
+		return err
+	}
+	s.clientVersions = nil
+	for _, v := range s.ClientVersions {
+		re, err := regexp.Compile(v)
+		if err != nil {
+			return fmt.Errorf("allowed_client_versions %q: %s", v, err)
+		}
+		s.clientVersions = append(s.clientVersions, re)
+	}
 
 	// check extensions meet permittedExtensions
-	for k, v := range s.Extensions {
-		val, ok := permittedExtensions[k]
-		if !ok {
-			return fmt.Errorf("extension %s not permitted", k)
+	err = checkExtensions("extensions", s.Extensions)
+	if err != nil {
+		return err
+	}
+
+	// check each accepted key type pattern matches a supported key type
+	for _, pattern := range s.AcceptedKeyTypes {
+		matched := false
+		for _, kt := range supportedKeyTypes {
+			ok, err := path.Match(pattern, kt)
+			if err != nil {
+				return fmt.Errorf("invalid accepted_key_types pattern %q: %s", pattern, err)
+			}
+			if ok {
+				matched = true
+				break
+			}
 		}
-		if v != val {
-			return fmt.Errorf("value '%s' for key %s not permitted, expected %s", val, k, v)
+		if !matched {
+			return fmt.Errorf("accepted_key_types pattern %q does not match any supported key type", pattern)
+		}
+	}
+
+	if !s.AllowWildcard && (&UserPrincipals{Principals: s.DefaultPrincipals}).HasWildcardPrincipal() {
+		return errors.New("default_principals has a wildcard principal but allow_wildcard_principal is not set")
+	}
+
+	for name, fingerprint := range s.CANames {
+		if !strings.HasPrefix(fingerprint, "SHA256:") {
+			return fmt.Errorf("ca_names %s must be the SHA256 fingerprint of a CA key, not %q", name, fingerprint)
 		}
 	}
 
@@ -138,11 +636,48 @@ func (s *Settings) validate() error {
 	for _, v := range s.Users {
 		if v.Name == "" {
 			return errors.New("user provided with empty name")
-		} else if len(v.Principals) == 0 {
-			return fmt.Errorf("user %s provided with no principals", v.Name)
+		} else if len(s.UserPrincipalList(v)) == 0 && len(v.PrincipalPatterns) == 0 {
+			return fmt.Errorf("user %s provided with no principals or principal_patterns", v.Name)
 		} else if v.AuthorizedKey == "" && v.OIDCSubject == "" {
 			return fmt.Errorf("user %s has no authorized_key or oidc_subject", v.Name)
 		}
+		err := s.validateAgentLifetime(fmt.Sprintf("user %s agent_lifetime", v.Name), v.AgentLifetime)
+		if err != nil {
+			return err
+		}
+		v.expiry = time.Time{}
+		if v.Expires != "" {
+			v.expiry, err = time.Parse(time.RFC3339, v.Expires)
+			if err != nil {
+				return fmt.Errorf("user %s expires is not an RFC3339 time such as 2006-01-02T15:04:05Z: %s", v.Name, err)
+			}
+		}
+		if v.Extensions != nil {
+			err = checkExtensions(fmt.Sprintf("user %s extensions (which replace the global extensions)", v.Name), v.Extensions)
+			if err != nil {
+				return err
+			}
+		}
+		switch v.CertType {
+		case "", "user":
+		case "host":
+			if len(v.Extensions) > 0 {
+				return fmt.Errorf("user %s has cert_type host, whose certificates cannot carry extensions", v.Name)
+			}
+		default:
+			return fmt.Errorf("user %s cert_type %q is not user or host", v.Name, v.CertType)
+		}
+		if _, ok := s.CANames[v.CA]; v.CA != "" && !ok {
+			return fmt.Errorf("user %s ca %s is not in ca_names", v.Name, v.CA)
+		}
+		for _, pattern := range v.PrincipalPatterns {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("user %s principal_patterns %q: %s", v.Name, pattern, err)
+			}
+		}
+		if !s.AllowWildcard && v.HasWildcardPrincipal() {
+			return fmt.Errorf("user %s has a wildcard principal but allow_wildcard_principal is not set", v.Name)
+		}
 
 		if v.AuthorizedKey != "" {
 			keys, err := LoadAuthorizedKeysBytes([]byte(v.AuthorizedKey))
@@ -163,18 +698,452 @@ func (s *Settings) validate() error {
 			return fmt.Errorf("user %s has fingerprint but no authorized_key", v.Name)
 		}
 
+		if v.TOTPSecret != "" {
+			if v.AuthorizedKey == "" {
+				return fmt.Errorf("user %s has totp_secret but no authorized_key", v.Name)
+			}
+			key, err := decodeTOTPSecret(v.TOTPSecret)
+			if err != nil {
+				return fmt.Errorf("user %s invalid totp_secret: %s", v.Name, err)
+			}
+			v.totpKey = key
+		}
+
 		if v.OIDCSubject != "" {
 			foundOIDC = true
 		}
 	}
 
+	// check hosts
+	if s.HostValidity < 0 {
+		return errors.New("host_validity must not be negative")
+	} else if s.HostValidity == 0 {
+		s.HostValidity = defaultHostValidity
+	} else if s.HostValidity < minvalidity {
+		return fmt.Errorf("host_validity is below minimum validity")
+	}
+	for _, h := range s.Hosts {
+		if h.Name == "" {
+			return errors.New("host provided with empty name")
+		} else if len(h.Principals) == 0 {
+			return fmt.Errorf("host %s provided with no principals", h.Name)
+		}
+		keys, err := LoadAuthorizedKeysBytes([]byte(h.AuthorizedKey))
+		if err != nil {
+			return fmt.Errorf("host %s: %s", h.Name, err)
+		}
+		if len(keys) != 1 {
+			return fmt.Errorf("host %s unexpected number of keys in authorized_key entry (%d)", h.Name, len(keys))
+		}
+		h.publicKeys = keys
+	}
+
 	if foundOIDC && s.OpenIDC == nil {
 		return errors.New("oidc authorization used but oidc provider not configured")
 	}
+	if s.OpenIDC != nil && s.OpenIDC.UsernameClaim != "" {
+		if len(s.OpenIDC.DefaultPrincipals) == 0 {
+			return errors.New("oidc username_claim requires default_principals")
+		}
+		// otherwise any account at the provider would be let in
+		if len(s.OpenIDC.AllowedDomains) == 0 && len(s.OpenIDC.AllowedUsernames) == 0 {
+			return errors.New("oidc username_claim requires allowed_domains or allowed_usernames")
+		}
+		if !s.AllowWildcard && (&UserPrincipals{Principals: s.OpenIDC.DefaultPrincipals}).HasWildcardPrincipal() {
+			return errors.New("oidc default_principals has a wildcard principal but allow_wildcard_principal is not set")
+		}
+	}
+
+	groupsClaim := s.OpenIDC != nil && s.OpenIDC.GroupsClaim != ""
+	if len(s.GroupPrincipals) > 0 && !groupsClaim {
+		return errors.New("group_principals used but oidc groups_claim not configured")
+	} else if groupsClaim && len(s.GroupPrincipals) == 0 {
+		return errors.New("oidc groups_claim configured but no group_principals given")
+	}
+
+	if s.ForbidSharedKeys {
+		err := s.checkSharedKeys()
+		if err != nil {
+			return err
+		}
+	}
 
 	return nil
 }
 
+// Check the named extensions are in permittedExtensions, or are in
+// valuedExtensions with a value matching their pattern
+func checkExtensions(name string, extensions map[string]string) error {
+	for k, v := range extensions {
+		if pattern, ok := valuedExtensions[k]; ok {
+			if !pattern.MatchString(v) {
+				return fmt.Errorf("%s: value '%s' for key %s not permitted", name, v, k)
+			}
+			continue
+		}
+		val, ok := permittedExtensions[k]
+		if !ok {
+			return fmt.Errorf("%s: extension %s not permitted", name, k)
+		}
+		if v != val {
+			return fmt.Errorf("%s: value '%s' for key %s not permitted, expected '%s'", name, v, k, val)
+		}
+	}
+	return nil
+}
+
+// Check an agent lifetime, where zero means not set
+func (s *Settings) validateAgentLifetime(name string, lifetime time.Duration) error {
+	if lifetime < 0 {
+		return fmt.Errorf("%s must not be negative", name)
+	} else if lifetime > s.Validity {
+		return fmt.Errorf("%s must not exceed validity", name)
+	}
+	return nil
+}
+
+// Parse a list of CIDR networks from the named setting. A bare address is
+// taken as a single host.
+func parseNetworks(name string, cidrs []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, c := range cidrs {
+		if !strings.Contains(c, "/") {
+			ip := net.ParseIP(c)
+			if ip == nil {
+				return nil, fmt.Errorf("%s: invalid address %q", name, c)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", name, err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// Report whether a client at ip may connect. Denied networks take
+// precedence; if no allowed networks are given, all others are allowed.
+func (s *Settings) NetworkAllowed(ip net.IP) bool {
+	for _, n := range s.deniedNets {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	if len(s.allowedNets) == 0 {
+		return true
+	}
+	for _, n := range s.allowedNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Report whether a client with the given version string, such as
+// "SSH-2.0-OpenSSH_8.9", may connect. If no allowed_client_versions are
+// given, all are allowed.
+func (s *Settings) ClientVersionAllowed(version string) bool {
+	if len(s.clientVersions) == 0 {
+		return true
+	}
+	for _, re := range s.clientVersions {
+		if re.MatchString(version) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check that no public key is assigned to more than one user
+func (s *Settings) checkSharedKeys() error {
+	shared := s.SharedKeys()
+	if len(shared) > 0 {
+		return errors.New(shared[0])
+	}
+	return nil
+}
+
+// Describe each public key which is listed for more than one user, naming
+// the users, in the order the keys first appear. Such a key authenticates
+// as whichever of the users the client gives the name of.
+func (s *Settings) SharedKeys() []string {
+	var keys []ssh.PublicKey
+	owners := map[string][]string{}
+	for _, v := range s.Users {
+		for _, key := range v.publicKeys {
+			k := string(key.Marshal())
+			names := owners[k]
+			if len(names) == 0 {
+				keys = append(keys, key)
+			} else if names[len(names)-1] == v.Name {
+				continue
+			}
+			owners[k] = append(names, v.Name)
+		}
+	}
+	var shared []string
+	for _, key := range keys {
+		if names := owners[string(key.Marshal())]; len(names) > 1 {
+			shared = append(shared, fmt.Sprintf("public key %s is listed for users %s",
+				ssh.FingerprintSHA256(key), strings.Join(names, ", ")))
+		}
+	}
+	return shared
+}
+
+// Return the source of randomness for key generation, certificate
+// signing and the oidc flow
+func (s *Settings) Random() io.Reader {
+	if s.random == nil {
+		return rand.Reader
+	}
+	return s.random
+}
+
+// Return a user record for a user with no user_principals entry, who has
+// logged in with oidc as the username given by the username_claim. Their
+// principals are the oidc default_principals, with %u replaced by name.
+func (s *Settings) ClaimedUser(name string) (*UserPrincipals, error) {
+	if s.OpenIDC == nil || s.OpenIDC.UsernameClaim == "" {
+		return nil, fmt.Errorf("user %s not found", name)
+	}
+	principals := make([]string, 0, len(s.OpenIDC.DefaultPrincipals))
+	for _, p := range s.OpenIDC.DefaultPrincipals {
+		principals = append(principals, strings.Replace(p, "%u", name, -1))
+	}
+	return &UserPrincipals{Name: name, Principals: principals}, nil
+}
+
+// Return the user's principals followed by those default_principals they
+// do not already have, unless they have no_default_principals set. The
+// user's own list is left unchanged.
+func (s *Settings) UserPrincipalList(up *UserPrincipals) []string {
+	principals := append([]string{}, up.Principals...)
+	if up.NoDefaultPrincipals {
+		return principals
+	}
+	for _, d := range s.DefaultPrincipals {
+		found := false
+		for _, p := range principals {
+			if p == d {
+				found = true
+				break
+			}
+		}
+		if !found {
+			principals = append(principals, d)
+		}
+	}
+	return principals
+}
+
+// Return those of the user's principals, including the default_principals,
+// which are granted by at least one of the given oidc groups
+func (s *Settings) PrincipalsForGroups(up *UserPrincipals, groups []string) []string {
+	granted := map[string]bool{}
+	for _, g := range groups {
+		for _, p := range s.GroupPrincipals[g] {
+			granted[p] = true
+		}
+	}
+	principals := []string{}
+	for _, p := range s.UserPrincipalList(up) {
+		if granted[p] {
+			principals = append(principals, p)
+		}
+	}
+	return principals
+}
+
+// Return how long the user's agent should keep their certificate,
+// defaulting to the certificate validity
+func (s *Settings) UserAgentLifetime(up *UserPrincipals) time.Duration {
+	if up.AgentLifetime > 0 {
+		return up.AgentLifetime
+	} else if s.AgentLifetime > 0 {
+		return s.AgentLifetime
+	}
+	return s.Validity
+}
+
+// Return the extensions for the user's certificates. A user's own
+// extensions replace the global ones entirely, rather than adding to them.
+// Host certificates carry none.
+func (s *Settings) UserExtensions(up *UserPrincipals) map[string]string {
+	if up.CertificateType() == ssh.HostCert {
+		return nil
+	}
+	if up.Extensions != nil {
+		return up.Extensions
+	}
+	return s.Extensions
+}
+
+// Return whether the user's agent should confirm each use of their
+// certificate
+func (s *Settings) UserAgentConfirm(up *UserPrincipals) bool {
+	if up.AgentConfirm != nil {
+		return *up.AgentConfirm
+	}
+	return s.AgentConfirm
+}
+
+// Return the CA key which signs the user's certificates, of caKeys: the
+// one their ca names, or else the first
+func (s *Settings) UserCAKey(up *UserPrincipals, caKeys []ssh.Signer) (ssh.Signer, error) {
+	if up.CA == "" {
+		return caKeys[0], nil
+	}
+	caKey := caKeyByFingerprint(caKeys, s.CANames[up.CA])
+	if caKey == nil {
+		return nil, fmt.Errorf("ca %s (%s) is not one of the CA keys loaded", up.CA, s.CANames[up.CA])
+	}
+	return caKey, nil
+}
+
+// Check that every CA key in ca_names is one of caKeys
+func (s *Settings) CheckCANames(caKeys []ssh.Signer) error {
+	for name, fingerprint := range s.CANames {
+		if caKeyByFingerprint(caKeys, fingerprint) == nil {
+			return fmt.Errorf("ca_names %s (%s) is not one of the CA keys loaded", name, fingerprint)
+		}
+	}
+	return nil
+}
+
+func caKeyByFingerprint(caKeys []ssh.Signer, fingerprint string) ssh.Signer {
+	for _, caKey := range caKeys {
+		if ssh.FingerprintSHA256(caKey.PublicKey()) == fingerprint {
+			return caKey
+		}
+	}
+	return nil
+}
+
+// Report whether auth is a CA trusted to sign certificates which users
+// may authenticate with
+func (s *Settings) IsTrustedUserCA(auth ssh.PublicKey) bool {
+	for _, key := range s.trustedCAKeys {
+		if bytes.Equal(auth.Marshal(), key.Marshal()) {
+			return true
+		}
+	}
+	return false
+}
+
+// Report whether clients may authenticate with a key of this type. All
+// key types are accepted when accepted_key_types is empty.
+func (s *Settings) KeyTypeAccepted(keyType string) bool {
+	if len(s.AcceptedKeyTypes) == 0 {
+		return true
+	}
+	for _, pattern := range s.AcceptedKeyTypes {
+		if ok, _ := path.Match(pattern, keyType); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Report whether any of the user's principals contains a wildcard, which
+// OpenSSH may treat as matching other principals
+func (up *UserPrincipals) HasWildcardPrincipal() bool {
+	for _, p := range up.Principals {
+		if strings.ContainsAny(p, "*?") {
+			return true
+		}
+	}
+	return false
+}
+
 func (up *UserPrincipals) PublicKeys() []ssh.PublicKey {
 	return up.publicKeys
 }
+
+// Report whether certificates may be issued to the user
+func (up *UserPrincipals) IsEnabled() bool {
+	return up.Enabled == nil || *up.Enabled
+}
+
+// Return when the user's account expires, or the zero time if it does not
+func (up *UserPrincipals) Expiry() time.Time {
+	return up.expiry
+}
+
+// Report whether the user's account has expired at time t
+func (up *UserPrincipals) Expired(t time.Time) bool {
+	return !up.expiry.IsZero() && !t.Before(up.expiry)
+}
+
+// Return the type of certificate issued to the user, ssh.UserCert unless
+// their cert_type is host
+func (up *UserPrincipals) CertificateType() uint32 {
+	if up.CertType == "host" {
+		return ssh.HostCert
+	}
+	return ssh.UserCert
+}
+
+// Report whether the user must give a TOTP code as a second factor
+func (up *UserPrincipals) RequiresTOTP() bool {
+	return len(up.totpKey) > 0
+}
+
+// Check a TOTP code given by the user at time t, returning the time step
+// whose code it is, so that a code which has been accepted once can be
+// refused if it is given again
+func (up *UserPrincipals) CheckTOTP(code string, t time.Time) (uint64, bool) {
+	if !up.RequiresTOTP() {
+		return 0, false
+	}
+	return checkTOTP(up.totpKey, code, t)
+}
+
+// Return the principals to grant from a user's principals and
+// principal_patterns. With no request, all the user's principals are
+// granted; otherwise only those requested which are among the user's
+// principals or match a pattern, though never a requested principal
+// containing wildcards itself.
+func GrantPrincipals(principals []string, patterns []string, requested []string) []string {
+	if len(requested) == 0 {
+		return append([]string{}, principals...)
+	}
+	allowed := map[string]bool{}
+	for _, p := range principals {
+		allowed[p] = true
+	}
+	granted := []string{}
+	seen := map[string]bool{}
+	for _, r := range requested {
+		if seen[r] {
+			continue
+		}
+		ok := allowed[r]
+		if !ok && !strings.ContainsAny(r, "*?[\\") {
+			for _, pattern := range patterns {
+				if ok, _ = path.Match(pattern, r); ok {
+					break
+				}
+			}
+		}
+		if ok {
+			granted = append(granted, r)
+			seen[r] = true
+		}
+	}
+	return granted
+}
+
+// Return the host's public key, as the list of public keys it may
+// authenticate with
+func (h *HostPrincipals) PublicKeys() []ssh.PublicKey {
+	return h.publicKeys
+}
@@ -1,7 +1,17 @@
 package util
 
 import (
+	"bytes"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	yaml "gopkg.in/yaml.v3"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
 	"testing"
+	"time"
 )
 
 func settingsLoad(t *testing.T) Settings {
@@ -69,6 +79,23 @@ func TestSettingsParse6(t *testing.T) {
 	}
 }
 
+func TestValuedExtensions(t *testing.T) {
+	settings := settingsLoad(t)
+	settings.Extensions["login@github.com"] = "jane-acme"
+	err := settings.validate()
+	if err != nil {
+		t.Errorf("unexpected error with login@github.com: %v", err)
+	}
+	for _, v := range []string{"", "-jane", "jane--acme", "jane acme"} {
+		settings.Extensions["login@github.com"] = v
+		err = settings.validate()
+		t.Logf("Error (expected): %v", err)
+		if err == nil {
+			t.Errorf("login@github.com value %q passed", v)
+		}
+	}
+}
+
 func TestSettingsParse7(t *testing.T) {
 	settings := settingsLoad(t)
 	settings.Users[0].OIDCSubject = "12345"
@@ -153,14 +180,20 @@ func TestUserSettings6(t *testing.T) {
 	if err != nil {
 		t.Errorf("UserByNamelookup failed: %v", err)
 	}
-	_, err = settings.UserByName("nonexistent")
-	if err == nil {
+	u, err := settings.UserByName("nonexistent")
+	if err == nil || u != nil {
 		t.Errorf("Invalid UserByName lookup succeeded")
 	}
-	_, err = settings.UserByName("")
-	if err == nil {
+	if err == ErrEmptyUsername {
+		t.Errorf("unknown user reported as an empty username")
+	}
+	u, err = settings.UserByName("")
+	if err == nil || u != nil {
 		t.Errorf("Invalid UserByName lookup succeeded")
 	}
+	if err != ErrEmptyUsername {
+		t.Errorf("empty username not reported as such: %v", err)
+	}
 }
 
 func TestUserAuth1(t *testing.T) {
@@ -187,3 +220,819 @@ func TestUserAuth2(t *testing.T) {
 		t.Errorf("fingerprints not matching authorized_key should not be allowed")
 	}
 }
+
+func TestUserSettings7(t *testing.T) {
+	settings := settingsLoad(t)
+	settings.Users[1].AuthorizedKey = settings.Users[0].AuthorizedKey
+	settings.Users[1].Fingerprint = ""
+	err := settings.validate()
+	if err != nil {
+		t.Errorf("shared key should be allowed by default: %v", err)
+	}
+	shared := settings.SharedKeys()
+	want := fmt.Sprintf("public key %s is listed for users %s, %s", ssh.FingerprintSHA256(settings.Users[0].publicKeys[0]),
+		settings.Users[0].Name, settings.Users[1].Name)
+	if len(shared) != 1 || shared[0] != want {
+		t.Errorf("unexpected shared keys %q", shared)
+	}
+	settings.ForbidSharedKeys = true
+	err = settings.validate()
+	t.Logf("Error (expected): %v", err)
+	if err == nil {
+		t.Errorf("shared key passed with forbid_shared_keys")
+	}
+}
+
+func TestSettingsParse9(t *testing.T) {
+	settings := settingsLoad(t)
+	settings.ValidityRounding = 15 * time.Minute
+	err := settings.validate()
+	if err != nil {
+		t.Errorf("unexpected error with validity_rounding: %v", err)
+	}
+	settings.ValidityRounding = settings.Validity
+	err = settings.validate()
+	t.Logf("Error (expected): %v", err)
+	if err == nil {
+		t.Errorf("validity_rounding not less than validity should not be allowed")
+	}
+}
+
+func TestSettingsParse10(t *testing.T) {
+	settings := settingsLoad(t)
+	if !settings.KeyTypeAccepted("ssh-rsa") {
+		t.Errorf("all key types should be accepted by default")
+	}
+	settings.AcceptedKeyTypes = []string{"ssh-ed25519", "ecdsa-sha2-*"}
+	err := settings.validate()
+	if err != nil {
+		t.Errorf("unexpected error with accepted_key_types: %v", err)
+	}
+	if settings.KeyTypeAccepted("ssh-rsa") {
+		t.Errorf("ssh-rsa should not be accepted")
+	}
+	if !settings.KeyTypeAccepted("ecdsa-sha2-nistp384") {
+		t.Errorf("ecdsa-sha2-nistp384 should be accepted")
+	}
+	settings.AcceptedKeyTypes = []string{"ssh-foo"}
+	err = settings.validate()
+	t.Logf("Error (expected): %v", err)
+	if err == nil {
+		t.Errorf("unsupported key type should not be allowed")
+	}
+}
+
+func TestUserSettings8(t *testing.T) {
+	settings := settingsLoad(t)
+	settings.Users[0].Principals = []string{"web", "*"}
+	err := settings.validate()
+	t.Logf("Error (expected): %v", err)
+	if err == nil {
+		t.Errorf("wildcard principal passed without allow_wildcard_principal")
+	}
+	settings.AllowWildcard = true
+	err = settings.validate()
+	if err != nil {
+		t.Errorf("wildcard principal failed with allow_wildcard_principal: %v", err)
+	}
+}
+
+func TestRandomSource(t *testing.T) {
+	for _, source := range []string{"", "system", "/dev/urandom"} {
+		_, err := openRandomSource(source)
+		if err != nil {
+			t.Errorf("random_source %q failed: %v", source, err)
+		}
+	}
+	_, err := openRandomSource("../settings.example.yaml")
+	t.Logf("Error (expected): %v", err)
+	if err == nil {
+		t.Errorf("regular file accepted as random_source")
+	}
+}
+
+func TestUserAgentSettings(t *testing.T) {
+	settings := settingsLoad(t)
+	u := settings.Users[0]
+	if settings.UserAgentLifetime(settings.Users[1]) != settings.Validity {
+		t.Errorf("agent lifetime should default to validity")
+	}
+	settings.AgentLifetime = time.Hour
+	settings.AgentConfirm = true
+	u.AgentLifetime = 5 * time.Minute
+	confirm := false
+	u.AgentConfirm = &confirm
+	err := settings.validate()
+	if err != nil {
+		t.Errorf("unexpected error with agent settings: %v", err)
+	}
+	if settings.UserAgentLifetime(u) != 5*time.Minute {
+		t.Errorf("per-user agent_lifetime not applied")
+	}
+	if settings.UserAgentConfirm(u) || !settings.UserAgentConfirm(settings.Users[1]) {
+		t.Errorf("per-user agent_confirm not applied")
+	}
+	u.AgentLifetime = settings.Validity + 1
+	err = settings.validate()
+	t.Logf("Error (expected): %v", err)
+	if err == nil {
+		t.Errorf("agent_lifetime longer than validity passed")
+	}
+}
+
+func TestGroupPrincipals(t *testing.T) {
+	settings := settingsLoad(t)
+	settings.GroupPrincipals = map[string][]string{
+		"admins":     {"web", "database", "root"},
+		"developers": {"web", "staging"},
+	}
+	err := settings.validate()
+	t.Logf("Error (expected): %v", err)
+	if err == nil {
+		t.Errorf("group_principals passed without oidc groups_claim")
+	}
+	settings.OpenIDC = &OpenIDC{
+		Issuer:      "https://accounts.google.com",
+		ClientID:    "XXXXXXXX",
+		GroupsClaim: "groups",
+	}
+	err = settings.validate()
+	if err != nil {
+		t.Errorf("unexpected error with group_principals: %v", err)
+	}
+	u := settings.Users[0]
+	p := settings.PrincipalsForGroups(u, []string{"developers", "unknown"})
+	if len(p) != 1 || p[0] != "web" {
+		t.Errorf("unexpected principals for developers: %v", p)
+	}
+	p = settings.PrincipalsForGroups(u, []string{})
+	if len(p) != 0 {
+		t.Errorf("unexpected principals for no groups: %v", p)
+	}
+}
+
+func TestTrustedUserCAKeys(t *testing.T) {
+	settings := settingsLoad(t)
+	settings.TrustedUserCAKeys = []string{settings.Users[1].AuthorizedKey}
+	err := settings.validate()
+	if err != nil {
+		t.Errorf("unexpected error with trusted_user_ca_keys: %v", err)
+	}
+	if !settings.IsTrustedUserCA(settings.Users[1].PublicKeys()[0]) {
+		t.Errorf("trusted user ca key not recognised")
+	}
+	if settings.IsTrustedUserCA(settings.Users[0].PublicKeys()[0]) {
+		t.Errorf("untrusted key recognised as user ca")
+	}
+	settings.TrustedUserCAKeys = []string{"ssh-rsa notakey"}
+	err = settings.validate()
+	t.Logf("Error (expected): %v", err)
+	if err == nil {
+		t.Errorf("invalid trusted_user_ca_keys entry passed")
+	}
+}
+
+func TestUserTOTP(t *testing.T) {
+	settings := settingsLoad(t)
+	u := settings.Users[0]
+	if u.RequiresTOTP() {
+		t.Errorf("user without totp_secret requires totp")
+	}
+	u.TOTPSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+	err := settings.validate()
+	if err != nil {
+		t.Errorf("unexpected error with totp_secret: %v", err)
+	}
+	if step, ok := u.CheckTOTP("081804", time.Unix(1111111109, 0)); !ok || step != 1111111109/30 {
+		t.Errorf("correct totp code rejected or for the wrong step %d", step)
+	}
+	u.TOTPSecret = "GEZDGNBV1"
+	err = settings.validate()
+	t.Logf("Error (expected): %v", err)
+	if err == nil {
+		t.Errorf("malformed totp_secret passed")
+	}
+}
+
+func TestNetworks(t *testing.T) {
+	settings := settingsLoad(t)
+	if !settings.NetworkAllowed(net.ParseIP("192.0.2.1")) {
+		t.Errorf("address refused with no networks set")
+	}
+	settings.AllowedNetworks = []string{"10.0.0.0/8", "2001:db8::/32", "192.0.2.1"}
+	settings.DeniedNetworks = []string{"10.99.0.0/16"}
+	err := settings.validate()
+	if err != nil {
+		t.Errorf("unexpected error with networks: %v", err)
+	}
+	tests := []struct {
+		ip      string
+		allowed bool
+	}{
+		{"10.1.2.3", true},
+		{"10.99.1.1", false},
+		{"2001:db8::1", true},
+		{"192.0.2.1", true},
+		{"192.0.2.2", false},
+	}
+	for _, tt := range tests {
+		if settings.NetworkAllowed(net.ParseIP(tt.ip)) != tt.allowed {
+			t.Errorf("%s expected allowed %v", tt.ip, tt.allowed)
+		}
+	}
+	settings.DeniedNetworks = []string{"10.0.0.0/33"}
+	err = settings.validate()
+	t.Logf("Error (expected): %v", err)
+	if err == nil {
+		t.Errorf("invalid denied_networks entry passed")
+	}
+}
+
+func TestClientVersions(t *testing.T) {
+	settings := settingsLoad(t)
+	if !settings.ClientVersionAllowed("SSH-2.0-PuTTY_Release_0.58") {
+		t.Errorf("client version refused with no allowed_client_versions")
+	}
+	settings.ClientVersions = []string{`^SSH-2\.0-OpenSSH_(8\.[89]|9\.)`}
+	err := settings.validate()
+	if err != nil {
+		t.Errorf("unexpected error with allowed_client_versions: %v", err)
+	}
+	if !settings.ClientVersionAllowed("SSH-2.0-OpenSSH_9.2p1 Debian-2+deb12u7") {
+		t.Errorf("allowed client version refused")
+	}
+	if settings.ClientVersionAllowed("SSH-2.0-OpenSSH_7.4") {
+		t.Errorf("old client version allowed")
+	}
+	settings.ClientVersions = []string{"OpenSSH_("}
+	err = settings.validate()
+	t.Logf("Error (expected): %v", err)
+	if err == nil {
+		t.Errorf("invalid allowed_client_versions passed")
+	}
+}
+
+func TestSessionTimeout(t *testing.T) {
+	settings := settingsLoad(t)
+	if settings.SessionTimeout != defaultSessionTimeout {
+		t.Errorf("unexpected default session_timeout %v", settings.SessionTimeout)
+	}
+	settings.SessionTimeout = -time.Second
+	err := settings.validate()
+	t.Logf("Error (expected): %v", err)
+	if err == nil {
+		t.Errorf("negative session_timeout passed")
+	}
+}
+
+func TestOIDCTimeout(t *testing.T) {
+	settings := settingsLoad(t)
+	if settings.OIDCTimeout != defaultOIDCTimeout {
+		t.Errorf("unexpected default oidc_timeout %v", settings.OIDCTimeout)
+	}
+	settings.OIDCTimeout = -time.Second
+	err := settings.validate()
+	t.Logf("Error (expected): %v", err)
+	if err == nil {
+		t.Errorf("negative oidc_timeout passed")
+	}
+}
+
+func TestReuseRemaining(t *testing.T) {
+	settings := settingsLoad(t)
+	settings.ReuseRemaining = settings.Validity / 2
+	err := settings.validate()
+	if err != nil {
+		t.Errorf("unexpected error with reuse_remaining: %v", err)
+	}
+	settings.ReuseRemaining = settings.Validity
+	err = settings.validate()
+	t.Logf("Error (expected): %v", err)
+	if err == nil {
+		t.Errorf("reuse_remaining equal to validity passed")
+	}
+	settings.ReuseRemaining = -time.Second
+	err = settings.validate()
+	t.Logf("Error (expected): %v", err)
+	if err == nil {
+		t.Errorf("negative reuse_remaining passed")
+	}
+}
+
+func TestUserSKKey(t *testing.T) {
+	settings := settingsLoad(t)
+	u := settings.Users[0]
+	u.AuthorizedKey = skEd25519Key
+	u.Fingerprint = "SHA256:FkB8EsOtLkXgDieVdG2ACMy+vmqeT05s94osBr+qgUU"
+	err := settings.validate()
+	if err != nil {
+		t.Errorf("unexpected error with sk authorized_key: %v", err)
+	}
+	u.Fingerprint = "SHA256:2101Cj/MberzCfXK+OdXUWqElzXG9WSsalDaiwwVe1A"
+	err = settings.validate()
+	t.Logf("Error (expected): %v", err)
+	if err == nil {
+		t.Errorf("mismatched sk fingerprint passed")
+	}
+}
+
+func TestUserExtensions(t *testing.T) {
+	settings := settingsLoad(t)
+	u := settings.Users[0]
+	if len(settings.UserExtensions(u)) != len(settings.Extensions) {
+		t.Errorf("user without extensions not given the global extensions")
+	}
+	err := yaml.Unmarshal([]byte("extensions: {}"), u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exts := settings.UserExtensions(u); exts == nil || len(exts) != 0 {
+		t.Errorf("empty user extensions did not replace the global extensions: %v", exts)
+	}
+	u.Extensions = map[string]string{"permit-pty": "", "permit-everything": ""}
+	err = settings.validate()
+	t.Logf("Error (expected): %v", err)
+	if err == nil {
+		t.Errorf("user extension not in permittedExtensions passed")
+	}
+}
+
+func TestUserEnabled(t *testing.T) {
+	settings := settingsLoad(t)
+	u := settings.Users[0]
+	if !u.IsEnabled() {
+		t.Errorf("user enabled by default")
+	}
+	err := yaml.Unmarshal([]byte("enabled: false"), u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.IsEnabled() {
+		t.Errorf("disabled user reported as enabled")
+	}
+	u.Principals = nil
+	err = settings.validate()
+	t.Logf("Error (expected): %v", err)
+	if err == nil {
+		t.Errorf("disabled user not validated")
+	}
+}
+
+func TestUserExpires(t *testing.T) {
+	settings := settingsLoad(t)
+	u := settings.Users[0]
+	if u.Expired(time.Now()) || !u.Expiry().IsZero() {
+		t.Errorf("user without expires has expired")
+	}
+	u.Expires = "2030-12-31T23:59:59Z"
+	err := settings.validate()
+	if err != nil {
+		t.Errorf("unexpected error with expires: %v", err)
+	}
+	expiry := time.Date(2030, 12, 31, 23, 59, 59, 0, time.UTC)
+	if u.Expired(expiry.Add(-time.Second)) || !u.Expired(expiry) {
+		t.Errorf("unexpected expiry at %v", u.Expiry())
+	}
+	u.Expires = "31/12/2030"
+	err = settings.validate()
+	t.Logf("Error (expected): %v", err)
+	if err == nil {
+		t.Errorf("malformed expires passed")
+	}
+}
+
+func TestPrincipalPatterns(t *testing.T) {
+	settings := settingsLoad(t)
+	u := settings.Users[0]
+	u.Principals = nil
+	err := settings.validate()
+	t.Logf("Error (expected): %v", err)
+	if err == nil {
+		t.Errorf("user with no principals passed")
+	}
+	u.PrincipalPatterns = []string{"web-*"}
+	err = settings.validate()
+	if err != nil {
+		t.Errorf("unexpected error with principal_patterns: %v", err)
+	}
+	u.PrincipalPatterns = []string{"web-["}
+	err = settings.validate()
+	t.Logf("Error (expected): %v", err)
+	if err == nil {
+		t.Errorf("malformed principal pattern passed")
+	}
+}
+
+func TestGrantPrincipals(t *testing.T) {
+	principals := []string{"web", "database"}
+	patterns := []string{"web-*", "db?"}
+	tests := []struct {
+		requested []string
+		granted   []string
+	}{
+		{nil, []string{"web", "database"}},
+		{[]string{"database"}, []string{"database"}},
+		{[]string{"web-1", "db2"}, []string{"web-1", "db2"}},
+		{[]string{"web-1", "web-1", "web"}, []string{"web-1", "web"}},
+		{[]string{"root", "db10", "web-*", "db[1]"}, []string{}},
+	}
+	for _, tt := range tests {
+		granted := GrantPrincipals(principals, patterns, tt.requested)
+		if !reflect.DeepEqual(granted, tt.granted) {
+			t.Errorf("requested %v: granted %v, expected %v", tt.requested, granted, tt.granted)
+		}
+	}
+	if g := GrantPrincipals(nil, patterns, nil); len(g) != 0 {
+		t.Errorf("granted %v with nothing requested", g)
+	}
+}
+
+func TestDefaultPrincipals(t *testing.T) {
+	settings := settingsLoad(t)
+	settings.DefaultPrincipals = []string{"staff", "web"}
+	u := settings.Users[0]
+	own := append([]string{}, u.Principals...)
+	err := settings.validate()
+	if err != nil {
+		t.Errorf("unexpected error with default_principals: %v", err)
+	}
+	p := settings.UserPrincipalList(u)
+	expected := append(append([]string{}, own...), "staff")
+	if !reflect.DeepEqual(p, expected) {
+		t.Errorf("principals %v, expected %v", p, expected)
+	}
+	if !reflect.DeepEqual(u.Principals, own) {
+		t.Errorf("user's principals changed to %v", u.Principals)
+	}
+	u.NoDefaultPrincipals = true
+	if p := settings.UserPrincipalList(u); !reflect.DeepEqual(p, own) {
+		t.Errorf("principals %v with no_default_principals, expected %v", p, own)
+	}
+
+	u.NoDefaultPrincipals = false
+	u.Principals = nil
+	err = settings.validate()
+	if err != nil {
+		t.Errorf("unexpected error for user with only default_principals: %v", err)
+	}
+	u.NoDefaultPrincipals = true
+	err = settings.validate()
+	t.Logf("Error (expected): %v", err)
+	if err == nil {
+		t.Errorf("user with no principals passed")
+	}
+
+	settings.DefaultPrincipals = []string{"*"}
+	err = settings.validate()
+	t.Logf("Error (expected): %v", err)
+	if err == nil {
+		t.Errorf("wildcard default_principals passed")
+	}
+}
+
+func TestUserCA(t *testing.T) {
+	settings := settingsLoad(t)
+	keys := testKeyMatrix(t)
+	oldKey, newKey := keys["ed25519"], keys["ecdsa-p256"]
+	caKeys := []ssh.Signer{oldKey, newKey}
+	u := settings.Users[0]
+	if caKey, err := settings.UserCAKey(u, caKeys); err != nil || caKey != oldKey {
+		t.Errorf("user without ca not signed by the first CA key: %v", err)
+	}
+
+	u.CA = "new"
+	err := settings.validate()
+	t.Logf("Error (expected): %v", err)
+	if err == nil {
+		t.Errorf("ca not in ca_names passed")
+	}
+	settings.CANames = map[string]string{"new": "ecdsa-p256"}
+	err = settings.validate()
+	t.Logf("Error (expected): %v", err)
+	if err == nil {
+		t.Errorf("ca_names entry which is not a fingerprint passed")
+	}
+	settings.CANames = map[string]string{"new": ssh.FingerprintSHA256(newKey.PublicKey())}
+	err = settings.validate()
+	if err != nil {
+		t.Errorf("unexpected error with ca in ca_names: %v", err)
+	}
+	if err = settings.CheckCANames(caKeys); err != nil {
+		t.Errorf("unexpected error checking ca_names: %v", err)
+	}
+	if caKey, err := settings.UserCAKey(u, caKeys); err != nil || caKey != newKey {
+		t.Errorf("user with ca new not signed by the new CA key: %v", err)
+	}
+
+	// the named key was not loaded
+	err = settings.CheckCANames(caKeys[:1])
+	t.Logf("Error (expected): %v", err)
+	if err == nil {
+		t.Errorf("ca_names naming a CA key not loaded passed")
+	}
+	if _, err = settings.UserCAKey(u, caKeys[:1]); err == nil {
+		t.Errorf("user given a CA key which was not loaded")
+	}
+}
+
+func TestUserCertType(t *testing.T) {
+	settings := settingsLoad(t)
+	u := settings.Users[0]
+	if u.CertificateType() != ssh.UserCert {
+		t.Errorf("unexpected default certificate type %d", u.CertificateType())
+	}
+	u.CertType = "host"
+	err := settings.validate()
+	if err != nil {
+		t.Errorf("unexpected error with cert_type host: %v", err)
+	}
+	if u.CertificateType() != ssh.HostCert {
+		t.Errorf("unexpected certificate type %d for cert_type host", u.CertificateType())
+	}
+	if e := settings.UserExtensions(u); len(e) != 0 {
+		t.Errorf("host certificate given extensions %v", e)
+	}
+	u.Extensions = map[string]string{"permit-pty": ""}
+	err = settings.validate()
+	t.Logf("Error (expected): %v", err)
+	if err == nil {
+		t.Errorf("cert_type host with extensions passed")
+	}
+	u.Extensions = nil
+	u.CertType = "server"
+	err = settings.validate()
+	t.Logf("Error (expected): %v", err)
+	if err == nil {
+		t.Errorf("unknown cert_type passed")
+	}
+}
+
+func TestHostPrincipals(t *testing.T) {
+	settings := settingsLoad(t)
+	host := &HostPrincipals{
+		Name:          "web1",
+		AuthorizedKey: "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIHb/CpqApTwkHpDkgESFWa0oF/k38g5ZeO4dCFSh8tDh root@web1.example.com",
+		Principals:    []string{"web1.example.com"},
+	}
+	settings.Hosts = []*HostPrincipals{host}
+	err := settings.validate()
+	if err != nil {
+		t.Errorf("unexpected error with host_principals: %v", err)
+	}
+	if settings.HostValidity != defaultHostValidity {
+		t.Errorf("unexpected default host_validity %v", settings.HostValidity)
+	}
+	err = settings.buildNameMap()
+	if err != nil {
+		t.Errorf("unexpected error building name map: %v", err)
+	}
+	if h, err := settings.HostByName("web1"); err != nil || len(h.PublicKeys()) != 1 {
+		t.Errorf("host web1 not found or has no key: %v", err)
+	}
+	if _, err := settings.HostByName("jane"); err == nil {
+		t.Errorf("user found as a host")
+	}
+
+	host.Name = "jane"
+	err = settings.buildNameMap()
+	t.Logf("Error (expected): %v", err)
+	if err == nil {
+		t.Errorf("host with the name of a user passed")
+	}
+	host.Principals = nil
+	err = settings.validate()
+	t.Logf("Error (expected): %v", err)
+	if err == nil {
+		t.Errorf("host with no principals passed")
+	}
+}
+
+func TestClaimedUser(t *testing.T) {
+	settings := settingsLoad(t)
+	if _, err := settings.ClaimedUser("sam"); err == nil {
+		t.Errorf("claimed user without oidc username_claim")
+	}
+	settings.OpenIDC = &OpenIDC{UsernameClaim: "email", AllowedDomains: []string{"example.com"}}
+	err := settings.validate()
+	t.Logf("Error (expected): %v", err)
+	if err == nil {
+		t.Errorf("username_claim without default_principals passed")
+	}
+	settings.OpenIDC.DefaultPrincipals = []string{"%u", "web"}
+	err = settings.validate()
+	if err != nil {
+		t.Errorf("unexpected error with username_claim: %v", err)
+	}
+	settings.OpenIDC.AllowedDomains = nil
+	err = settings.validate()
+	t.Logf("Error (expected): %v", err)
+	if err == nil {
+		t.Errorf("username_claim without allowed_domains or allowed_usernames passed")
+	}
+	settings.OpenIDC.AllowedUsernames = []string{"sam"}
+	err = settings.validate()
+	if err != nil {
+		t.Errorf("unexpected error with allowed_usernames: %v", err)
+	}
+	u, err := settings.ClaimedUser("sam")
+	if err != nil || u.Name != "sam" || !reflect.DeepEqual(u.Principals, []string{"sam", "web"}) {
+		t.Errorf("unexpected claimed user %+v: %v", u, err)
+	}
+}
+
+func TestValidAfterSkew(t *testing.T) {
+	settings := settingsLoad(t)
+	if *settings.ValidAfterSkew != defaultValidAfterSkew {
+		t.Errorf("unexpected default valid_after_skew %v", *settings.ValidAfterSkew)
+	}
+	skew := time.Hour
+	settings.ValidAfterSkew = &skew
+	err := settings.validate()
+	t.Logf("Error (expected): %v", err)
+	if err == nil {
+		t.Errorf("valid_after_skew of an hour passed")
+	}
+
+	// 0 means no skew, rather than the default
+	example, err := ioutil.ReadFile("../settings.example.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	zero, err := settingsParse(append(example, "\nvalid_after_skew: 0s\n"...), ioutil.ReadFile)
+	if err != nil {
+		t.Fatalf("could not load settings with valid_after_skew 0: %v", err)
+	}
+	if *zero.ValidAfterSkew != 0 {
+		t.Errorf("valid_after_skew of 0 read as %v", *zero.ValidAfterSkew)
+	}
+}
+
+func TestBannerFile(t *testing.T) {
+	settings := settingsLoad(t)
+	settings.BannerFile = "banner.txt"
+	err := settings.validate()
+	t.Logf("Error (expected): %v", err)
+	if err == nil {
+		t.Errorf("banner and banner_file both set passed")
+	}
+	settings.Banner = ""
+	settings.fileBanner = "hello\n"
+	err = settings.validate()
+	if err != nil {
+		t.Errorf("unexpected error with banner_file: %v", err)
+	}
+	if settings.BannerText() != "hello\n" {
+		t.Errorf("unexpected banner %q", settings.BannerText())
+	}
+}
+
+func TestUserBanner(t *testing.T) {
+	settings := settingsLoad(t)
+	settings.Banner = "hello\n"
+	up := settings.Users[0]
+	if got := settings.UserBanner(up); got != "hello\n" {
+		t.Errorf("user without a message given banner %q", got)
+	}
+	up.Message = "web team, see the wiki\n"
+	if got := settings.UserBanner(up); got != up.Message {
+		t.Errorf("user with a message given banner %q", got)
+	}
+}
+
+func TestExpandBanner(t *testing.T) {
+	cert := &ssh.Certificate{Serial: 42, ValidBefore: 1600000000}
+	banner := "hello %u, serial %s expires %e (100%%)"
+	if !BannerUsesCert(banner) {
+		t.Errorf("banner using the certificate not detected")
+	}
+	if BannerUsesCert("hello %u, 100%%s") {
+		t.Errorf("escaped %% taken as a certificate placeholder")
+	}
+	got := ExpandBanner(banner, "bob", cert)
+	want := "hello bob, serial 42 expires 2020-09-13T12:26UTC (100%)"
+	if got != want {
+		t.Errorf("unexpected banner %q, want %q", got, want)
+	}
+	if got = ExpandBanner("hello %u", "bob", nil); got != "hello bob" {
+		t.Errorf("unexpected banner %q", got)
+	}
+}
+
+func TestExpandEnv(t *testing.T) {
+	defer func(r bool) { RequireEnv = r }(RequireEnv)
+	os.Setenv("SSHTOKENCA_TEST_SECRET", "s3cret")
+	os.Setenv("SSHTOKENCA_TEST_INJECT", "x # y: z\nvalidity: 1000h")
+	os.Setenv("SSHTOKENCA_TEST_NUMBER", "5")
+	os.Unsetenv("SSHTOKENCA_TEST_UNSET")
+	data := "# ${SSHTOKENCA_TEST_UNSET}\nclient_secret: ${SSHTOKENCA_TEST_SECRET}\nother: \"${SSHTOKENCA_TEST_UNSET}\"\n" +
+		"banner: pre-${SSHTOKENCA_TEST_INJECT}\nmax_attempts: ${SSHTOKENCA_TEST_NUMBER}\n"
+	RequireEnv = false
+	got, err := expandEnv([]byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var parsed struct {
+		ClientSecret string `yaml:"client_secret"`
+		Other        string `yaml:"other"`
+		Banner       string `yaml:"banner"`
+		MaxAttempts  int    `yaml:"max_attempts"`
+		Validity     string `yaml:"validity"`
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(got))
+	dec.KnownFields(true)
+	if err = dec.Decode(&parsed); err != nil {
+		t.Fatalf("expansion %q did not parse: %v", got, err)
+	}
+	if parsed.ClientSecret != "s3cret" || parsed.Other != "" || parsed.MaxAttempts != 5 {
+		t.Errorf("unexpected expansion %+v", parsed)
+	}
+	if parsed.Banner != "pre-x # y: z\nvalidity: 1000h" || parsed.Validity != "" {
+		t.Errorf("variable value was not kept to its own setting: %+v", parsed)
+	}
+	RequireEnv = true
+	_, err = expandEnv([]byte(data))
+	t.Logf("Error (expected): %v", err)
+	if err == nil {
+		t.Errorf("unset variable passed with RequireEnv")
+	}
+	if _, err = expandEnv([]byte("# ${SSHTOKENCA_TEST_UNSET}\nbanner: hi\n")); err != nil {
+		t.Errorf("unset variable in a comment refused: %v", err)
+	}
+}
+
+func TestUsersFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	example, err := ioutil.ReadFile("../settings.example.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	settingsPath := filepath.Join(dir, "settings.yaml")
+	err = ioutil.WriteFile(settingsPath, append(example, "\nusers_files: [ops.yaml]\n"...), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ops := "user_principals:\n  - name: kim\n    authorized_key: ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIDV258rTR192bEbliZMYxjqVNWYxoKQkh67ds1vZcg1I kim\n    principals: [web]\n"
+	err = ioutil.WriteFile(filepath.Join(dir, "ops.yaml"), []byte(ops), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	settings, err := SettingsLoad(settingsPath)
+	if err != nil {
+		t.Fatalf("could not load settings with users_files: %v", err)
+	}
+	if len(settings.Users) != 3 {
+		t.Errorf("unexpected user length %d", len(settings.Users))
+	}
+	if _, err = settings.UserByName("kim"); err != nil {
+		t.Errorf("user from users_files not found: %v", err)
+	}
+
+	ops = "user_principals:\n  - name: jane\n    authorized_key: ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIDV258rTR192bEbliZMYxjqVNWYxoKQkh67ds1vZcg1I kim\n    principals: [web]\n"
+	err = ioutil.WriteFile(filepath.Join(dir, "ops.yaml"), []byte(ops), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = SettingsLoad(settingsPath)
+	t.Logf("Error (expected): %v", err)
+	if err == nil {
+		t.Errorf("duplicate user in users_files passed")
+	}
+}
+
+func TestMaintenanceMessage(t *testing.T) {
+	settings := settingsLoad(t)
+	if settings.MaintenanceMessage != defaultMaintenanceMessage {
+		t.Errorf("unexpected default maintenance_message %q", settings.MaintenanceMessage)
+	}
+	settings.MaintenanceMessage = "back at 14:00"
+	err := settings.validate()
+	if err != nil || settings.MaintenanceMessage != "back at 14:00" {
+		t.Errorf("maintenance_message not kept: %q, %v", settings.MaintenanceMessage, err)
+	}
+}
+
+func TestListenSettings(t *testing.T) {
+	settings := settingsLoad(t)
+	settings.ListenAddress = "::1"
+	settings.ListenPort = 2222
+	err := settings.validate()
+	if err != nil {
+		t.Errorf("valid listen settings refused: %v", err)
+	}
+	for _, bad := range []struct {
+		address string
+		port    int
+	}{{"localhost", 0}, {"", -1}, {"", 65536}} {
+		settings.ListenAddress, settings.ListenPort = bad.address, bad.port
+		err = settings.validate()
+		t.Logf("Error (expected): %v", err)
+		if err == nil {
+			t.Errorf("bad listen settings %q %d passed", bad.address, bad.port)
+		}
+	}
+}
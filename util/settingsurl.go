@@ -0,0 +1,102 @@
+package util
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// How long fetching a settings URL may take
+const settingsFetchTimeout = 30 * time.Second
+
+// The most settings yaml read from a URL
+const settingsFetchLimit = 16 << 20
+
+// The transport settings are fetched with, or nil for the default; tests
+// set it to trust their own server
+var settingsTransport http.RoundTripper
+
+// Report whether s is an http or https URL rather than a file name. Only
+// https URLs may be loaded; an http URL is recognised so that it is
+// refused, rather than taken for a file name.
+func IsSettingsURL(s string) bool {
+	return strings.HasPrefix(s, "http://") || strings.HasPrefix(s, "https://")
+}
+
+// Load settings yaml from an https URL into a Settings struct. If the URL
+// gives a user name, as in https://user@host/settings.yaml, basic auth is
+// used with that name and password. A relative banner_file or users_files
+// entry is fetched relative to the URL, in the same way. Settings are
+// never fetched, nor redirected, over plain http, since they say who may
+// have certificates.
+func SettingsLoadURL(settingsURL, password string) (Settings, error) {
+	base, err := url.Parse(settingsURL)
+	if err != nil {
+		return Settings{}, err
+	}
+	if _, ok := base.User.Password(); ok {
+		return Settings{}, errors.New("settings URL may not include a password")
+	}
+	client := &http.Client{
+		Timeout:   settingsFetchTimeout,
+		Transport: settingsTransport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if req.URL.Scheme != "https" {
+				return fmt.Errorf("settings redirected to %s://%s%s, which is not https", req.URL.Scheme, req.URL.Host, req.URL.Path)
+			}
+			if len(via) >= 10 {
+				return errors.New("stopped after 10 redirects")
+			}
+			return nil
+		},
+	}
+	fetch := func(u *url.URL) ([]byte, error) {
+		return fetchSettings(client, u, password)
+	}
+
+	data, err := fetch(base)
+	if err != nil {
+		return Settings{}, err
+	}
+	return settingsParse(data, func(p string) ([]byte, error) {
+		u, err := base.Parse(p)
+		if err != nil {
+			return nil, err
+		}
+		return fetch(u)
+	})
+}
+
+// GET u, authenticating as its user, if any
+func fetchSettings(client *http.Client, u *url.URL, password string) ([]byte, error) {
+	target := *u
+	target.User = nil
+	if target.Scheme != "https" {
+		return nil, fmt.Errorf("settings URL %s is not https", target.String())
+	}
+	req, err := http.NewRequest("GET", target.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if u.User != nil {
+		req.SetBasicAuth(u.User.Username(), password)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching %s: %s", target.String(), resp.Status)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, settingsFetchLimit))
+	if err != nil {
+		return nil, fmt.Errorf("fetching %s: %s", target.String(), err)
+	}
+	return data, nil
+}
@@ -0,0 +1,78 @@
+package util
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSettingsLoadURL(t *testing.T) {
+	example, err := ioutil.ReadFile("../settings.example.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"/conf/settings.yaml": string(example) + "\nusers_files: [ops.yaml]\n",
+		"/conf/ops.yaml":      "user_principals:\n  - name: kim\n    authorized_key: ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIDV258rTR192bEbliZMYxjqVNWYxoKQkh67ds1vZcg1I kim\n    principals: [web]\n",
+	}
+	var plain *httptest.Server
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/redirect" {
+			http.Redirect(w, r, plain.URL+"/conf/settings.yaml", http.StatusFound)
+			return
+		}
+		user, password, ok := r.BasicAuth()
+		if !ok || user != "conf" || password != "secret" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		body, ok := files[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(body))
+	}))
+	defer srv.Close()
+	plain = httptest.NewServer(srv.Config.Handler)
+	defer plain.Close()
+	settingsTransport = srv.Client().Transport
+	defer func() { settingsTransport = nil }()
+
+	if !IsSettingsURL(srv.URL) || IsSettingsURL("settings.yaml") {
+		t.Errorf("settings URL not recognised")
+	}
+	settingsURL := strings.Replace(srv.URL, "https://", "https://conf@", 1) + "/conf/settings.yaml"
+	settings, err := SettingsLoadURL(settingsURL, "secret")
+	if err != nil {
+		t.Fatalf("could not load settings URL: %v", err)
+	}
+	if len(settings.Users) != 3 {
+		t.Errorf("unexpected user length %d", len(settings.Users))
+	}
+
+	_, err = SettingsLoadURL(settingsURL, "wrong")
+	t.Logf("Error (expected): %v", err)
+	if err == nil {
+		t.Errorf("wrong password passed")
+	}
+
+	_, err = SettingsLoadURL(strings.Replace(settingsURL, "conf@", "conf:secret@", 1), "")
+	t.Logf("Error (expected): %v", err)
+	if err == nil {
+		t.Errorf("password in URL passed")
+	}
+
+	for _, u := range []string{
+		strings.Replace(plain.URL, "http://", "http://conf@", 1) + "/conf/settings.yaml",
+		strings.Replace(srv.URL, "https://", "https://conf@", 1) + "/redirect",
+	} {
+		_, err = SettingsLoadURL(u, "secret")
+		t.Logf("Error (expected): %v", err)
+		if err == nil {
+			t.Errorf("settings over plain http passed from %s", u)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package util
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"path"
+	"path/filepath"
+)
+
+// Another organisation served by the same process, with its own
+// settings file, giving its users, banner and other settings, and its
+// own CA keys. A tenant serves the connections made to its listen
+// address, and the top level settings serve the rest.
+type Tenant struct {
+	Name         string   `yaml:"name"`
+	Listen       string   `yaml:"listen"`
+	SettingsFile string   `yaml:"settings_file"`
+	CAKeys       []string `yaml:"ca_keys"`
+
+	settings *Settings
+}
+
+// Return the settings of the tenant
+func (t *Tenant) Settings() *Settings {
+	return t.settings
+}
+
+// Return the named tenant
+func (s *Settings) TenantByName(name string) (*Tenant, error) {
+	for _, t := range s.Tenants {
+		if t.Name == name {
+			return t, nil
+		}
+	}
+	return nil, fmt.Errorf("tenant %s not found", name)
+}
+
+// Check the tenants and load their settings files, with readFile. Paths
+// in a tenant's settings file are relative to that file.
+func (s *Settings) loadTenants(readFile func(p string) ([]byte, error)) error {
+	names := map[string]bool{}
+	listens := map[string]bool{}
+	for _, t := range s.Tenants {
+		if t.Name == "" {
+			return errors.New("tenants: each tenant must have a name")
+		}
+		if names[t.Name] {
+			return fmt.Errorf("tenants: duplicate tenant %s", t.Name)
+		}
+		names[t.Name] = true
+		if _, _, err := net.SplitHostPort(t.Listen); err != nil {
+			return fmt.Errorf("tenant %s: listen: %s", t.Name, err)
+		}
+		if listens[t.Listen] {
+			return fmt.Errorf("tenant %s: listen address %s is used by another tenant", t.Name, t.Listen)
+		}
+		listens[t.Listen] = true
+		if len(t.CAKeys) == 0 {
+			return fmt.Errorf("tenant %s: ca_keys must be given", t.Name)
+		}
+		if t.SettingsFile == "" {
+			return fmt.Errorf("tenant %s: settings_file must be given", t.Name)
+		}
+
+		data, err := readFile(t.SettingsFile)
+		if err != nil {
+			return fmt.Errorf("tenant %s: settings_file: %s", t.Name, err)
+		}
+		dir := path.Dir(t.SettingsFile)
+		settings, err := settingsParse(data, func(p string) ([]byte, error) {
+			if !filepath.IsAbs(p) {
+				p = path.Join(dir, p)
+			}
+			return readFile(p)
+		})
+		if err != nil {
+			return fmt.Errorf("tenant %s: %s", t.Name, err)
+		}
+		if len(settings.Tenants) > 0 {
+			return fmt.Errorf("tenant %s: a tenant's settings may not have tenants", t.Name)
+		}
+		t.settings = &settings
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package util
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTenants(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tenants")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	example, err := ioutil.ReadFile("../settings.example.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Mkdir(filepath.Join(dir, "tenants"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tenants := "\ntenants:\n  - name: globex\n    listen: 127.0.0.1:2223\n    settings_file: tenants/globex.yaml\n    ca_keys: [globex_ca]\n"
+	files := map[string]string{
+		"settings.yaml":       string(example) + tenants,
+		"tenants/globex.yaml": "validity: 1h\norganisation: globex\nbanner: globex ssh certificates\nusers_files: [users.yaml]\n",
+		"tenants/users.yaml":  "user_principals:\n  - name: kim\n    authorized_key: ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIDV258rTR192bEbliZMYxjqVNWYxoKQkh67ds1vZcg1I kim\n    principals: [web]\n",
+	}
+	for name, body := range files {
+		err = ioutil.WriteFile(filepath.Join(dir, name), []byte(body), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	settingsPath := filepath.Join(dir, "settings.yaml")
+	settings, err := SettingsLoad(settingsPath)
+	if err != nil {
+		t.Fatalf("could not load settings with tenants: %v", err)
+	}
+	tenant, err := settings.TenantByName("globex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := tenant.Settings()
+	if ts.Organisation != "globex" || ts.BannerText() != "globex ssh certificates" {
+		t.Errorf("unexpected tenant settings %s %q", ts.Organisation, ts.BannerText())
+	}
+	if _, err = ts.UserByName("kim"); err != nil {
+		t.Errorf("tenant user not found: %v", err)
+	}
+	if _, err = settings.UserByName("kim"); err == nil {
+		t.Errorf("tenant user found at the top level")
+	}
+	if _, err = settings.TenantByName("initech"); err == nil {
+		t.Errorf("unknown tenant found")
+	}
+
+	for _, bad := range []string{
+		strings.Replace(tenants, "127.0.0.1:2223", "2223", 1),
+		strings.Replace(tenants, "    ca_keys: [globex_ca]\n", "", 1),
+		strings.Replace(tenants, "globex.yaml", "missing.yaml", 1),
+		tenants + strings.Replace(tenants, "tenants:\n", "", 1),
+	} {
+		err = ioutil.WriteFile(settingsPath, append(example, bad...), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = SettingsLoad(settingsPath)
+		t.Logf("Error (expected): %v", err)
+		if err == nil {
+			t.Errorf("bad tenants passed:%s", bad)
+		}
+	}
+}
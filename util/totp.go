@@ -0,0 +1,70 @@
+package util
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// RFC 6238 parameters, as used by common authenticator apps
+const (
+	totpStep   = 30 * time.Second
+	totpDigits = 6
+	// number of steps either side of the current one which are accepted,
+	// to allow for clock drift and slow typing
+	totpWindow = 1
+)
+
+// Decode a base32 TOTP secret, ignoring case, spaces and padding
+func decodeTOTPSecret(secret string) ([]byte, error) {
+	s := strings.ToUpper(strings.Replace(secret, " ", "", -1))
+	s = strings.TrimRight(s, "=")
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) == 0 {
+		return nil, fmt.Errorf("empty secret")
+	}
+	return key, nil
+}
+
+// Compute the TOTP code for key at the given step counter
+func totpCode(key []byte, counter uint64) string {
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, counter)
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	mod := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", totpDigits, value%mod)
+}
+
+// Check a TOTP code against key at time t, allowing totpWindow steps
+// either side, returning the step whose code it is
+func checkTOTP(key []byte, code string, t time.Time) (uint64, bool) {
+	code = strings.TrimSpace(code)
+	if len(code) != totpDigits {
+		return 0, false
+	}
+	counter := uint64(t.Unix() / int64(totpStep/time.Second))
+	var step uint64
+	ok := false
+	for i := -totpWindow; i <= totpWindow; i++ {
+		expected := totpCode(key, counter+uint64(i))
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			step, ok = counter+uint64(i), true
+		}
+	}
+	return step, ok
+}
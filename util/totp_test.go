@@ -0,0 +1,52 @@
+package util
+
+import (
+	"testing"
+	"time"
+)
+
+// RFC 6238 appendix B test vectors, truncated to six digits
+func TestTOTPCode(t *testing.T) {
+	key := []byte("12345678901234567890")
+	tests := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+	}
+	for _, tt := range tests {
+		code := totpCode(key, uint64(tt.unix/30))
+		if code != tt.code {
+			t.Errorf("at %d expected %s, got %s", tt.unix, tt.code, code)
+		}
+	}
+}
+
+func TestCheckTOTP(t *testing.T) {
+	key, err := decodeTOTPSecret("GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1111111109, 0)
+	if step, ok := checkTOTP(key, "081804", now); !ok || step != 1111111109/30 {
+		t.Errorf("current code rejected or for the wrong step %d", step)
+	}
+	if step, ok := checkTOTP(key, "081804", now.Add(30*time.Second)); !ok || step != 1111111109/30 {
+		t.Errorf("previous code rejected within window or for the wrong step %d", step)
+	}
+	if _, ok := checkTOTP(key, "081804", now.Add(90*time.Second)); ok {
+		t.Errorf("code accepted outside window")
+	}
+	if _, ok := checkTOTP(key, "81804", now); ok {
+		t.Errorf("short code accepted")
+	}
+	_, err = decodeTOTPSecret("not base32!")
+	t.Logf("Error (expected): %v", err)
+	if err == nil {
+		t.Errorf("malformed secret accepted")
+	}
+}
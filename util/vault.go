@@ -0,0 +1,276 @@
+package util
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// A CA which signs whole certificates itself, rather than signing data
+// handed to it, such as HashiCorp Vault's SSH secrets engine
+type CertSigner interface {
+	// Sign a certificate with the key, principals, validity, key id and
+	// extensions of cert, returning the certificate made by the CA
+	SignCertificate(cert *ssh.Certificate) (*ssh.Certificate, error)
+	// Check the CA is reachable and able to sign
+	Check() error
+}
+
+// The parts of a Vault URI used to locate an SSH secrets engine role, e.g.
+// vault://vault.example.com:8200/ssh-client-signer?role=sshtokenca. The
+// vault+http scheme uses plain http, for a development server.
+type VaultURI struct {
+	Address string
+	Mount   string
+	Role    string
+}
+
+// Report whether s looks like a Vault URI rather than a file name
+func IsVaultURI(s string) bool {
+	return strings.HasPrefix(s, "vault://") || strings.HasPrefix(s, "vault+http://")
+}
+
+// Parse a Vault URI. The host, the mount path of the SSH secrets engine
+// and the role are required.
+func ParseVaultURI(s string) (*VaultURI, error) {
+	if !IsVaultURI(s) {
+		return nil, fmt.Errorf("not a vault uri: %s", s)
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid vault uri: %s", err)
+	}
+	scheme := "https"
+	if u.Scheme == "vault+http" {
+		scheme = "http"
+	}
+	v := &VaultURI{
+		Address: scheme + "://" + u.Host,
+		Mount:   strings.Trim(u.Path, "/"),
+		Role:    u.Query().Get("role"),
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("vault uri has no host: %s", s)
+	} else if v.Mount == "" {
+		return nil, fmt.Errorf("vault uri has no secrets engine mount path: %s", s)
+	} else if v.Role == "" {
+		return nil, fmt.Errorf("vault uri has no role: %s", s)
+	}
+	return v, nil
+}
+
+// A CA key held by Vault's SSH secrets engine. It cannot sign arbitrary
+// data, only certificates, through SignCertificate.
+type VaultSigner struct {
+	uri       *VaultURI
+	token     string
+	client    *http.Client
+	publicKey ssh.PublicKey
+}
+
+// Connect to the Vault SSH secrets engine at uri, fetching its CA public
+// key. token authenticates requests to sign certificates.
+func LoadVaultSigner(uri *VaultURI, token string) (*VaultSigner, error) {
+	v := &VaultSigner{
+		uri:    uri,
+		token:  token,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+	resp, err := v.request("GET", "public_key", nil)
+	if err != nil {
+		return nil, err
+	}
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(resp)
+	if err != nil {
+		return nil, fmt.Errorf("vault public_key: %s", err)
+	}
+	v.publicKey = pub
+	return v, nil
+}
+
+func (v *VaultSigner) PublicKey() ssh.PublicKey {
+	return v.publicKey
+}
+
+func (v *VaultSigner) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
+	return nil, errors.New("vault CA keys can only sign certificates")
+}
+
+// How far the validity Vault gives a certificate may stray outside that
+// asked for, allowing for the time taken to sign and the clocks of the two
+// servers
+const vaultValiditySlack = time.Minute
+
+// Check the token may sign with the role, which needs Vault to be
+// reachable and unsealed and the token to be valid. The token's own
+// capabilities are asked for, which Vault's default policy allows, so
+// that a token which may only sign will do.
+func (v *VaultSigner) Check() error {
+	path := v.uri.Mount + "/sign/" + v.uri.Role
+	body, err := json.Marshal(map[string][]string{"paths": {path}})
+	if err != nil {
+		return err
+	}
+	resp, err := v.call("POST", "sys/capabilities-self", body)
+	if err != nil {
+		return err
+	}
+	// older versions of Vault give the capabilities at the top level
+	var caps struct {
+		Capabilities []string `json:"capabilities"`
+		Data         struct {
+			Capabilities []string `json:"capabilities"`
+		} `json:"data"`
+	}
+	err = json.Unmarshal(resp, &caps)
+	if err != nil {
+		return fmt.Errorf("vault capabilities response: %s", err)
+	}
+	for _, c := range append(caps.Capabilities, caps.Data.Capabilities...) {
+		if c == "update" || c == "root" {
+			return nil
+		}
+	}
+	return fmt.Errorf("vault token may not sign with %s", path)
+}
+
+// Ask Vault to sign a certificate like cert. Vault sets the serial and
+// validity itself; the role must allow the key id and extensions given.
+// A certificate which a role has changed, with other principals, type or
+// extensions, or a longer validity, is refused.
+func (v *VaultSigner) SignCertificate(cert *ssh.Certificate) (*ssh.Certificate, error) {
+	certType := "user"
+	if cert.CertType == ssh.HostCert {
+		certType = "host"
+	}
+	ttl := int64(cert.ValidBefore) - time.Now().Unix()
+	if ttl <= 0 {
+		return nil, errors.New("certificate has already expired")
+	}
+	req := map[string]interface{}{
+		"public_key":       string(ssh.MarshalAuthorizedKey(cert.Key)),
+		"valid_principals": strings.Join(cert.ValidPrincipals, ","),
+		"ttl":              fmt.Sprintf("%ds", ttl),
+		"cert_type":        certType,
+		"key_id":           cert.KeyId,
+		"extensions":       cert.Permissions.Extensions,
+		"critical_options": cert.Permissions.CriticalOptions,
+	}
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := v.request("POST", "sign/"+v.uri.Role, body)
+	if err != nil {
+		return nil, err
+	}
+	var signed struct {
+		Data struct {
+			SignedKey string `json:"signed_key"`
+		} `json:"data"`
+	}
+	err = json.Unmarshal(resp, &signed)
+	if err != nil {
+		return nil, fmt.Errorf("vault sign response: %s", err)
+	}
+	pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(signed.Data.SignedKey))
+	if err != nil {
+		return nil, fmt.Errorf("vault signed_key: %s", err)
+	}
+	signedCert, ok := pub.(*ssh.Certificate)
+	if !ok {
+		return nil, errors.New("vault signed_key is not a certificate")
+	}
+	if !bytes.Equal(signedCert.Key.Marshal(), cert.Key.Marshal()) ||
+		!bytes.Equal(signedCert.SignatureKey.Marshal(), v.publicKey.Marshal()) {
+		return nil, errors.New("vault returned a certificate for another key or CA")
+	}
+	if err := checkSignedLike(signedCert, cert); err != nil {
+		return nil, fmt.Errorf("vault returned a certificate unlike that asked for: %s", err)
+	}
+	return signedCert, nil
+}
+
+// Check a certificate made by a CA has the type, principals, extensions
+// and critical options of cert, and is valid for no longer
+func checkSignedLike(signed, cert *ssh.Certificate) error {
+	if signed.CertType != cert.CertType {
+		return fmt.Errorf("certificate type %d, not %d", signed.CertType, cert.CertType)
+	}
+	if strings.Join(signed.ValidPrincipals, ",") != strings.Join(cert.ValidPrincipals, ",") {
+		return fmt.Errorf("principals %s, not %s", signed.ValidPrincipals, cert.ValidPrincipals)
+	}
+	if !sameOptions(signed.Extensions, cert.Extensions) {
+		return fmt.Errorf("extensions %v, not %v", signed.Extensions, cert.Extensions)
+	}
+	if !sameOptions(signed.CriticalOptions, cert.CriticalOptions) {
+		return fmt.Errorf("critical options %v, not %v", signed.CriticalOptions, cert.CriticalOptions)
+	}
+	slack := uint64(vaultValiditySlack.Seconds())
+	if signed.ValidBefore > cert.ValidBefore+slack || signed.ValidAfter+slack < cert.ValidAfter {
+		return fmt.Errorf("validity %d to %d, beyond %d to %d",
+			signed.ValidAfter, signed.ValidBefore, cert.ValidAfter, cert.ValidBefore)
+	}
+	return nil
+}
+
+// Report whether two sets of certificate options or extensions are the
+// same, an empty set being the same as none
+func sameOptions(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if w, ok := b[k]; !ok || w != v {
+			return false
+		}
+	}
+	return true
+}
+
+// Make a request to the secrets engine, returning the response body
+func (v *VaultSigner) request(method string, path string, body []byte) ([]byte, error) {
+	return v.call(method, v.uri.Mount+"/"+path, body)
+}
+
+// Make a request to the Vault API at path, returning the response body
+func (v *VaultSigner) call(method string, path string, body []byte) ([]byte, error) {
+	endpoint := fmt.Sprintf("%s/v1/%s", v.uri.Address, path)
+	req, err := http.NewRequest(method, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if v.token != "" {
+		req.Header.Set("X-Vault-Token", v.token)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("vault request failed: %s", err)
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, fmt.Errorf("vault request failed: %s", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		var failure struct {
+			Errors []string `json:"errors"`
+		}
+		if json.Unmarshal(data, &failure) == nil && len(failure.Errors) > 0 {
+			return nil, fmt.Errorf("vault %s %s: %s", method, path, strings.Join(failure.Errors, "; "))
+		}
+		return nil, fmt.Errorf("vault %s %s: %s", method, path, resp.Status)
+	}
+	return data, nil
+}
@@ -0,0 +1,222 @@
+package util
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"golang.org/x/crypto/ssh"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVaultURI(t *testing.T) {
+	uri, err := ParseVaultURI("vault://vault.example.com:8200/ssh-client-signer/?role=sshtokenca")
+	if err != nil {
+		t.Fatalf("could not parse vault uri: %v", err)
+	}
+	if uri.Address != "https://vault.example.com:8200" || uri.Mount != "ssh-client-signer" || uri.Role != "sshtokenca" {
+		t.Errorf("wrong vault uri %+v", uri)
+	}
+	uri, err = ParseVaultURI("vault+http://127.0.0.1:8200/ssh?role=dev")
+	if err != nil || uri.Address != "http://127.0.0.1:8200" {
+		t.Errorf("wrong vault+http uri %+v: %v", uri, err)
+	}
+	for _, s := range []string{
+		"/path/to/ca",
+		"vault:///ssh?role=x",
+		"vault://vault.example.com?role=x",
+		"vault://vault.example.com/ssh",
+	} {
+		_, err := ParseVaultURI(s)
+		t.Logf("Error (expected): %v", err)
+		if err == nil {
+			t.Errorf("invalid vault uri %s accepted", s)
+		}
+	}
+}
+
+// A fake Vault SSH secrets engine at mount "ssh", signing with caKey.
+// The token may only sign with role "ca". If tamper is set it may change
+// each certificate before it is signed, as a role's settings might.
+func fakeVault(t *testing.T, caKey ssh.Signer, token string, tamper func(*ssh.Certificate)) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == "GET" && r.URL.Path == "/v1/ssh/public_key":
+			w.Write(ssh.MarshalAuthorizedKey(caKey.PublicKey()))
+		case r.Header.Get("X-Vault-Token") != token:
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"errors":["permission denied"]}`))
+		case r.Method == "POST" && r.URL.Path == "/v1/sys/capabilities-self":
+			var req struct {
+				Paths []string `json:"paths"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				t.Errorf("bad capabilities request: %v", err)
+			}
+			caps := []string{"deny"}
+			if len(req.Paths) == 1 && req.Paths[0] == "ssh/sign/ca" {
+				caps = []string{"update"}
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"data": map[string][]string{"capabilities": caps},
+			})
+		case r.Method == "POST" && r.URL.Path == "/v1/ssh/sign/ca":
+			var req struct {
+				PublicKey       string            `json:"public_key"`
+				ValidPrincipals string            `json:"valid_principals"`
+				TTL             string            `json:"ttl"`
+				CertType        string            `json:"cert_type"`
+				KeyID           string            `json:"key_id"`
+				Extensions      map[string]string `json:"extensions"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				t.Errorf("bad sign request: %v", err)
+			}
+			pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(req.PublicKey))
+			if err != nil {
+				t.Errorf("bad sign request public_key: %v", err)
+			}
+			ttl, _ := time.ParseDuration(req.TTL)
+			now := time.Now()
+			cert := &ssh.Certificate{
+				CertType:        ssh.UserCert,
+				Key:             pub,
+				Serial:          42,
+				KeyId:           req.KeyID,
+				ValidPrincipals: strings.Split(req.ValidPrincipals, ","),
+				ValidAfter:      uint64(now.Add(-30 * time.Second).Unix()),
+				ValidBefore:     uint64(now.Add(ttl).Unix()),
+				Permissions:     ssh.Permissions{Extensions: req.Extensions},
+			}
+			if req.CertType == "host" {
+				cert.CertType = ssh.HostCert
+			}
+			if tamper != nil {
+				tamper(cert)
+			}
+			if err := cert.SignCert(rand.Reader, caKey); err != nil {
+				t.Errorf("could not sign certificate: %v", err)
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"data": map[string]string{"signed_key": string(ssh.MarshalAuthorizedKey(cert))},
+			})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+}
+
+func TestVaultSigner(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caKey, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := fakeVault(t, caKey, "s.token", nil)
+	defer server.Close()
+	uri, err := ParseVaultURI(strings.Replace(server.URL, "http://", "vault+http://", 1) + "/ssh?role=ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v, err := LoadVaultSigner(uri, "s.token")
+	if err != nil {
+		t.Fatalf("could not load vault signer: %v", err)
+	}
+	if string(v.PublicKey().Marshal()) != string(caKey.PublicKey().Marshal()) {
+		t.Errorf("wrong vault CA public key")
+	}
+	if err := v.Check(); err != nil {
+		t.Errorf("vault check failed: %v", err)
+	}
+	signer, err := NewCASigner(v, "")
+	if err != nil || signer != ssh.Signer(v) {
+		t.Errorf("NewCASigner did not return the vault signer: %v", err)
+	}
+
+	cert := signTestCert(t, caKey)
+	cert.KeyId = "acmeinc_jane_from:x"
+	cert.ValidBefore = uint64(time.Now().Add(time.Hour).Unix())
+	cert.Permissions.Extensions = map[string]string{"permit-pty": ""}
+	signed, err := v.SignCertificate(cert)
+	if err != nil {
+		t.Fatalf("vault could not sign certificate: %v", err)
+	}
+	if signed.KeyId != cert.KeyId || signed.ValidPrincipals[0] != "test" || signed.Serial != 42 {
+		t.Errorf("unexpected certificate from vault %+v", signed)
+	}
+	if _, ok := signed.Extensions["permit-pty"]; !ok {
+		t.Errorf("extensions not passed to vault")
+	}
+	checker := &ssh.CertChecker{}
+	if err := checker.CheckCert("test", signed); err != nil {
+		t.Errorf("vault certificate does not check: %v", err)
+	}
+
+	bad, err := LoadVaultSigner(uri, "wrong")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = bad.SignCertificate(cert)
+	t.Logf("Error (expected): %v", err)
+	if err == nil || !strings.Contains(err.Error(), "permission denied") {
+		t.Errorf("sign with a bad token did not fail as expected")
+	}
+
+	other, err := ParseVaultURI(strings.Replace(server.URL, "http://", "vault+http://", 1) + "/ssh?role=other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	v.uri = other
+	err = v.Check()
+	t.Logf("Error (expected): %v", err)
+	if err == nil {
+		t.Errorf("vault check passed for a role the token may not sign with")
+	}
+}
+
+func TestVaultSignerTampered(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caKey, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, tamper := range map[string]func(*ssh.Certificate){
+		"principals": func(c *ssh.Certificate) { c.ValidPrincipals = append(c.ValidPrincipals, "root") },
+		"type":       func(c *ssh.Certificate) { c.CertType = ssh.HostCert },
+		"extensions": func(c *ssh.Certificate) { c.Extensions["permit-port-forwarding"] = "" },
+		"options":    func(c *ssh.Certificate) { c.CriticalOptions = map[string]string{"force-command": "true"} },
+		"validity":   func(c *ssh.Certificate) { c.ValidBefore += 3600 },
+		"backdated":  func(c *ssh.Certificate) { c.ValidAfter = 0 },
+	} {
+		server := fakeVault(t, caKey, "s.token", tamper)
+		uri, err := ParseVaultURI(strings.Replace(server.URL, "http://", "vault+http://", 1) + "/ssh?role=ca")
+		if err != nil {
+			t.Fatal(err)
+		}
+		v, err := LoadVaultSigner(uri, "s.token")
+		if err != nil {
+			t.Fatalf("could not load vault signer: %v", err)
+		}
+		cert := signTestCert(t, caKey)
+		cert.ValidAfter = uint64(time.Now().Add(-time.Minute).Unix())
+		cert.ValidBefore = uint64(time.Now().Add(time.Hour).Unix())
+		cert.Permissions.Extensions = map[string]string{"permit-pty": ""}
+		_, err = v.SignCertificate(cert)
+		t.Logf("Error (expected): %v", err)
+		if err == nil {
+			t.Errorf("certificate with changed %s accepted", name)
+		}
+		server.Close()
+	}
+}